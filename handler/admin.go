@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultAdminAPIKeyHeader = "X-Admin-Key"
+
+// tokenInfo - ORCID API access token details (without the token itself).
+type tokenInfo struct {
+	ORCID     string `json:"orcid"`
+	Email     string `json:"email"`
+	EPPN      string `json:"eppn"`
+	Scopes    string `json:"scopes"`
+	IssueTime string `json:"issue_time"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// userReport - the summary of the user as it is seen by the integration. In the privacy mode
+// the personal identifiers are replaced with the pseudonyms.
+type userReport struct {
+	Identity         Identity   `json:"identity"`
+	ORCID            string     `json:"orcid,omitempty"`
+	Token            *tokenInfo `json:"token,omitempty"`
+	ConsentWithdrawn bool       `json:"consent-withdrawn"`
+	Records          []Record   `json:"records"`
+}
+
+// taskReport - the current affiliation task summary.
+type taskReport struct {
+	ID          int       `json:"id"`
+	CreatedAt   time.Time `json:"created-at"`
+	RecordCount int       `json:"record-count"`
+	IsDue       bool      `json:"is-due"`
+	Task        *Task     `json:"task,omitempty"`
+}
+
+// addAdminRoutes adds the operator REST API routes protected with the given authenticator:
+//
+//   - GET /admin/users/{upi-or-id} - the user identity, ORCID iD, token scopes and the records that would be generated;
+//   - POST /admin/users/{upi-or-id}/resync - triggers the full resync of the user;
+//   - GET /admin/task - the current affiliation task;
+//   - POST /admin/task/activate - activates the current task and starts a new one;
+//   - POST /admin/task/rotate - starts a new task leaving the current one inactive;
+//   - GET|PUT /admin/loglevel - the logging level, e.g., {"level": "debug"};
+//   - GET /admin/degree-codes - the degree code mapping version and the unmapped degrees;
+//   - POST /admin/degree-codes/reload - reloads the degree code mapping;
+//   - GET /admin/conflicts - the ORCID iD conflicts (?status=pending for the review queue, ?format=csv for CSV);
+//   - POST /admin/conflicts/{upi}/resolve - stores the chosen ORCID iD, e.g., {"orcid": "0000-0002-1825-0097"},
+//     in the identity system and removes the conflict;
+//   - DELETE /admin/conflicts/{upi} - dismisses the conflict keeping the stored ORCID iD.
+func addAdminRoutes(mux *http.ServeMux, auth *authenticator) {
+	mux.Handle("/admin/users/", auth.wrap(http.HandlerFunc(adminUsers)))
+	mux.Handle("/admin/task", auth.wrap(http.HandlerFunc(adminTask)))
+	mux.Handle("/admin/task/", auth.wrap(http.HandlerFunc(adminTask)))
+	mux.Handle("/admin/loglevel", auth.wrap(loggingLevel))
+	mux.Handle("/admin/degree-codes", auth.wrap(http.HandlerFunc(adminDegreeCodes)))
+	mux.Handle("/admin/degree-codes/", auth.wrap(http.HandlerFunc(adminDegreeCodes)))
+	mux.Handle("/admin/conflicts", auth.wrap(http.HandlerFunc(adminConflicts)))
+	mux.Handle("/admin/conflicts/", auth.wrap(http.HandlerFunc(adminConflicts)))
+}
+
+// writeJSON writes the JSON encoded response.
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+// writeError writes the JSON encoded error response.
+func writeError(rw http.ResponseWriter, status int, err error) {
+	writeJSON(rw, status, map[string]string{"error": err.Error()})
+}
+
+// isNumericID checks if the value looks like an employment/student ID.
+func isNumericID(uid string) bool {
+	if l := len(uid); l == 0 || l > 10 {
+		return false
+	}
+	_, err := strconv.Atoi(uid)
+	return err == nil
+}
+
+// adminUsers handles the user look-up and resync requests.
+func adminUsers(rw http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/users/"), "/"), "/")
+	upiOrID := parts[0]
+	if !isValidUPI(upiOrID) && !isNumericID(upiOrID) {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid UPI or ID: %q", upiOrID))
+		return
+	}
+	if err := setup(dryRun); err != nil {
+		writeError(rw, http.StatusServiceUnavailable, err)
+		return
+	}
+	var id Identity
+	if err := api.lookup("identity/integrations/v3/identity/"+upiOrID, &id); err != nil {
+		writeError(rw, http.StatusBadGateway, err)
+		return
+	}
+	if id.ID == 0 {
+		writeError(rw, http.StatusNotFound, fmt.Errorf("identity record for %q not found", upiOrID))
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && req.Method == "GET":
+		report, err := newUserReport(id, upiOrID)
+		if err != nil {
+			writeError(rw, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, report)
+	case len(parts) == 2 && parts[1] == "resync" && req.Method == "POST":
+		requestLogger(req).Infof("resync of the user %q (ID: %s) requested", pseudonym(piiUPI, id.Upi), idPseudonym(id.ID))
+		msg, err := (&Event{Subject: id.ID, Type: resyncEventType, requestID: requestID(req)}).handle()
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, map[string]string{"message": msg})
+	default:
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("%s %s is not supported", req.Method, req.URL.Path))
+	}
+}
+
+// newUserReport collects the details of the user and the records that would be generated.
+func newUserReport(id Identity, upiOrID string) (report userReport, err error) {
+	report.Identity = id
+	report.ORCID = id.GetORCID()
+	report.ConsentWithdrawn = consents.isWithdrawn(id.Upi)
+
+	email, orcid := id.EmailAddress, report.ORCID
+	if token, ok := id.GetOrcidAccessToken(&oh); ok {
+		report.Token = &tokenInfo{
+			ORCID:     token.ORCID,
+			Email:     token.Email,
+			EPPN:      token.EPPN,
+			Scopes:    token.Scopes,
+			IssueTime: token.IssueTime,
+			ExpiresIn: token.ExpiresIn,
+		}
+		email, orcid = token.Email, token.ORCID
+	}
+
+	var emp Employment
+	if err = api.lookup("employment/integrations/v1/employee/"+upiOrID, &emp); err != nil {
+		return
+	}
+	var degrees Degrees
+	if err = api.lookup("student/integrations/v1/student/"+upiOrID+"/degree/", &degrees); err != nil {
+		return
+	}
+	report.Records = append(emp.records(email, orcid), degrees.records(email, orcid)...)
+	if privacy != nil {
+		report.Identity = id.pseudonymise()
+		report.ORCID = pseudonym(piiORCID, report.ORCID)
+		if report.Token != nil {
+			report.Token.ORCID = pseudonym(piiORCID, report.Token.ORCID)
+			report.Token.Email = pseudonym(piiEmail, report.Token.Email)
+			report.Token.EPPN = pseudonym(piiEPPN, report.Token.EPPN)
+		}
+		for i := range report.Records {
+			report.Records[i].Email = pseudonym(piiEmail, report.Records[i].Email)
+			report.Records[i].Orcid = pseudonym(piiORCID, report.Records[i].Orcid)
+			// NB! the local IDs of the education records include the student ID
+			report.Records[i].LocalID = pseudonym(piiID, report.Records[i].LocalID)
+		}
+	}
+	return
+}
+
+// currentTaskReport returns the current affiliation task summary.
+func currentTaskReport() taskReport {
+	taskIDMutex.Lock()
+	taskRecordCountMutex.Lock()
+	report := taskReport{ID: taskID, CreatedAt: taskCreatedAt, RecordCount: taskRecordCount}
+	taskRecordCountMutex.Unlock()
+	report.IsDue = isTaskDue()
+	taskIDMutex.Unlock()
+	if report.ID != 0 {
+		var task Task
+		if err := oh.get("api/v1/tasks/"+strconv.Itoa(report.ID), &task); err == nil && task.ID != 0 {
+			report.Task = &task
+		}
+	}
+	return report
+}
+
+// adminTask handles the affiliation task requests.
+func adminTask(rw http.ResponseWriter, req *http.Request) {
+	if err := setup(dryRun); err != nil {
+		writeError(rw, http.StatusServiceUnavailable, err)
+		return
+	}
+	action := strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/task"), "/")
+	switch {
+	case action == "" && req.Method == "GET":
+		writeJSON(rw, http.StatusOK, currentTaskReport())
+	case (action == "activate" || action == "rotate") && req.Method == "POST":
+		if dryRun {
+			requestLogger(req).Infof("DRY-RUN: the task would be %s", iif(action == "activate", "activated", "rotated"))
+			writeJSON(rw, http.StatusOK, map[string]interface{}{"dry-run": true, "action": action, "task": currentTaskReport()})
+			return
+		}
+		taskIDMutex.Lock()
+		previousID := taskID
+		if action == "activate" && taskID != 0 {
+			(&Task{ID: taskID}).activate(oh.with(requestLogger(req)))
+			// NB! the activated task cannot be used any more, a new one gets created with the next event
+			taskID = 0
+		}
+		if err := newTask(oh.with(requestLogger(req))); err != nil {
+			taskIDMutex.Unlock()
+			requestLogger(req).Error(err)
+			writeError(rw, http.StatusBadGateway, err)
+			return
+		}
+		taskRecordCountMutex.Lock()
+		taskRecordCount = 0
+		taskRecordCountMutex.Unlock()
+		newID := taskID
+		taskIDMutex.Unlock()
+		requestLogger(req).Infof("the task %d %s, the new task ID: %d",
+			previousID, iif(action == "activate", "activated", "rotated"), newID)
+		writeJSON(rw, http.StatusOK, currentTaskReport())
+	default:
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("%s %s is not supported", req.Method, req.URL.Path))
+	}
+}
+
+// adminDegreeCodes handles the degree code mapping requests.
+func adminDegreeCodes(rw http.ResponseWriter, req *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/degree-codes"), "/")
+	switch {
+	case action == "" && req.Method == "GET":
+		writeJSON(rw, http.StatusOK, degreeCodes.info())
+	case action == "reload" && req.Method == "POST":
+		if _, err := degreeCodes.reload(); err != nil {
+			writeError(rw, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, degreeCodes.info())
+	default:
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("%s %s is not supported", req.Method, req.URL.Path))
+	}
+}
+
+// adminConflicts handles the ORCID iD conflict report and review requests.
+func adminConflicts(rw http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/conflicts"), "/")
+	if path == "" {
+		if req.Method != "GET" {
+			writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("%s %s is not supported", req.Method, req.URL.Path))
+			return
+		}
+		var list []OrcidConflict
+		status := req.URL.Query().Get("status")
+		for _, c := range conflicts.list() {
+			if status == "" || c.Status == status {
+				list = append(list, c)
+			}
+		}
+		if req.URL.Query().Get("format") == "csv" {
+			rw.Header().Set("Content-Type", "text/csv")
+			writeConflicts(rw, "csv", list)
+			return
+		}
+		if list == nil {
+			list = []OrcidConflict{}
+		}
+		writeJSON(rw, http.StatusOK, list)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	upi := parts[0]
+	c, ok := conflicts.get(upi)
+	if !ok {
+		writeError(rw, http.StatusNotFound, fmt.Errorf("no ORCID iD conflict of the user %q", upi))
+		return
+	}
+	switch {
+	case len(parts) == 1 && req.Method == "DELETE":
+		conflicts.remove(upi)
+		requestLogger(req).Infof("the ORCID iD conflict of the user %q dismissed", pseudonym(piiUPI, upi))
+		writeJSON(rw, http.StatusOK, c)
+	case len(parts) == 2 && parts[1] == "resolve" && req.Method == "POST":
+		var body struct {
+			ORCID string `json:"orcid"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		orcid, err := parseOrcidID(body.ORCID)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		if err := setup(dryRun); err != nil {
+			writeError(rw, http.StatusServiceUnavailable, err)
+			return
+		}
+		id, err := (&Event{}).identity(upi)
+		if err != nil || id.ID == 0 {
+			writeError(rw, http.StatusBadGateway, fmt.Errorf("failed to retrieve the identity record for UPI %s: %v", upi, err))
+			return
+		}
+		if dryRun {
+			requestLogger(req).Infof("DRY-RUN: the ORCID iD conflict of the user %q would be resolved: %s",
+				pseudonym(piiUPI, upi), pseudonym(piiORCID, orcid.String()))
+			writeJSON(rw, http.StatusOK, map[string]interface{}{
+				"dry-run": true, "upi": upi, "orcid": orcid.String(), "write": orcid.String() != id.GetORCID()})
+			return
+		}
+		if orcid.String() != id.GetORCID() {
+			if err = id.writeOrcid(api.with(requestLogger(req)), orcid, nil); err != nil {
+				writeError(rw, http.StatusBadGateway, err)
+				return
+			}
+		}
+		conflicts.remove(upi)
+		requestLogger(req).Infof("the ORCID iD conflict of the user %q resolved: %s",
+			pseudonym(piiUPI, upi), pseudonym(piiORCID, orcid.String()))
+		writeJSON(rw, http.StatusOK, map[string]string{"upi": upi, "orcid": orcid.String()})
+	default:
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("%s %s is not supported", req.Method, req.URL.Path))
+	}
+}
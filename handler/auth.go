@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAPIKeyHeader       = "apikey"
+	defaultSignatureTolerance = 300
+	defaultMaxBodySize        = 1 << 20
+	signatureHeader           = "X-Signature"
+	signatureTimestampHeader  = "X-Signature-Timestamp"
+)
+
+// authenticator - optional incoming request authentication of the stand-alone server:
+//
+//   - API key header check (WEBHOOK_APIKEY, WEBHOOK_APIKEY_HEADER);
+//   - HMAC-SHA256 body signature (WEBHOOK_SECRET, WEBHOOK_SIGNATURE_TOLERANCE), where the signature
+//     is the hex encoded HMAC of "<timestamp>.<body>" sent in the header X-Signature and
+//     the Unix timestamp is sent in the header X-Signature-Timestamp;
+//   - mutual TLS with the client certificate allow list (TLS_CLIENT_CA_FILE, TLS_CLIENT_ALLOW).
+//
+// If more than one method is configured, the request has to pass all of them.
+// Missing credentials result in 401 and invalid credentials in 403 (as Kong does).
+// The request bodies larger than the limit (MAX_BODY_SIZE) get rejected with 413.
+type authenticator struct {
+	maxBodySize       int64
+	apiKey            string
+	apiKeyHeader      string
+	secret            []byte
+	tolerance         time.Duration
+	requireClientCert bool
+	allowedClients    map[string]bool
+	// seen signatures (to prevent replays)
+	seen      map[string]time.Time
+	seenMutex sync.Mutex
+	now       func() time.Time
+}
+
+// newAuthenticator configures the request authentication.
+func newAuthenticator() *authenticator {
+	wc := config.Server.Webhook
+	a := authenticator{
+		maxBodySize:       int64(config.Server.MaxBodySize),
+		apiKey:            string(wc.APIKey),
+		apiKeyHeader:      wc.APIKeyHeader,
+		secret:            []byte(wc.Secret),
+		tolerance:         wc.SignatureTolerance,
+		requireClientCert: config.Server.TLS.ClientCAFile != "",
+		seen:              make(map[string]time.Time),
+		now:               time.Now,
+	}
+	if len(config.Server.TLS.ClientAllow) > 0 {
+		a.allowedClients = make(map[string]bool)
+		for _, name := range config.Server.TLS.ClientAllow {
+			a.allowedClients[name] = true
+		}
+	}
+	return &a
+}
+
+// isEnabled checks if any of the authentication methods is configured.
+func (a *authenticator) isEnabled() bool {
+	return a.apiKey != "" || len(a.secret) > 0 || a.requireClientCert || a.allowedClients != nil
+}
+
+// authError - authentication failure with the HTTP status code to respond with.
+type authError struct {
+	status int
+	error
+}
+
+func unauthorized(format string, args ...interface{}) *authError {
+	return &authError{http.StatusUnauthorized, fmt.Errorf(format, args...)}
+}
+
+func forbidden(format string, args ...interface{}) *authError {
+	return &authError{http.StatusForbidden, fmt.Errorf(format, args...)}
+}
+
+// authenticate verifies the request. The body is the request body that has already been read.
+func (a *authenticator) authenticate(req *http.Request, body []byte) *authError {
+
+	if a.requireClientCert || a.allowedClients != nil {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			return unauthorized("missing client certificate")
+		}
+		if a.allowedClients != nil && !a.isAllowedClient(req.TLS.VerifiedChains[0][0]) {
+			return forbidden("client certificate %q is not allowed", req.TLS.VerifiedChains[0][0].Subject.CommonName)
+		}
+	}
+
+	if a.apiKey != "" {
+		key := req.Header.Get(a.apiKeyHeader)
+		if key == "" {
+			return unauthorized("missing API key")
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(a.apiKey)) != 1 {
+			return forbidden("invalid API key")
+		}
+	}
+
+	if len(a.secret) > 0 {
+		if err := a.verifySignature(req.Header, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isAllowedClient checks if either the subject common name or any of the DNS names
+// of the client certificate is in the allow list.
+func (a *authenticator) isAllowedClient(cert *x509.Certificate) bool {
+	if a.allowedClients[cert.Subject.CommonName] {
+		return true
+	}
+	for _, name := range cert.DNSNames {
+		if a.allowedClients[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// sign computes the HMAC-SHA256 signature of the timestamped body.
+func (a *authenticator) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature verifies the body signature and the timestamp.
+func (a *authenticator) verifySignature(h http.Header, body []byte) *authError {
+	signature := strings.TrimPrefix(h.Get(signatureHeader), "sha256=")
+	timestamp := h.Get(signatureTimestampHeader)
+	if signature == "" || timestamp == "" {
+		return unauthorized("missing signature")
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return forbidden("invalid signature timestamp %q", timestamp)
+	}
+	now := a.now()
+	if d := now.Sub(time.Unix(ts, 0)); d > a.tolerance || d < -a.tolerance {
+		return forbidden("the signature timestamp is outside of the tolerance")
+	}
+	if !hmac.Equal([]byte(signature), []byte(a.sign(timestamp, body))) {
+		return forbidden("invalid signature")
+	}
+
+	a.seenMutex.Lock()
+	defer a.seenMutex.Unlock()
+	for s, expiresAt := range a.seen {
+		if now.After(expiresAt) {
+			delete(a.seen, s)
+		}
+	}
+	if _, ok := a.seen[signature]; ok {
+		return forbidden("replayed request")
+	}
+	a.seen[signature] = time.Unix(ts, 0).Add(a.tolerance)
+	return nil
+}
+
+// limit reads the request body rejecting it with 413 if it exceeds the limit (if the limit is set).
+func (a *authenticator) limit(h http.Handler) http.Handler {
+	if a.maxBodySize <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, a.maxBodySize))
+		if err != nil {
+			status := http.StatusBadRequest
+			if int64(len(body)) >= a.maxBodySize {
+				status, err = http.StatusRequestEntityTooLarge, fmt.Errorf("the request body exceeds %d bytes", a.maxBodySize)
+			}
+			log.Warnf("%s %s from %s: %v", req.Method, req.URL.Path, req.RemoteAddr, err)
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(status)
+			fmt.Fprintf(rw, `{"error": %q}`, err.Error())
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// wrap wraps the handler with the request body size limit and the request authentication.
+func (a *authenticator) wrap(h http.Handler) http.Handler {
+	if !a.isEnabled() {
+		return a.limit(h)
+	}
+	return a.limit(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err := a.authenticate(req, body); err != nil {
+			log.Warnf("%s %s from %s: %v", req.Method, req.URL.Path, req.RemoteAddr, err)
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(err.status)
+			fmt.Fprintf(rw, `{"error": %q}`, err.Error())
+			return
+		}
+		h.ServeHTTP(rw, req)
+	}))
+}
+
+// tlsConfig configures the server TLS with the client certificate verification
+// if the client CA file is given.
+func tlsConfig() (*tls.Config, error) {
+	var cfg tls.Config
+	if caFile := config.Server.TLS.ClientCAFile; caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no client CA certificates found in " + caFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return &cfg, nil
+}
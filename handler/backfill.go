@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const hubUsersPageSize = 100
+
+// HubUser - ORCID Hub user record.
+type HubUser struct {
+	Email     string `json:"email"`
+	EPPN      string `json:"eppn"`
+	ORCID     string `json:"orcid"`
+	Confirmed bool   `json:"confirmed"`
+	UpdatedAt string `json:"updated-at"`
+}
+
+// hasUpdateScope checks if any of the tokens grants the access to update the ORCID record.
+func hasUpdateScope(tokens []Token) bool {
+	for _, t := range tokens {
+		if strings.Contains(t.Scopes, "update") {
+			return true
+		}
+	}
+	return false
+}
+
+// hubUsers enumerates the ORCID Hub users with linked ORCID accounts who have granted
+// the access to update their ORCID records and returns their UPIs.
+func hubUsers() (upis []string, err error) {
+	seen := make(map[string]bool)
+	for page := 1; ; page++ {
+		var users []HubUser
+		if err = oh.get(fmt.Sprintf("api/v1/users?page=%d&page_size=%d", page, hubUsersPageSize), &users); err != nil {
+			return
+		}
+		for _, u := range users {
+			if u.ORCID == "" || !strings.HasSuffix(strings.ToLower(u.EPPN), "@auckland.ac.nz") {
+				continue
+			}
+			upi := strings.ToLower(strings.Split(u.EPPN, "@")[0])
+			if !isValidOrcidID(u.ORCID) {
+				log.Warnf("skipped the user %q with an invalid ORCID iD %q", pseudonym(piiUPI, upi), pseudonym(piiORCID, u.ORCID))
+				continue
+			}
+			if !isValidUPI(upi) || seen[upi] {
+				continue
+			}
+			var tokens []Token
+			if err = oh.lookup("api/v1/tokens/"+u.EPPN, &tokens); err != nil {
+				return
+			}
+			if !hasUpdateScope(tokens) {
+				log.Infof("skipped the user %q who hasn't granted the update access", pseudonym(piiUPI, upi))
+				continue
+			}
+			seen[upi] = true
+			upis = append(upis, upi)
+		}
+		if len(users) < hubUsersPageSize {
+			return
+		}
+	}
+}
+
+// readUserList reads the UPIs or the employee/student IDs from the first column of the CSV
+// file. The header row (if any) and the invalid entries are skipped.
+func readUserList(r io.Reader) ([]string, error) {
+	var users []string
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.Comment = '#'
+	for line := 1; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return users, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		value := strings.TrimSpace(row[0])
+		if value == "" {
+			continue
+		}
+		if !isValidUPI(value) && !isNumericID(value) {
+			if line > 1 {
+				log.Warnf("line %d: invalid UPI or ID %q", line, value)
+			}
+			continue
+		}
+		users = append(users, value)
+	}
+}
+
+// checkpoint - the list of the users that have been successfully processed.
+// Each processed user gets appended to the file, so the interrupted run
+// can be resumed.
+type checkpoint struct {
+	sync.Mutex
+	file *os.File
+	done map[string]bool
+}
+
+// openCheckpoint loads the checkpoint file (if it exists) and opens it for appending.
+func openCheckpoint(path string) (*checkpoint, error) {
+	cp := checkpoint{done: make(map[string]bool)}
+	if path == "" {
+		return &cp, nil
+	}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				cp.done[line] = true
+			}
+		}
+		f.Close()
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	cp.file = f
+	return &cp, nil
+}
+
+func (cp *checkpoint) isDone(user string) bool {
+	cp.Lock()
+	defer cp.Unlock()
+	return cp.done[user]
+}
+
+func (cp *checkpoint) markDone(user string) {
+	cp.Lock()
+	defer cp.Unlock()
+	cp.done[user] = true
+	if cp.file != nil {
+		if _, err := fmt.Fprintln(cp.file, user); err != nil {
+			log.Errorf("failed to update the checkpoint: %v", err)
+		}
+	}
+}
+
+func (cp *checkpoint) close() error {
+	if cp.file != nil {
+		return cp.file.Close()
+	}
+	return nil
+}
+
+// BackfillSummary - the outcome of the backfill run. The failures are keyed by
+// the (pseudonymised) UPIs or employee/student IDs.
+type BackfillSummary struct {
+	Total     int               `json:"total"`
+	Processed int               `json:"processed"`
+	Skipped   int               `json:"skipped"`
+	Failed    int               `json:"failed"`
+	Failures  map[string]string `json:"failures,omitempty"`
+	Duration  string            `json:"duration"`
+}
+
+// backfillUser runs the full resync of the user given by the UPI or the employee/student ID.
+func backfillUser(user string, dryRun bool) (string, error) {
+	subject, err := strconv.Atoi(user)
+	if err != nil {
+		var id Identity
+		if err = api.lookup("identity/integrations/v3/identity/"+user, &id); err != nil {
+			return "", err
+		}
+		if id.ID == 0 {
+			return "", fmt.Errorf("identity record for %q not found", user)
+		}
+		subject = id.ID
+	}
+	return (&Event{Subject: subject, Type: resyncEventType, DryRun: dryRun}).handle()
+}
+
+// backfill processes the users with the given number of concurrent workers, skipping
+// the users that have already been processed according to the checkpoint. The progress
+// gets reported every progressInterval.
+func backfill(users []string, concurrency int, cp *checkpoint, dryRun bool, progressInterval time.Duration) BackfillSummary {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		summary = BackfillSummary{Total: len(users), Failures: make(map[string]string)}
+		mutex   sync.Mutex
+		workers sync.WaitGroup
+		queue   = make(chan string)
+		start   = time.Now()
+		done    = make(chan struct{})
+	)
+
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mutex.Lock()
+				log.Infof("progress: %d of %d (skipped: %d, failed: %d)",
+					summary.Processed+summary.Skipped+summary.Failed, summary.Total, summary.Skipped, summary.Failed)
+				mutex.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for user := range queue {
+				_, err := backfillUser(user, dryRun)
+				mutex.Lock()
+				if err != nil {
+					summary.Failed++
+					summary.Failures[userPseudonym(user)] = err.Error()
+				} else {
+					summary.Processed++
+				}
+				mutex.Unlock()
+				if err != nil {
+					log.Errorf("failed to backfill %q: %v", userPseudonym(user), err)
+				} else if !dryRun {
+					cp.markDone(user)
+				}
+			}
+		}()
+	}
+	for _, user := range users {
+		if cp.isDone(user) {
+			mutex.Lock()
+			summary.Skipped++
+			mutex.Unlock()
+			continue
+		}
+		queue <- user
+	}
+	close(queue)
+	workers.Wait()
+	close(done)
+
+	summary.Duration = time.Since(start).Round(time.Millisecond).String()
+	return summary
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// the interval to retry the failed load after (if it is shorter than TTL)
+const cacheRetryInterval = 5 * time.Minute
+
+// cacheLoader loads the value of the key.
+type cacheLoader func(key string) (interface{}, error)
+
+// cacheDecoder decodes the persisted value.
+type cacheDecoder func(data []byte) (interface{}, error)
+
+type cacheEntry struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+// cacheCall - the value load in progress (the concurrent look-ups wait for it).
+type cacheCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// cache - a key/value cache with TTL (no expiry if TTL is not positive). The concurrent
+// look-ups of the same key share a single load. If the value cannot be reloaded, the
+// last-known-good value is used. If the directory is set, the loaded values get persisted
+// (as JSON) and used as the last-known-good values after the restart.
+type cache struct {
+	sync.Mutex
+	ttl     time.Duration
+	loader  cacheLoader
+	decoder cacheDecoder
+	dir     string
+	entries map[string]cacheEntry
+	calls   map[string]*cacheCall
+	now     func() time.Time
+}
+
+// newCache creates the in-memory cache.
+func newCache(ttl time.Duration, loader cacheLoader) *cache {
+	return &cache{
+		ttl:     ttl,
+		loader:  loader,
+		entries: make(map[string]cacheEntry),
+		calls:   make(map[string]*cacheCall),
+		now:     time.Now,
+	}
+}
+
+// persist sets the directory to persist the values in and the decoder of the persisted values.
+func (c *cache) persist(dir string, decoder cacheDecoder) *cache {
+	c.dir, c.decoder = dir, decoder
+	return c
+}
+
+func (c *cache) filename(key string) string {
+	return filepath.Join(c.dir, "cache-"+filepath.Base(key)+".json")
+}
+
+// get returns the cached value or loads it if it is missing or has expired.
+func (c *cache) get(key string) (interface{}, error) {
+	c.Lock()
+	if e, ok := c.entries[key]; ok && (c.ttl <= 0 || c.now().Before(e.expiresAt)) {
+		c.Unlock()
+		return e.value, nil
+	}
+	c.Unlock()
+	return c.load(key)
+}
+
+// load loads the value (sharing the load with the concurrent look-ups) and falls back
+// to the last-known-good value if the load fails.
+func (c *cache) load(key string) (interface{}, error) {
+	c.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.Unlock()
+
+	value, err := c.loader(key)
+	loaded := err == nil
+	if loaded && c.dir != "" {
+		c.store(key, value)
+	}
+
+	c.Lock()
+	if loaded {
+		c.entries[key] = cacheEntry{value: value, expiresAt: c.now().Add(c.ttl)}
+	} else if e, ok := c.entries[key]; ok {
+		log.Warnf("failed to load %q, using the last-known-good value: %v", key, err)
+		// NB! the load gets retried after the retry interval (not with every look-up)
+		c.entries[key] = cacheEntry{value: e.value, expiresAt: c.retryAt()}
+		value, err = e.value, nil
+	} else if v, ok := c.restore(key); ok {
+		log.Warnf("failed to load %q, using the persisted value: %v", key, err)
+		c.entries[key] = cacheEntry{value: v, expiresAt: c.retryAt()}
+		value, err = v, nil
+	}
+	delete(c.calls, key)
+	c.Unlock()
+
+	call.value, call.err = value, err
+	close(call.done)
+	return value, err
+}
+
+// retryAt returns the time to retry the failed load at.
+func (c *cache) retryAt() time.Time {
+	if c.ttl < cacheRetryInterval {
+		return c.now().Add(c.ttl)
+	}
+	return c.now().Add(cacheRetryInterval)
+}
+
+// store persists the value.
+func (c *cache) store(key string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err == nil {
+		fn := c.filename(key)
+		if err = ioutil.WriteFile(fn+".tmp", data, 0600); err == nil {
+			err = os.Rename(fn+".tmp", fn)
+		}
+	}
+	if err != nil {
+		log.Errorf("failed to persist %q: %v", key, err)
+	}
+}
+
+// restore reads the persisted value.
+func (c *cache) restore(key string) (interface{}, bool) {
+	if c.dir == "" {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(c.filename(key))
+	if err != nil {
+		return nil, false
+	}
+	value, err := c.decoder(data)
+	if err != nil {
+		log.Errorf("failed to decode the persisted %q: %v", key, err)
+		return nil, false
+	}
+	return value, true
+}
+
+// refresh reloads all the cached values.
+func (c *cache) refresh() {
+	c.Lock()
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	c.Unlock()
+	for _, key := range keys {
+		c.load(key)
+	}
+}
+
+// start refreshes the cached values in the background every interval
+// (so the look-ups don't have to wait for the values to get reloaded).
+func (c *cache) start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			c.refresh()
+		}
+	}()
+}
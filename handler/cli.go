@@ -0,0 +1,312 @@
+//+build !test,cli
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+const cliUsage = `Usage: %s <command> [options]
+
+Commands:
+  backfill   push the affiliations of the existing ORCID holders to the ORCID Hub
+  reconcile  compare the records that would be generated with the affiliations on ORCID
+  replay     handle the event messages read from the files or stdin
+  conflicts  report the users whose ORCID iDs in the identity system and the ORCID Hub disagree
+  config     'config check' validates and prints out the effective configuration (the secrets are redacted)
+
+Run '%[1]s <command> -h' for the command options.
+`
+
+func usage() {
+	fmt.Fprintf(os.Stderr, cliUsage, os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	if os.Args[1] != "config" {
+		if configErr != nil {
+			log.Fatal("invalid configuration: ", configErr)
+		}
+		log.Debug("configuration:\n", config)
+	}
+	switch os.Args[1] {
+	case "backfill":
+		err = runBackfill(os.Args[2:])
+	case "reconcile":
+		err = runReconcile(os.Args[2:])
+	case "replay":
+		err = runReplay(os.Args[2:])
+	case "conflicts":
+		err = runConflicts(os.Args[2:])
+	case "config":
+		err = runConfig(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		usage()
+	}
+	logger.Sync()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		os.Exit(1)
+	}
+}
+
+// readUserFile reads the list of the users from the CSV file ("-" for stdin).
+func readUserFile(name string) ([]string, error) {
+	if name == "-" {
+		return readUserList(os.Stdin)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readUserList(f)
+}
+
+// runBackfill runs the registration/update flow for either all the ORCID Hub users
+// with linked ORCID accounts or the users listed in the CSV file.
+func runBackfill(args []string) error {
+	var (
+		fs               = flag.NewFlagSet("backfill", flag.ExitOnError)
+		csvFile          = fs.String("csv", "", "the CSV file with the UPIs or the employee/student IDs in the first column (\"-\" for stdin)")
+		concurrency      = fs.Int("concurrency", 4, "the number of the users processed concurrently")
+		checkpointFile   = fs.String("checkpoint", "", "the file to record the processed users in and to resume from")
+		progressInterval = fs.Duration("progress", 10*time.Second, "the progress report interval")
+	)
+	fs.BoolVar(&dryRun, "dry-run", dryRun, "compute the records without writing anywhere")
+	fs.Parse(args)
+
+	if err := setup(dryRun); err != nil {
+		return err
+	}
+
+	var (
+		users []string
+		err   error
+	)
+	if *csvFile == "" {
+		log.Info("enumerating the ORCID Hub users...")
+		users, err = hubUsers()
+	} else {
+		users, err = readUserFile(*csvFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	cp, err := openCheckpoint(*checkpointFile)
+	if err != nil {
+		return err
+	}
+	defer cp.close()
+
+	log.Infof("backfilling %d user(s) (concurrency: %d)", len(users), *concurrency)
+	summary := backfill(users, *concurrency, cp, dryRun, *progressInterval)
+	// submit the records for processing if the task is due
+	activateDueTask(false)
+
+	output, _ := json.MarshalIndent(summary, "", "  ")
+	fmt.Println(string(output))
+	if summary.Failed > 0 {
+		return fmt.Errorf("failed to backfill %d user(s)", summary.Failed)
+	}
+	return nil
+}
+
+// runReconcile reports the discrepancies between the records that would be generated
+// and the affiliations on ORCID of the users given either as the arguments or in the CSV file.
+func runReconcile(args []string) error {
+	var (
+		fs         = flag.NewFlagSet("reconcile", flag.ExitOnError)
+		csvFile    = fs.String("csv", "", "the CSV file with the UPIs or the employee/student IDs in the first column (\"-\" for stdin)")
+		format     = fs.String("format", "csv", "the output format: csv or json")
+		outputFile = fs.String("o", "", "the output file (default: stdout)")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s reconcile [options] [UPI or ID ...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	users := fs.Args()
+	if *csvFile != "" {
+		list, err := readUserFile(*csvFile)
+		if err != nil {
+			return err
+		}
+		users = append(users, list...)
+	}
+	if len(users) == 0 {
+		fs.Usage()
+		return fmt.Errorf("no users given")
+	}
+	// NB! the reconciliation is read-only, so no affiliation task is needed
+	dryRun = true
+	if err := setup(dryRun); err != nil {
+		return err
+	}
+
+	var (
+		diffs  []AffiliationDiff
+		failed int
+	)
+	for _, user := range users {
+		d, err := reconcileUser(user)
+		if err != nil {
+			log.Errorf("failed to reconcile %q: %v", userPseudonym(user), err)
+			failed++
+			continue
+		}
+		diffs = append(diffs, d...)
+	}
+
+	output := os.Stdout
+	if *outputFile != "" {
+		f, err := os.Create(*outputFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		output = f
+	}
+	if err := writeDiffs(output, *format, diffs); err != nil {
+		return err
+	}
+	log.Infof("reconciled %d user(s), found %d discrepancies", len(users)-failed, len(diffs))
+	if failed > 0 {
+		return fmt.Errorf("failed to reconcile %d user(s)", failed)
+	}
+	return nil
+}
+
+// runReplay handles the event messages read from the files given as the arguments or stdin
+// and prints out the results (as JSONL).
+func runReplay(args []string) error {
+	var (
+		fs     = flag.NewFlagSet("replay", flag.ExitOnError)
+		envArg = fs.String("env", config.Env, "the environment to replay the events against: dev, tst or prd")
+	)
+	fs.BoolVar(&dryRun, "dry-run", dryRun, "compute the records without writing anywhere")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [options] [FILE ...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setConfig(os.Getenv("CONFIG_FILE"), withEnv(*envArg)); err != nil {
+		return err
+	}
+	log.Infof("replaying the events against %s (dry-run: %t)", config, dryRun)
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	var (
+		enc    = json.NewEncoder(os.Stdout)
+		failed int
+	)
+	for _, name := range files {
+		var (
+			events []Event
+			err    error
+		)
+		if name == "-" {
+			events, err = readEvents(os.Stdin)
+		} else {
+			var f *os.File
+			if f, err = os.Open(name); err != nil {
+				return err
+			}
+			events, err = readEvents(f)
+			f.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the events from %q: %v", name, err)
+		}
+		for _, r := range replay(name, events, dryRun) {
+			if r.Error != "" {
+				failed++
+			}
+			enc.Encode(r)
+		}
+	}
+	// submit the records for processing if the task is due
+	activateDueTask(false)
+	if failed > 0 {
+		return fmt.Errorf("failed to handle %d event(s)", failed)
+	}
+	return nil
+}
+
+// runConflicts prints out the ORCID iD conflict report (ORCID_CONFLICT_STORE).
+func runConflicts(args []string) error {
+	var (
+		fs      = flag.NewFlagSet("conflicts", flag.ExitOnError)
+		store   = fs.String("store", conflicts.path, "the ORCID iD conflict store file")
+		format  = fs.String("format", "csv", "the output format: csv or json")
+		pending = fs.Bool("pending", false, "report only the conflicts waiting for the review")
+	)
+	fs.Parse(args)
+	if *store == "" {
+		return fmt.Errorf("the ORCID iD conflict store is not set (ORCID_CONFLICT_STORE or -store)")
+	}
+	if _, err := os.Stat(*store); err != nil {
+		return err
+	}
+	conflicts = conflictStore{path: *store}
+
+	var list []OrcidConflict
+	for _, c := range conflicts.list() {
+		if !*pending || c.Status == conflictPending {
+			list = append(list, c)
+		}
+	}
+	return writeConflicts(os.Stdout, *format, list)
+}
+
+// runConfig validates the configuration (the file and the environment variables) and prints out
+// the effective configuration with the secrets redacted.
+func runConfig(args []string) error {
+	var (
+		fs         = flag.NewFlagSet("config", flag.ExitOnError)
+		configFile = fs.String("config", os.Getenv("CONFIG_FILE"), "the configuration file (YAML)")
+		envArg     = fs.String("env", "", "the environment: dev, tst or prd (default: the one of the configuration)")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s config check [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "check" {
+		fs.Usage()
+		return fmt.Errorf("unknown config command")
+	}
+	fs.Parse(args[1:])
+
+	var options []func(*Config)
+	if *envArg != "" {
+		options = append(options, withEnv(*envArg))
+	}
+	cfg, err := newConfig(*configFile, options...)
+	if errs, ok := err.(configErrors); ok {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, "invalid", e)
+		}
+		return fmt.Errorf("the configuration has %d error(s)", len(errs))
+	} else if err != nil {
+		return err
+	}
+	fmt.Print(cfg)
+	return nil
+}
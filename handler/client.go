@@ -3,11 +3,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// the upstream service names
+const (
+	upstreamAPI = "uoa-api"
+	upstreamHub = "orcid-hub"
 )
 
 // Client - RESTfull service implementation
@@ -15,26 +26,37 @@ type Client struct {
 	http.Client
 	accessToken, baseURL, apiKey, clientID, clientSecret string
 	jsonBody                                             []byte
+	// the upstream service name
+	name string
+	// the request scoped logger (if set)
+	log *zap.SugaredLogger
+	// the span context of the calls (if set)
+	parent spanContext
 }
 
 var lock sync.Mutex
 
 func setupAPIClients() (err error) {
 	if api.apiKey == "" {
-		api.apiKey = getenv("APIKEY", "")
-		api.baseURL = APIBaseURL
-		log.Debug("APIKEY: ", api.apiKey)
+		if api.apiKey, err = getSecret("APIKEY"); err != nil {
+			return
+		}
+		redaction.addValues(api.apiKey)
+		api.baseURL = config.APIURL
 	}
 
 	lock.Lock()
 	defer lock.Unlock()
 
 	if oh.accessToken == "" {
-		oh.clientID = getenv("CLIENT_ID", "")
-		oh.clientSecret = getenv("CLIENT_SECRET", "")
-		log.Debug("CLIENT_ID: ", oh.clientID)
-		log.Debug("CLIENT_SECRET: ", oh.clientSecret)
-		oh.baseURL = OHBaseURL
+		if oh.clientID, err = getSecret("CLIENT_ID"); err != nil {
+			return
+		}
+		if oh.clientSecret, err = getSecret("CLIENT_SECRET"); err != nil {
+			return
+		}
+		redaction.addValues(oh.clientID, oh.clientSecret)
+		oh.baseURL = config.HubURL
 		err = oh.getAccessToken("oauth/token")
 		if err != nil || oh.accessToken == "" {
 			log.Error("filed to authorize with the client credentials", err)
@@ -62,10 +84,12 @@ func (c *Client) getAccessToken(url string) error {
 		return err
 	}
 	c.accessToken = token.AccessToken
+	redaction.addValues(c.accessToken)
 	return nil
 }
 
-func (c *Client) execute(req *http.Request, resp interface{}) error {
+// send sets the authentication and content headers and sends the request.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
 
 	if c.apiKey != "" {
 		req.Header.Set("apikey", c.apiKey)
@@ -77,32 +101,100 @@ func (c *Client) execute(req *http.Request, resp interface{}) error {
 	if req.Method != "GET" && req.Header.Get("Content-Type") == "" {
 		req.Header.Set("Content-Type", "application/json")
 	}
-	r, err := c.Do(req)
+	return c.Do(req)
+}
+
+// with returns the copy of the client logging with the request scoped logger.
+func (c *Client) with(l *zap.SugaredLogger) *Client {
+	cc := *c
+	cc.log = l
+	return &cc
+}
+
+// in returns the copy of the client making the calls within the span.
+func (c *Client) in(s *span) *Client {
+	cc := *c
+	cc.parent = s.context()
+	return &cc
+}
+
+// logger returns the request scoped logger (if set) or the global one.
+func (c *Client) logger() *zap.SugaredLogger {
+	if c.log != nil {
+		return c.log
+	}
+	return log
+}
+
+// endpointTemplate returns the URL path with the UPIs, the IDs, the emails (EPPNs) and ORCID iDs
+// replaced with the placeholders, e.g., identity/integrations/v3/identity/{upi}.
+func endpointTemplate(path string) string {
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		switch {
+		case p == "":
+		case isValidUPI(p):
+			parts[i] = "{upi}"
+		case strings.Contains(p, "@"):
+			parts[i] = "{email}"
+		case isValidOrcidID(p):
+			parts[i] = "{orcid}"
+		case strings.Trim(p, "0123456789") == "":
+			parts[i] = "{id}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func (c *Client) execute(req *http.Request, resp interface{}) error {
+
+	if c.parent.isValid() {
+		req = req.WithContext(contextWithSpan(req.Context(), c.parent))
+	}
+	start := time.Now()
+	r, err := c.send(req)
+	latency, endpoint := time.Since(start), endpointTemplate(req.URL.Path)
+	l := c.logger().With("upstream", c.name, "method", req.Method, "endpoint", endpoint, "latency", latency)
 	if err != nil {
+		observeUpstream(c.name, req.Method, endpoint, 0, latency)
+		l.Debugw("upstream call failed", "error", err)
 		return err
 	}
-	log.Debug("*****************")
-	log.Debugf("%s %q %d %q", req.Method, req.URL.RequestURI(), r.StatusCode, r.Status)
+	observeUpstream(c.name, req.Method, endpoint, r.StatusCode, latency)
+	l.Debugw("upstream call", "status", r.StatusCode)
+	defer r.Body.Close()
 
-	if resp != nil && r.StatusCode == http.StatusOK {
-		defer r.Body.Close()
+	if r.StatusCode/100 != 2 {
+		return &statusError{method: req.Method, endpoint: endpoint, status: r.StatusCode}
+	}
+	// NB! the response body (with the personal data and the tokens) doesn't get logged
+	if resp != nil && r.StatusCode != http.StatusNoContent {
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			return err
 		}
-		err = json.Unmarshal(body, resp)
-		if err == nil {
-			output, _ := json.MarshalIndent(resp, "", "    ")
-			log.Debug(string(output))
-		} else {
-			log.Debug(string(body))
-		}
-		log.Debug("*****************")
-		return err
+		return json.Unmarshal(body, resp)
 	}
 	return nil
 }
 
+// statusError - the upstream call responded with a non-2xx status.
+type statusError struct {
+	method, endpoint string
+	status           int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s %q: %d %s", e.method, e.endpoint, e.status, http.StatusText(e.status))
+}
+
+// isNotFound checks if the upstream call failed as the resource doesn't exist, i.e., with 404 Not Found
+// or, as the UoA API responds to the IDs it doesn't know (e.g., the student API to non-students), 400 Bad Request.
+func isNotFound(err error) bool {
+	se, ok := err.(*statusError)
+	return ok && (se.status == http.StatusNotFound || se.status == http.StatusBadRequest)
+}
+
 func (c *Client) get(url string, resp interface{}) error {
 	url = c.baseURL + "/" + url
 	req, err := http.NewRequest("GET", url, nil)
@@ -112,6 +204,15 @@ func (c *Client) get(url string, resp interface{}) error {
 	return c.execute(req, resp)
 }
 
+// lookup retrieves the resource that might not exist, e.g., the user records. If it doesn't exist,
+// resp is left unchanged and no error is returned.
+func (c *Client) lookup(url string, resp interface{}) error {
+	if err := c.get(url, resp); err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
 func (c *Client) prepare(method, url string, body interface{}) (req *http.Request, err error) {
 	url = c.baseURL + "/" + url
 	if body == nil {
@@ -148,3 +249,20 @@ func (c *Client) post(url string, body interface{}, resp interface{}) error {
 func (c *Client) patch(url string, body interface{}, resp interface{}) error {
 	return c.do("PATCH", url, body, resp)
 }
+
+// check verifies that the resource is accessible, i.e., the response status is 200 OK.
+func (c *Client) check(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/"+url, nil)
+	if err != nil {
+		return err
+	}
+	r, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %q: %s", req.URL.Path, r.Status)
+	}
+	return nil
+}
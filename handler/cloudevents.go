@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// CloudEvent - CloudEvents 1.0 event in the structured content mode, e.g.:
+//
+//	{
+//	  "specversion": "1.0",
+//	  "id": "A234-1234-1234",
+//	  "source": "nz-ac-auckland-employment",
+//	  "type": "RESYNC",
+//	  "subject": "484378182",
+//	  "datacontenttype": "application/json",
+//	  "data": {...}
+//	}
+//
+// The data, if present, can be any event message the handler understands.
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+	DataBase64      string          `json:"data_base64"`
+}
+
+// EventBridgeEvent - AWS EventBridge (CloudWatch Events) event envelope.
+type EventBridgeEvent struct {
+	Version    string          `json:"version"`
+	ID         string          `json:"id"`
+	DetailType string          `json:"detail-type"`
+	Source     string          `json:"source"`
+	Time       string          `json:"time"`
+	Detail     json.RawMessage `json:"detail"`
+}
+
+// decodeCloudEvent maps the structured mode CloudEvent onto the event.
+func (e *Event) decodeCloudEvent(data []byte) error {
+	var ce CloudEvent
+	if err := json.Unmarshal(data, &ce); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(ce.SpecVersion, "1.") {
+		return fmt.Errorf("unsupported CloudEvents version %q", ce.SpecVersion)
+	}
+	payload := []byte(ce.Data)
+	if ce.DataBase64 != "" {
+		var err error
+		payload, err = base64.StdEncoding.DecodeString(ce.DataBase64)
+		if err != nil {
+			return fmt.Errorf("failed to decode CloudEvent %q data: %v", ce.ID, err)
+		}
+	} else if len(payload) > 0 && payload[0] == '"' {
+		// JSON encoded as a string
+		var s string
+		if err := json.Unmarshal(payload, &s); err != nil {
+			return err
+		}
+		payload = []byte(s)
+	}
+	if err := e.decodePayload(payload); err != nil {
+		return fmt.Errorf("failed to decode CloudEvent %q data: %v", ce.ID, err)
+	}
+	e.applyAttributes(ce.Type, ce.Subject, ce.Source)
+	if e.id == "" {
+		e.id = ce.ID
+	}
+	return nil
+}
+
+// decodeEventBridgeEvent maps the EventBridge event onto the event.
+func (e *Event) decodeEventBridgeEvent(data []byte) error {
+	var eb EventBridgeEvent
+	if err := json.Unmarshal(data, &eb); err != nil {
+		return err
+	}
+	if err := e.decodePayload(eb.Detail); err != nil {
+		return fmt.Errorf("failed to decode EventBridge event %q detail: %v", eb.ID, err)
+	}
+	e.applyAttributes(eb.DetailType, "", eb.Source)
+	if e.id == "" {
+		e.id = eb.ID
+	}
+	return nil
+}
+
+// decodePayload decodes the wrapped event message (if any).
+func (e *Event) decodePayload(payload []byte) error {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) == 0 || bytes.Equal(payload, []byte("null")) {
+		return nil
+	}
+	return json.Unmarshal(payload, e)
+}
+
+// applyCloudEventHeaders maps the binary content mode CloudEvent
+// HTTP headers (ce-*) onto the event. It returns false if the request
+// is not a binary mode CloudEvent.
+func (e *Event) applyCloudEventHeaders(h http.Header) bool {
+	if h.Get("ce-specversion") == "" {
+		return false
+	}
+	e.applyAttributes(h.Get("ce-type"), h.Get("ce-subject"), h.Get("ce-source"))
+	if e.id == "" {
+		e.id = h.Get("ce-id")
+	}
+	return true
+}
+
+// eventFromRequest decodes the event message from the HTTP request body
+// (a JSON message or a structured mode CloudEvent) and the binary mode CloudEvent headers.
+func eventFromRequest(req *http.Request) (e Event, err error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return
+	}
+	isBinaryCloudEvent := req.Header.Get("ce-specversion") != ""
+	if len(bytes.TrimSpace(body)) > 0 || !isBinaryCloudEvent {
+		err = json.Unmarshal(body, &e)
+		if err != nil {
+			return
+		}
+	}
+	if isBinaryCloudEvent && !strings.HasPrefix(req.Header.Get("ce-specversion"), "1.") {
+		err = fmt.Errorf("unsupported CloudEvents version %q", req.Header.Get("ce-specversion"))
+		return
+	}
+	e.applyCloudEventHeaders(req.Header)
+	e.requestID = requestID(req)
+	e.parent, _ = parseTraceParent(req.Header.Get(traceParentHeader))
+	return
+}
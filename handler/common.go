@@ -1,8 +1,8 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -13,42 +13,33 @@ import (
 	"github.com/joho/godotenv"
 
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
 const (
-	taskFilenamePrefix      = "UOA-OH-INTEGRATION-TASK-"
-	defaultTaskRetentionMin = 10080.0
-	defaultBatchSize        = 400
+	taskFilenamePrefix   = "UOA-OH-INTEGRATION-TASK-"
+	defaultTaskRetention = 7 * 24 * time.Hour
+	defaultBatchSize     = 400
 )
 
 var (
-	api                  Client
+	api                  = Client{Client: http.Client{Transport: &tracingTransport{}}, name: upstreamAPI}
 	batchSize            = defaultBatchSize
 	counter              int
 	log                  *zap.SugaredLogger
 	logger               *zap.Logger
 	loggerCfg            zap.Config
 	loggingLevel         zap.AtomicLevel
-	oh                   Client
+	oh                   = Client{Client: http.Client{Transport: &tracingTransport{}}, name: upstreamHub}
 	taskCreatedAt        time.Time
 	taskID               int
 	taskIDMutex          sync.Mutex
 	taskRecordCount      int
 	taskRecordCountMutex sync.Mutex
-	taskRetentionMin     = defaultTaskRetentionMin
+	taskRetentionMin     = defaultTaskRetention.Minutes()
 	verbose              bool
-	env                  string
-	// for testing/mocking
-	logFatal func(args ...interface{})
 
-	// APIBaseURL is the UoA API base URL
-	APIBaseURL string
-	// OHBaseURL is the ORCID Hub API base URL
-	OHBaseURL string
-
-	// Qualification code -> description map (only for 'tertiary' qualifications)
-	qualifications map[string]string
+	// Qualification code -> description map cache (only for 'tertiary' qualifications)
+	qualifications *cache
 )
 
 func iif(cond bool, truePart, falsePart string) string {
@@ -61,85 +52,88 @@ func iif(cond bool, truePart, falsePart string) string {
 func init() {
 	godotenv.Load()
 
-	env = os.Getenv("ENV")
-	verboseEnv := os.Getenv("VERBOSE")
-	verbose = verboseEnv != "" && verboseEnv != "n" && verboseEnv != "0" && verboseEnv != "false"
-	if env != "" && env != "prd" {
-		var e = iif(env == "tst", "test", env)
-		APIBaseURL = "https://api." + e + ".auckland.ac.nz/service"
-		OHBaseURL = "https://" + e + ".orcidhub.org.nz"
-	} else {
-		APIBaseURL = "https://api.auckland.ac.nz/service"
-		OHBaseURL = "https://orcidhub.org.nz"
-	}
+	configErr = setConfig(os.Getenv("CONFIG_FILE"))
+	consents.path = config.ConsentStore
+	conflicts.path = config.Conflicts.Store
+	verbose = config.Verbose
+	dryRun = config.DryRun
+	batchSize = config.Task.BatchSize
+	taskRetentionMin = config.Task.Retention.Minutes()
 
-	isDevelopment := strings.Contains(env, "dev")
+	isDevelopment := strings.Contains(config.Env, "dev")
 	loggingLevel = zap.NewAtomicLevel()
-	loggerCfg = zap.Config{
-		Level:       loggingLevel,
-		Development: isDevelopment,
-		Encoding:    "console",
-		EncoderConfig: zapcore.EncoderConfig{
-			TimeKey:        "T",
-			LevelKey:       "L",
-			NameKey:        "N",
-			CallerKey:      "C",
-			MessageKey:     "M",
-			StacktraceKey:  "S",
-			LineEnding:     zapcore.DefaultLineEnding,
-			EncodeLevel:    zapcore.CapitalLevelEncoder,
-			EncodeTime:     zapcore.ISO8601TimeEncoder,
-			EncodeDuration: zapcore.StringDurationEncoder,
-			EncodeCaller:   zapcore.ShortCallerEncoder,
-		},
-		OutputPaths:      []string{"stderr"},
-		ErrorOutputPaths: []string{"stderr"},
-	}
+	loggerCfg = newLoggerConfig(config.Log.Format, loggingLevel, isDevelopment)
 	if verbose {
 		loggingLevel.SetLevel(zap.DebugLevel)
 	} else {
 		loggingLevel.SetLevel(zap.InfoLevel)
 	}
-	logger, _ = loggerCfg.Build()
+	setRedaction(config)
+	logger, _ = loggerCfg.Build(zap.WrapCore(newRedactingCore))
 	log = logger.Sugar()
-	logFatal = log.Fatal
+	if configErr == nil {
+		configErr = setPrivacy(config)
+	}
+	setLogHashKey(config)
+	setTracing(config)
 }
 
-func setup() (err error) {
+// setup sets up the API clients, the qualification cache, the degree code mapping and,
+// unless it is a dry run, the affiliation task.
+func setup(isDryRun bool) (err error) {
+	if err = setupClients(); err != nil || isDryRun {
+		// NB! no affiliation task gets created or activated in the dry-run mode
+		return
+	}
+	return setupTask(&oh)
+}
+
+// setupClients sets up the API clients, the qualification cache and the degree code mapping.
+func setupClients() (err error) {
 	err = setupAPIClients()
 	if err != nil {
 		return
 	}
 	lock.Lock()
 	if qualifications == nil {
-		// Reduce verbosity
-		ll := loggerCfg.Level.Level()
-		loggerCfg.Level.SetLevel(zap.ErrorLevel)
-		var list Qualifications
-		api.get("external-organisations/v1/qualifications", &list)
-		qualifications = make(map[string]string, len(list))
-		for _, q := range list {
-			if q.Type == "tertiary" {
-				qualifications[q.Code] = q.Description
-			}
+		ttl := config.QualificationsTTL
+		qualifications = newCache(ttl, loadQualifications).persist(config.CacheDir, decodeQualifications)
+		if ttl > 0 {
+			qualifications.start(ttl / 2)
 		}
-		loggerCfg.Level.SetLevel(ll)
 	}
 	lock.Unlock()
-	return setupTask()
+	if _, err := qualifications.get(qualificationsKey); err != nil {
+		log.Error("failed to load the qualifications: ", err)
+	}
+	setupDegreeCodes()
+	return
 }
 
 // handle performs the incoming message routing.
-func (e *Event) handle() (string, error) {
+func (e *Event) handle() (message string, err error) {
+
+	if e.isDryRun() && e.dryRun == nil && !e.isBatch() {
+		e.dryRun = new(DryRun)
+		if _, err := e.handle(); err != nil {
+			return "", err
+		}
+		return e.dryRun.report(), nil
+	}
 
 	counter++
-	log.Infof("Event message #%d: %+v", counter, e)
+	e.startTrace()
+	defer func() { e.span.finish(err) }()
+	e.logger().Infof("Event message #%d: %s", counter, e.describe())
+	if err = e.SNS.verify(); err != nil {
+		return "", err
+	}
 
-	if e.Records != nil {
+	if e.isBatch() {
 		var (
 			resp   []string
 			errors errorList
-			events []Event
+			events = e.messages()
 		)
 
 		type restponse struct {
@@ -147,21 +141,25 @@ func (e *Event) handle() (string, error) {
 			err     error
 		}
 
-		for _, r := range e.Records {
-			var e Event
-			json.Unmarshal([]byte(r.Body), &e)
-
-			if e.Subject != 0 || (e.EPPN != "" && e.Type == "CREATED") {
-				events = append(events, e)
-			}
-		}
-
 		if events == nil {
 			return "", nil
 		}
 
 		output := make(chan restponse, len(events))
+		isDryRun := e.isDryRun()
+		// NB! the identity records get looked up only once within the batch (in the batch trace)
+		identities := e.identities
+		if identities == nil {
+			c := api.with(e.logger()).in(e.span)
+			identities = newCache(0, func(upiOrID string) (interface{}, error) { return getIdentity(c, upiOrID) })
+		}
+		batch := e.span.context()
 		for _, e := range events {
+			e.DryRun = e.DryRun || isDryRun
+			e.identities = identities
+			if !e.parent.isValid() {
+				e.parent = batch
+			}
 			go func(e Event, o chan<- restponse) {
 				resp, err := e.handle()
 				o <- restponse{resp, err}
@@ -174,87 +172,139 @@ func (e *Event) handle() (string, error) {
 			}
 			resp = append(resp, rr.message)
 		}
-		return strings.Join(resp, "; "), errors
+		// NB! the batch fails only if any of the messages failed (a nil errorList
+		// returned as the error interface value would not be nil)
+		if len(errors) > 0 {
+			return strings.Join(resp, "; "), errors
+		}
+		return strings.Join(resp, "; "), nil
+	}
+
+	start := time.Now()
+	message, err = e.route()
+	e.logOutcome(start, err)
+	observeEvent(e.Type, start, err)
+	return message, err
+}
+
+// route routes the single event message.
+func (e *Event) route() (string, error) {
+	switch e.Type {
+	case snsSubscriptionConfirmation:
+		return e.confirmSubscription()
+	case snsUnsubscribeConfirmation:
+		e.logger().Infof("unsubscribed from %q", e.Source)
+		return "", nil
 	}
 
-	if (e.EPPN != "" && e.Type == "CREATED") || e.Subject != 0 || e.Type == "PING" {
-		setup()
+	if e.isHubEvent() || e.Subject != 0 || e.Type == "PING" {
+		if err := setupClients(); err != nil {
+			return "", err
+		}
+		// NB! no affiliation task gets created or activated in the dry-run mode
+		if !e.isDryRun() {
+			if err := setupTask(oh.with(e.logger()).in(e.span)); err != nil {
+				return "", err
+			}
+		}
 
-		if e.EPPN != "" {
-			return e.processUserRegistration()
+		if e.isHubEvent() {
+			return e.processHubEvent()
 		} else if e.Subject != 0 {
 			return e.processUpdate()
 		} else if e.Type == "PING" { // Heartbeat Check
 			return "GNIP", nil
 		}
 	}
-	return "", fmt.Errorf("unhandled event: %#v", e)
+	return "", fmt.Errorf("unhandled event: %s", e.describe())
 }
 
-// processUpdate handles the employer update event.
+// processUpdate handles the employment/student update event. Depending on the event
+// source it refreshes either employment, education, or both (full resync) sections.
 func (e *Event) processUpdate() (string, error) {
 
 	var employeeID = strconv.Itoa(e.Subject)
 
-	var id Identity
-	err := api.get("identity/integrations/v3/identity/"+employeeID, &id)
+	id, err := e.identity(employeeID)
 	if err != nil {
-		logFatal("failed to retrieve the identity record", err)
+		return "", fmt.Errorf("failed to retrieve the identity record for ID %s: %v", pseudonym(piiID, employeeID), err)
 	}
 	if id.Upi == "" {
-		return "", fmt.Errorf("failed to retrieve the identity record for ID %s", employeeID)
+		return "", fmt.Errorf("failed to retrieve the identity record for ID %s", pseudonym(piiID, employeeID))
+	}
+	e.withUPI(id.Upi)
+	if consents.isWithdrawn(id.Upi) {
+		e.logger().Infof("the user (UPI: %s) has withdrawn the consent, the update is ignored", pseudonym(piiUPI, id.Upi))
+		return "", nil
 	}
 
-	token, ok := id.GetOrcidAccessToken()
+	token, ok := id.GetOrcidAccessToken(oh.with(e.logger()).in(e.span))
 	if !ok {
-		return "", fmt.Errorf("the user (ID: %s) hasn't granted access to the profile", employeeID)
+		return "", fmt.Errorf("the user (ID: %s) hasn't granted access to the profile", pseudonym(piiID, employeeID))
 	}
-	go id.updateOrcid(token.ORCID)
-
-	var emp Employment
-	err = api.get("employment/integrations/v1/employee/"+employeeID, &emp)
+	orcid, err := parseOrcidID(token.ORCID)
 	if err != nil {
-		logFatal("failed to get employment record", zap.Error(err))
+		return "", fmt.Errorf("the user (ID: %s) access token: %v", pseudonym(piiID, employeeID), err)
 	}
-	emp.propagateToHub(token.Email, token.ORCID)
-
-	var degrees Degrees
-	err = api.get("student/integrations/v1/student/"+employeeID+"/degree/", &degrees)
-	if err != nil {
-		logFatal("failed to get degree records", err)
+	token.ORCID = orcid.String()
+	if e.dryRun != nil {
+		e.updateOrcid(id, token.ORCID, orcidFromToken)
+	} else {
+		go e.updateOrcid(id, token.ORCID, orcidFromToken)
 	}
-	degrees.propagateToHub(token.Email, token.ORCID)
 
-	return "", nil
-}
+	// Refresh only the sections affected by the event:
+	if e.refreshesEmployment() {
+		var emp Employment
+		s := e.stage("employment")
+		err = api.with(e.logger()).in(s).lookup("employment/integrations/v1/employee/"+employeeID, &emp)
+		s.finish(err)
+		if err != nil {
+			return "", fmt.Errorf("failed to get the employment record for ID %s: %v", pseudonym(piiID, employeeID), err)
+		}
+		s = e.stage("hub employment")
+		count, err := emp.propagateToHub(oh.with(e.logger()).in(s), token.Email, token.ORCID, e.dryRun)
+		s.finish(err)
+		e.logRecords("employment", count, err)
+	}
 
-// getIdentidy retrieves the user identity records.
-func getIdentidy(output chan<- Identity, upiOrID string) {
-	var id Identity
-	err := api.get("identity/integrations/v3/identity/"+upiOrID, &id)
-	if err != nil {
-		logFatal("failed to retrieve the identity record", err)
+	if e.refreshesEducation() {
+		var degrees Degrees
+		s := e.stage("degrees")
+		err = api.with(e.logger()).in(s).lookup("student/integrations/v1/student/"+employeeID+"/degree/", &degrees)
+		s.finish(err)
+		if err != nil {
+			return "", fmt.Errorf("failed to get the degree records for ID %s: %v", pseudonym(piiID, employeeID), err)
+		}
+		s = e.stage("hub education")
+		count, err := degrees.propagateToHub(oh.with(e.logger()).in(s), token.Email, token.ORCID, e.dryRun)
+		s.finish(err)
+		e.logRecords("education", count, err)
 	}
-	output <- id
+
+	return "", nil
 }
 
 // getEmp retrieves the user employment records.
-func getEmp(output chan<- Employment, upiOrID string) {
-	var emp Employment
-	err := api.get("employment/integrations/v1/employee/"+upiOrID, &emp)
+func (e *Event) getEmp(upiOrID string) (emp Employment, err error) {
+	s := e.stage("employment")
+	err = api.with(e.logger()).in(s).lookup("employment/integrations/v1/employee/"+upiOrID, &emp)
+	s.finish(err)
 	if err != nil {
-		logFatal("failed to get employment record", err)
+		err = fmt.Errorf("failed to get the employment record: %v", err)
 	}
-	output <- emp
+	return
 }
 
-func getDegrees(output chan<- Degrees, upiOrID string) {
-	var degrees Degrees
-	err := api.get("student/integrations/v1/student/"+upiOrID+"/degree/", &degrees)
+// getDegrees retrieves the user degree records.
+func (e *Event) getDegrees(upiOrID string) (degrees Degrees, err error) {
+	s := e.stage("degrees")
+	err = api.with(e.logger()).in(s).lookup("student/integrations/v1/student/"+upiOrID+"/degree/", &degrees)
+	s.finish(err)
 	if err != nil {
-		logFatal("failed to get degree record", err)
+		err = fmt.Errorf("failed to get the degree records: %v", err)
 	}
-	output <- degrees
+	return
 }
 
 // isValidUPI validates UPI
@@ -278,49 +328,65 @@ func isValidUPI(upi string) bool {
 // processUserRegistration handles the user registration/ORCID account linking on the Hub.
 func (e *Event) processUserRegistration() (restponse string, err error) {
 
-	parts := strings.Split(e.EPPN, "@")
-	upi := parts[0]
-	if !isValidUPI(upi) {
-		return "", fmt.Errorf("invalid UPI: %q", upi)
+	upi, err := e.upi()
+	if err != nil {
+		return "", err
 	}
-	log.Info("UPI: ", upi)
 
 	var (
-		id      Identity
-		emp     Employment
-		degrees Degrees
+		id                       Identity
+		emp                      Employment
+		degrees                  Degrees
+		idErr, empErr, degreeErr error
+		wg                       sync.WaitGroup
 	)
-	identities := make(chan Identity)
-	employments := make(chan Employment)
-	degreesChan := make(chan Degrees)
-
-	go getIdentidy(identities, upi)
-	go getEmp(employments, upi)
-	go getDegrees(degreesChan, upi)
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		if id, idErr = e.identity(upi); idErr != nil {
+			idErr = fmt.Errorf("failed to retrieve the identity record: %v", idErr)
+		}
+	}()
+	go func() { defer wg.Done(); emp, empErr = e.getEmp(upi) }()
+	go func() { defer wg.Done(); degrees, degreeErr = e.getDegrees(upi) }()
+	wg.Wait()
 
-	id = <-identities
+	// NB! the event fails (and can be retried) if any of the records couldn't be retrieved
+	for _, err := range []error{idErr, empErr, degreeErr} {
+		if err != nil {
+			return "", err
+		}
+	}
 	if id.ID == 0 {
-		return "", fmt.Errorf("missing identity reocord for Subject ID: %d", e.Subject)
+		return "", fmt.Errorf("missing identity reocord for Subject ID: %s", idPseudonym(e.Subject))
+	}
+	if e.dryRun != nil {
+		e.updateOrcid(id, e.ORCID, orcidFromWebhook)
+	} else {
+		go e.updateOrcid(id, e.ORCID, orcidFromWebhook)
 	}
-	go id.updateOrcid(e.ORCID)
 
-	emp = <-employments
 	if emp.Job != nil {
-		_, err := emp.propagateToHub(id.EmailAddress, e.ORCID)
+		s := e.stage("hub employment")
+		count, err := emp.propagateToHub(oh.with(e.logger()).in(s), id.EmailAddress, e.ORCID, e.dryRun)
+		s.finish(err)
 		if err != nil {
-			log.Error(err)
+			e.logger().Error(err)
 		}
+		e.logRecords("employment", count, err)
 	}
 
-	degrees = <-degreesChan
 	if len(degrees) > 0 {
-		_, err := degrees.propagateToHub(id.EmailAddress, e.ORCID)
+		s := e.stage("hub education")
+		count, err := degrees.propagateToHub(oh.with(e.logger()).in(s), id.EmailAddress, e.ORCID, e.dryRun)
+		s.finish(err)
 		if err != nil {
-			log.Error(err)
+			e.logger().Error(err)
 		}
+		e.logRecords("education", count, err)
 	}
 
-	return fmt.Sprintf("%#v", id), err
+	return id.describe(), err
 }
 
 type errorList []error
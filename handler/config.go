@@ -0,0 +1,531 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	orcidProductionURI = "https://orcid.org/"
+	orcidSandboxURI    = "https://sandbox.orcid.org/"
+	productionEnv      = "prd"
+	redacted           = "******"
+)
+
+// Secret - a configuration value that never gets printed out.
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// MarshalYAML redacts the secret.
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+// MarshalJSON redacts the secret.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(s.String())), nil
+}
+
+// Config - the handler configuration. It is loaded from the YAML configuration file (CONFIG_FILE)
+// and the environment variables (given in the comments) that take precedence. The service URLs
+// default to the ones of the known environment (ENV).
+type Config struct {
+	// the environment name, e.g., "dev", "tst", or "prd" (empty - production) (ENV)
+	Env string `yaml:"env"`
+	// the ORCID iD URI base, i.e., https://orcid.org/ or https://sandbox.orcid.org/ (ORCID_BASE_URI)
+	ORCIDBaseURI string `yaml:"orcid-base-uri"`
+	// the ORCID Hub (API) URL (ORCID_HUB_URL)
+	HubURL string `yaml:"hub-url"`
+	// the UoA API base URL (UOA_API_URL)
+	APIURL string `yaml:"api-url"`
+	// the UoA API key (APIKEY)
+	APIKey Secret `yaml:"api-key"`
+	// the ORCID Hub API client credentials (CLIENT_ID and CLIENT_SECRET)
+	ClientID     Secret `yaml:"client-id"`
+	ClientSecret Secret `yaml:"client-secret"`
+	// the debug logging (VERBOSE)
+	Verbose bool `yaml:"verbose"`
+	Log     struct {
+		// the log format: json or console (LOG_FORMAT)
+		Format string `yaml:"format"`
+		// the additional names of the fields to be redacted in the logs (LOG_REDACT - comma separated)
+		Redact []string `yaml:"redact"`
+		// the key of the UPI hashes (upi-hash) in the logs (LOG_HASH_KEY)
+		HashKey Secret `yaml:"hash-key"`
+	} `yaml:"log"`
+	Metrics struct {
+		// the CloudWatch metric namespace of the Embedded Metric Format log entries on AWS Lambda (METRICS_NAMESPACE)
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metrics"`
+	Tracing struct {
+		// the OpenTelemetry collector OTLP/HTTP endpoint, e.g., http://localhost:4318 (OTEL_EXPORTER_OTLP_ENDPOINT),
+		// the tracing is disabled unless it is set
+		Endpoint string `yaml:"endpoint"`
+		// (OTEL_SERVICE_NAME)
+		ServiceName string `yaml:"service-name"`
+	} `yaml:"tracing"`
+	Privacy struct {
+		// replace the personal identifiers in the logs and the responses with the keyed hashes (PRIVACY_MODE)
+		Enabled bool `yaml:"enabled"`
+		// the hash key (PRIVACY_KEY)
+		Key Secret `yaml:"key"`
+		// the audit log file holding the hash to identifier mapping (PRIVACY_AUDIT_LOG)
+		AuditLog string `yaml:"audit-log"`
+	} `yaml:"privacy"`
+	// the dry-run mode of the whole service (DRY_RUN)
+	DryRun bool `yaml:"dry-run"`
+	// the file to persist the list of the users who have withdrawn the consent in (CONSENT_STORE)
+	ConsentStore string `yaml:"consent-store"`
+	// the directory to persist the cached values in (CACHE_DIR)
+	CacheDir string `yaml:"cache-dir"`
+	// the qualification cache TTL (QUALIFICATIONS_TTL)
+	QualificationsTTL time.Duration `yaml:"qualifications-ttl"`
+
+	Secrets struct {
+		// the secrets provider of APIKEY, CLIENT_ID and CLIENT_SECRET: env, file, ssm, or vault
+		// (SECRETS_PROVIDER, default: ssm on AWS Lambda, otherwise env)
+		Provider string `yaml:"provider"`
+		// the secret file directory of the file provider (SECRETS_DIR)
+		Dir string `yaml:"dir"`
+		// the SSM parameter name prefix (SECRETS_SSM_PREFIX, default: /<env>/ORCIDHUB-INTEGRATION/)
+		SSMPrefix string `yaml:"ssm-prefix"`
+
+		Vault struct {
+			// (VAULT_ADDR and VAULT_TOKEN)
+			Addr  string `yaml:"addr"`
+			Token Secret `yaml:"token"`
+			// the secret path, e.g., secret/data/orcidhub-integration (VAULT_SECRET_PATH)
+			Path string `yaml:"path"`
+		} `yaml:"vault"`
+	} `yaml:"secrets"`
+
+	Task struct {
+		// the number of the records to activate the task with (BATCH_SIZE)
+		BatchSize int `yaml:"batch-size"`
+		// the time after which the task gets activated (TASK_RETENTION)
+		Retention time.Duration `yaml:"retention"`
+	} `yaml:"task"`
+
+	Conflicts struct {
+		// the ORCID iD conflict policy: overwrite, keep, or review (ORCID_CONFLICT_POLICY)
+		Policy string `yaml:"policy"`
+		// the file to persist the ORCID iD conflicts in (ORCID_CONFLICT_STORE)
+		Store string `yaml:"store"`
+	} `yaml:"orcid-conflicts"`
+
+	DegreeCodes struct {
+		// the degree code mapping source: a file path, an HTTP(S) URL, or s3://bucket/key (DEGREE_CODES)
+		Source string `yaml:"source"`
+		// (DEGREE_CODES_RELOAD_INTERVAL)
+		ReloadInterval time.Duration `yaml:"reload-interval"`
+		// (DEGREE_CODES_REPORT_INTERVAL)
+		ReportInterval time.Duration `yaml:"report-interval"`
+	} `yaml:"degree-codes"`
+
+	DegreeTitle struct {
+		// the degree title template (DEGREE_TITLE_FORMAT)
+		Format string `yaml:"format"`
+		// include the te reo Māori degree names (DEGREE_TITLE_MAORI)
+		Maori bool `yaml:"maori"`
+	} `yaml:"degree-title"`
+
+	// the stand-alone server configuration
+	Server struct {
+		// (PORT)
+		Port string `yaml:"port"`
+		// (READ_TIMEOUT, WRITE_TIMEOUT, IDLE_TIMEOUT, and SHUTDOWN_TIMEOUT)
+		ReadTimeout     time.Duration `yaml:"read-timeout"`
+		WriteTimeout    time.Duration `yaml:"write-timeout"`
+		IdleTimeout     time.Duration `yaml:"idle-timeout"`
+		ShutdownTimeout time.Duration `yaml:"shutdown-timeout"`
+		// the maximum request body size in bytes (MAX_BODY_SIZE)
+		MaxBodySize int `yaml:"max-body-size"`
+
+		Queue struct {
+			// the event queue directory (QUEUE_DIR)
+			Dir string `yaml:"dir"`
+			// (QUEUE_RETENTION)
+			Retention time.Duration `yaml:"retention"`
+			// (QUEUE_WORKERS)
+			Workers int `yaml:"workers"`
+			// the maximum number of the attempts to process the event (QUEUE_MAX_ATTEMPTS)
+			// and the delay before the first retry that doubles with each attempt (QUEUE_RETRY_DELAY)
+			MaxAttempts int           `yaml:"max-attempts"`
+			RetryDelay  time.Duration `yaml:"retry-delay"`
+		} `yaml:"queue"`
+
+		TLS struct {
+			// (TLS_CERT_FILE and TLS_KEY_FILE)
+			CertFile string `yaml:"cert-file"`
+			KeyFile  string `yaml:"key-file"`
+			// the client certificate CA file (TLS_CLIENT_CA_FILE)
+			ClientCAFile string `yaml:"client-ca-file"`
+			// the allowed client certificate names (TLS_CLIENT_ALLOW - comma separated)
+			ClientAllow []string `yaml:"client-allow"`
+		} `yaml:"tls"`
+
+		Webhook struct {
+			// (WEBHOOK_APIKEY and WEBHOOK_APIKEY_HEADER)
+			APIKey       Secret `yaml:"api-key"`
+			APIKeyHeader string `yaml:"api-key-header"`
+			// (WEBHOOK_SECRET)
+			Secret Secret `yaml:"secret"`
+			// (WEBHOOK_SIGNATURE_TOLERANCE - in seconds or a duration, e.g., 5m)
+			SignatureTolerance time.Duration `yaml:"signature-tolerance"`
+		} `yaml:"webhook"`
+
+		Admin struct {
+			// (ADMIN_APIKEY and ADMIN_APIKEY_HEADER)
+			APIKey       Secret `yaml:"api-key"`
+			APIKeyHeader string `yaml:"api-key-header"`
+		} `yaml:"admin"`
+	} `yaml:"server"`
+}
+
+// the service URLs of the known environments
+var environments = map[string]struct{ orcidBaseURI, hubURL, apiURL string }{
+	"dev":         {orcidSandboxURI, "https://dev.orcidhub.org.nz", "https://api.dev.auckland.ac.nz/service"},
+	"tst":         {orcidSandboxURI, "https://test.orcidhub.org.nz", "https://api.test.auckland.ac.nz/service"},
+	productionEnv: {orcidProductionURI, "https://orcidhub.org.nz", "https://api.auckland.ac.nz/service"},
+}
+
+var (
+	// the effective configuration
+	config = defaultConfig()
+	// the configuration error (the configuration is loaded at the start)
+	configErr error
+)
+
+// configErrors - the list of the configuration errors.
+type configErrors []string
+
+func (ce configErrors) Error() string {
+	return strings.Join(ce, "; ")
+}
+
+// defaultConfig returns the configuration with the default values.
+func defaultConfig() (c Config) {
+	c.QualificationsTTL = defaultQualificationsTTL
+	c.Log.Format = logJSON
+	c.Metrics.Namespace = defaultMetricsNamespace
+	c.Tracing.ServiceName = defaultServiceName
+	c.Secrets.Dir = defaultSecretsDir
+	c.Task.BatchSize = defaultBatchSize
+	c.Task.Retention = defaultTaskRetention
+	c.Conflicts.Policy = conflictOverwrite
+	c.DegreeCodes.ReloadInterval = defaultDegreeCodesReloadInterval
+	c.DegreeCodes.ReportInterval = defaultDegreeCodesReportInterval
+	c.DegreeTitle.Format = defaultDegreeTitleFormat
+	c.Server.ReadTimeout = 30 * time.Second
+	c.Server.WriteTimeout = 5 * time.Minute
+	c.Server.IdleTimeout = 2 * time.Minute
+	c.Server.ShutdownTimeout = 30 * time.Second
+	c.Server.MaxBodySize = defaultMaxBodySize
+	c.Server.Queue.Retention = defaultQueueRetention
+	c.Server.Queue.Workers = 1
+	c.Server.Queue.MaxAttempts = defaultQueueMaxAttempts
+	c.Server.Queue.RetryDelay = defaultQueueRetryDelay
+	c.Server.Webhook.APIKeyHeader = defaultAPIKeyHeader
+	c.Server.Webhook.SignatureTolerance = defaultSignatureTolerance * time.Second
+	c.Server.Admin.APIKeyHeader = defaultAdminAPIKeyHeader
+	return
+}
+
+// withEnv overrides the environment name.
+func withEnv(env string) func(*Config) {
+	return func(c *Config) { c.Env = env }
+}
+
+// newConfig loads the configuration from the file (if given) and the environment variables,
+// applies the options, and validates the configuration.
+func newConfig(filename string, options ...func(*Config)) (Config, error) {
+	cfg := defaultConfig()
+	if filename != "" {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return cfg, err
+		}
+		if err = yaml.UnmarshalStrict(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("invalid configuration file %q: %v", filename, err)
+		}
+	}
+	if err := cfg.override(); err != nil {
+		return cfg, err
+	}
+	for _, o := range options {
+		o(&cfg)
+	}
+
+	if e, ok := environments[iif(cfg.Env == "", productionEnv, cfg.Env)]; ok {
+		if cfg.ORCIDBaseURI == "" {
+			cfg.ORCIDBaseURI = e.orcidBaseURI
+		}
+		if cfg.HubURL == "" {
+			cfg.HubURL = e.hubURL
+		}
+		if cfg.APIURL == "" {
+			cfg.APIURL = e.apiURL
+		}
+	}
+	if cfg.ORCIDBaseURI != "" && !strings.HasSuffix(cfg.ORCIDBaseURI, "/") {
+		cfg.ORCIDBaseURI += "/"
+	}
+	if cfg.Secrets.SSMPrefix == "" {
+		cfg.Secrets.SSMPrefix = iif(cfg.Env == "", "", "/"+cfg.Env) + awsPsPrefix
+	}
+	cfg.HubURL = strings.TrimSuffix(cfg.HubURL, "/")
+	cfg.APIURL = strings.TrimSuffix(cfg.APIURL, "/")
+	return cfg, cfg.validate()
+}
+
+// override overrides the configuration with the values of the environment variables.
+func (c *Config) override() error {
+	var errs []string
+	for _, v := range []struct {
+		key   string
+		value interface{}
+	}{
+		{"ENV", &c.Env},
+		{"ORCID_BASE_URI", &c.ORCIDBaseURI},
+		{"ORCID_HUB_URL", &c.HubURL},
+		{"UOA_API_URL", &c.APIURL},
+		{"APIKEY", &c.APIKey},
+		{"CLIENT_ID", &c.ClientID},
+		{"CLIENT_SECRET", &c.ClientSecret},
+		{"VERBOSE", &c.Verbose},
+		{"LOG_FORMAT", &c.Log.Format},
+		{"LOG_REDACT", &c.Log.Redact},
+		{"LOG_HASH_KEY", &c.Log.HashKey},
+		{"METRICS_NAMESPACE", &c.Metrics.Namespace},
+		{"OTEL_EXPORTER_OTLP_ENDPOINT", &c.Tracing.Endpoint},
+		{"OTEL_SERVICE_NAME", &c.Tracing.ServiceName},
+		{"PRIVACY_MODE", &c.Privacy.Enabled},
+		{"PRIVACY_KEY", &c.Privacy.Key},
+		{"PRIVACY_AUDIT_LOG", &c.Privacy.AuditLog},
+		{"DRY_RUN", &c.DryRun},
+		{"CONSENT_STORE", &c.ConsentStore},
+		{"CACHE_DIR", &c.CacheDir},
+		{"QUALIFICATIONS_TTL", &c.QualificationsTTL},
+		{"SECRETS_PROVIDER", &c.Secrets.Provider},
+		{"SECRETS_DIR", &c.Secrets.Dir},
+		{"SECRETS_SSM_PREFIX", &c.Secrets.SSMPrefix},
+		{"VAULT_ADDR", &c.Secrets.Vault.Addr},
+		{"VAULT_TOKEN", &c.Secrets.Vault.Token},
+		{"VAULT_SECRET_PATH", &c.Secrets.Vault.Path},
+		{"BATCH_SIZE", &c.Task.BatchSize},
+		{"TASK_RETENTION", &c.Task.Retention},
+		{"ORCID_CONFLICT_POLICY", &c.Conflicts.Policy},
+		{"ORCID_CONFLICT_STORE", &c.Conflicts.Store},
+		{"DEGREE_CODES", &c.DegreeCodes.Source},
+		{"DEGREE_CODES_RELOAD_INTERVAL", &c.DegreeCodes.ReloadInterval},
+		{"DEGREE_CODES_REPORT_INTERVAL", &c.DegreeCodes.ReportInterval},
+		{"DEGREE_TITLE_FORMAT", &c.DegreeTitle.Format},
+		{"DEGREE_TITLE_MAORI", &c.DegreeTitle.Maori},
+		{"PORT", &c.Server.Port},
+		{"READ_TIMEOUT", &c.Server.ReadTimeout},
+		{"WRITE_TIMEOUT", &c.Server.WriteTimeout},
+		{"IDLE_TIMEOUT", &c.Server.IdleTimeout},
+		{"SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout},
+		{"MAX_BODY_SIZE", &c.Server.MaxBodySize},
+		{"QUEUE_DIR", &c.Server.Queue.Dir},
+		{"QUEUE_RETENTION", &c.Server.Queue.Retention},
+		{"QUEUE_WORKERS", &c.Server.Queue.Workers},
+		{"QUEUE_MAX_ATTEMPTS", &c.Server.Queue.MaxAttempts},
+		{"QUEUE_RETRY_DELAY", &c.Server.Queue.RetryDelay},
+		{"TLS_CERT_FILE", &c.Server.TLS.CertFile},
+		{"TLS_KEY_FILE", &c.Server.TLS.KeyFile},
+		{"TLS_CLIENT_CA_FILE", &c.Server.TLS.ClientCAFile},
+		{"TLS_CLIENT_ALLOW", &c.Server.TLS.ClientAllow},
+		{"WEBHOOK_APIKEY", &c.Server.Webhook.APIKey},
+		{"WEBHOOK_APIKEY_HEADER", &c.Server.Webhook.APIKeyHeader},
+		{"WEBHOOK_SECRET", &c.Server.Webhook.Secret},
+		{"WEBHOOK_SIGNATURE_TOLERANCE", &c.Server.Webhook.SignatureTolerance},
+		{"ADMIN_APIKEY", &c.Server.Admin.APIKey},
+		{"ADMIN_APIKEY_HEADER", &c.Server.Admin.APIKeyHeader},
+	} {
+		value, ok := os.LookupEnv(v.key)
+		if !ok || value == "" {
+			continue
+		}
+		switch p := v.value.(type) {
+		case *string:
+			*p = value
+		case *Secret:
+			*p = Secret(value)
+		case *bool:
+			*p = value != "n" && value != "0" && value != "false"
+		case *int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: invalid number %q", v.key, value))
+			}
+			*p = n
+		case *time.Duration:
+			// NB! a plain number is the number of seconds
+			if seconds, err := strconv.Atoi(value); err == nil {
+				*p = time.Duration(seconds) * time.Second
+			} else if d, err := time.ParseDuration(value); err == nil {
+				*p = d
+			} else {
+				errs = append(errs, fmt.Sprintf("%s: invalid duration %q (e.g., 30s, 5m, 24h)", v.key, value))
+			}
+		case *[]string:
+			*p = nil
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*p = append(*p, item)
+				}
+			}
+		}
+	}
+	if errs != nil {
+		return configErrors(errs)
+	}
+	return nil
+}
+
+// isProduction checks if the configuration is the production one.
+func (c Config) isProduction() bool {
+	return c.Env == "" || c.Env == productionEnv
+}
+
+// validate checks the configuration and reports all the invalid values.
+func (c Config) validate() error {
+	var errs []string
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if _, ok := environments[iif(c.Env == "", productionEnv, c.Env)]; !ok &&
+		(c.ORCIDBaseURI == "" || c.HubURL == "" || c.APIURL == "") {
+		invalid("env (ENV): unknown environment %q (orcid-base-uri, hub-url and api-url have to be set)", c.Env)
+	}
+	for _, v := range []struct{ key, value string }{
+		{"orcid-base-uri (ORCID_BASE_URI)", c.ORCIDBaseURI},
+		{"hub-url (ORCID_HUB_URL)", c.HubURL},
+		{"api-url (UOA_API_URL)", c.APIURL},
+		{"tracing.endpoint (OTEL_EXPORTER_OTLP_ENDPOINT)", c.Tracing.Endpoint},
+	} {
+		if v.value == "" {
+			continue
+		}
+		u, err := url.Parse(v.value)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			invalid("%s: invalid URL %q", v.key, v.value)
+		}
+	}
+	if c.ORCIDBaseURI != "" && c.ORCIDBaseURI != orcidProductionURI && c.ORCIDBaseURI != orcidSandboxURI {
+		invalid("orcid-base-uri (ORCID_BASE_URI): expected %q or %q, got %q",
+			orcidProductionURI, orcidSandboxURI, c.ORCIDBaseURI)
+	} else if c.isProduction() && c.ORCIDBaseURI == orcidSandboxURI {
+		invalid("orcid-base-uri (ORCID_BASE_URI): the production environment cannot use the ORCID sandbox")
+	}
+
+	if !isValidSecretsProvider(c.Secrets.Provider) {
+		invalid("secrets.provider (SECRETS_PROVIDER): expected env, file, ssm, or vault, got %q", c.Secrets.Provider)
+	} else if c.Secrets.Provider == secretsFromVault && (c.Secrets.Vault.Addr == "" || c.Secrets.Vault.Path == "") {
+		invalid("secrets.vault (VAULT_ADDR and VAULT_SECRET_PATH): both the address and the secret path have to be set")
+	}
+	if !isValidLogFormat(c.Log.Format) {
+		invalid("log.format (LOG_FORMAT): expected json or console, got %q", c.Log.Format)
+	}
+	if c.Log.HashKey != "" && len(c.Log.HashKey) < minPrivacyKeyLength {
+		invalid("log.hash-key (LOG_HASH_KEY): the key has to be at least %d characters", minPrivacyKeyLength)
+	}
+	if c.Metrics.Namespace == "" {
+		invalid("metrics.namespace (METRICS_NAMESPACE): the namespace cannot be empty")
+	}
+	if c.Privacy.Enabled {
+		if len(c.Privacy.Key) < minPrivacyKeyLength {
+			invalid("privacy.key (PRIVACY_KEY): the privacy mode requires the key of at least %d characters",
+				minPrivacyKeyLength)
+		}
+		if c.Privacy.AuditLog == "" {
+			invalid("privacy.audit-log (PRIVACY_AUDIT_LOG): the privacy mode requires the audit log")
+		}
+	}
+	if c.Task.BatchSize <= 0 {
+		invalid("task.batch-size (BATCH_SIZE): must be positive, got %d", c.Task.BatchSize)
+	}
+	if !isValidConflictPolicy(c.Conflicts.Policy) {
+		invalid("orcid-conflicts.policy (ORCID_CONFLICT_POLICY): expected overwrite, keep, or review, got %q",
+			c.Conflicts.Policy)
+	}
+	if _, err := template.New("").Parse(c.DegreeTitle.Format); err != nil {
+		invalid("degree-title.format (DEGREE_TITLE_FORMAT): %v", err)
+	}
+	if c.Server.MaxBodySize < 1 {
+		invalid("server.max-body-size (MAX_BODY_SIZE): must be positive, got %d", c.Server.MaxBodySize)
+	}
+	if c.Server.Queue.Workers < 1 {
+		invalid("server.queue.workers (QUEUE_WORKERS): must be positive, got %d", c.Server.Queue.Workers)
+	}
+	if c.Server.Queue.MaxAttempts < 1 {
+		invalid("server.queue.max-attempts (QUEUE_MAX_ATTEMPTS): must be positive, got %d", c.Server.Queue.MaxAttempts)
+	}
+	for _, v := range []struct {
+		key      string
+		value    time.Duration
+		positive bool
+	}{
+		{"qualifications-ttl (QUALIFICATIONS_TTL)", c.QualificationsTTL, false},
+		{"task.retention (TASK_RETENTION)", c.Task.Retention, false},
+		{"degree-codes.reload-interval (DEGREE_CODES_RELOAD_INTERVAL)", c.DegreeCodes.ReloadInterval, true},
+		{"degree-codes.report-interval (DEGREE_CODES_REPORT_INTERVAL)", c.DegreeCodes.ReportInterval, true},
+		{"server.read-timeout (READ_TIMEOUT)", c.Server.ReadTimeout, false},
+		{"server.write-timeout (WRITE_TIMEOUT)", c.Server.WriteTimeout, false},
+		{"server.idle-timeout (IDLE_TIMEOUT)", c.Server.IdleTimeout, false},
+		{"server.shutdown-timeout (SHUTDOWN_TIMEOUT)", c.Server.ShutdownTimeout, false},
+		{"server.queue.retention (QUEUE_RETENTION)", c.Server.Queue.Retention, false},
+		{"server.queue.retry-delay (QUEUE_RETRY_DELAY)", c.Server.Queue.RetryDelay, true},
+		{"server.webhook.signature-tolerance (WEBHOOK_SIGNATURE_TOLERANCE)", c.Server.Webhook.SignatureTolerance, true},
+	} {
+		if v.value < 0 || v.positive && v.value == 0 {
+			invalid("%s: must be %s, got %s", v.key, iif(v.positive, "positive", "non-negative"), v.value)
+		}
+	}
+	tls := c.Server.TLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		invalid("server.tls (TLS_CERT_FILE and TLS_KEY_FILE): both the certificate and the key have to be set")
+	}
+	if tls.CertFile == "" && (tls.ClientCAFile != "" || len(tls.ClientAllow) > 0) {
+		invalid("server.tls (TLS_CLIENT_CA_FILE, TLS_CLIENT_ALLOW): the client certificate verification requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if errs != nil {
+		return configErrors(errs)
+	}
+	return nil
+}
+
+// String returns the configuration as YAML (the secrets are redacted).
+func (c Config) String() string {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// setConfig loads, validates and sets the configuration.
+func setConfig(filename string, options ...func(*Config)) error {
+	cfg, err := newConfig(filename, options...)
+	if err != nil {
+		return err
+	}
+	config = cfg
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ORCID iD conflict policies (ORCID_CONFLICT_POLICY), i.e., what to do if the ORCID iD
+// stored in the identity system differs from the incoming one:
+const (
+	// overwrite the stored ORCID iD (the conflict gets reported)
+	conflictOverwrite = "overwrite"
+	// keep the stored ORCID iD (the conflict gets reported)
+	conflictKeep = "keep"
+	// keep the stored ORCID iD until the conflict gets resolved by an operator
+	conflictReview = "review"
+)
+
+// the sources of the incoming ORCID iDs
+const (
+	orcidFromToken   = "token"
+	orcidFromWebhook = "webhook"
+)
+
+// ORCID iD conflict statuses
+const (
+	conflictOverwritten = "overwritten"
+	conflictKept        = "kept"
+	conflictPending     = "pending"
+)
+
+// OrcidConflict - the user whose ORCID iDs in the identity system, the ORCID Hub
+// access token and the Hub webhook event disagree.
+type OrcidConflict struct {
+	Upi           string    `json:"upi"`
+	ID            int       `json:"id"`
+	IdentityORCID string    `json:"identity-orcid"`
+	TokenORCID    string    `json:"token-orcid,omitempty"`
+	WebhookORCID  string    `json:"webhook-orcid,omitempty"`
+	Policy        string    `json:"policy"`
+	Status        string    `json:"status"`
+	DetectedAt    time.Time `json:"detected-at"`
+	UpdatedAt     time.Time `json:"updated-at"`
+}
+
+// isValidConflictPolicy checks if the policy is supported.
+func isValidConflictPolicy(policy string) bool {
+	return policy == conflictOverwrite || policy == conflictKeep || policy == conflictReview
+}
+
+// conflictStore - the ORCID iD conflict report and review queue (by UPI). If the path is set,
+// the conflicts are persisted in the file.
+type conflictStore struct {
+	sync.Mutex
+	path      string
+	conflicts map[string]*OrcidConflict
+}
+
+var conflicts conflictStore
+
+// load reads the persisted conflicts (if they haven't been loaded yet).
+func (s *conflictStore) load() {
+	if s.conflicts != nil {
+		return
+	}
+	s.conflicts = make(map[string]*OrcidConflict)
+	if s.path == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read the ORCID iD conflicts %q: %v", s.path, err)
+		}
+		return
+	}
+	if err = json.Unmarshal(data, &s.conflicts); err != nil {
+		log.Errorf("failed to decode the ORCID iD conflicts %q: %v", s.path, err)
+	}
+}
+
+// save persists the conflicts.
+func (s *conflictStore) save() {
+	if s.path == "" {
+		return
+	}
+	data, _ := json.Marshal(s.conflicts)
+	if err := ioutil.WriteFile(s.path, data, 0600); err != nil {
+		log.Errorf("failed to store the ORCID iD conflicts %q: %v", s.path, err)
+	}
+}
+
+// add records the conflict. The ORCID iDs of the other sources that have been
+// reported earlier for the user are kept.
+func (s *conflictStore) add(c OrcidConflict) OrcidConflict {
+	s.Lock()
+	defer s.Unlock()
+	s.load()
+	if prev, ok := s.conflicts[c.Upi]; ok {
+		c.DetectedAt = prev.DetectedAt
+		if c.TokenORCID == "" {
+			c.TokenORCID = prev.TokenORCID
+		}
+		if c.WebhookORCID == "" {
+			c.WebhookORCID = prev.WebhookORCID
+		}
+	}
+	s.conflicts[c.Upi] = &c
+	s.save()
+	return c
+}
+
+// get returns the conflict of the user.
+func (s *conflictStore) get(upi string) (OrcidConflict, bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.load()
+	if c, ok := s.conflicts[upi]; ok {
+		return *c, true
+	}
+	return OrcidConflict{}, false
+}
+
+// remove removes the conflict of the user from the report.
+func (s *conflictStore) remove(upi string) bool {
+	s.Lock()
+	defer s.Unlock()
+	s.load()
+	if _, ok := s.conflicts[upi]; !ok {
+		return false
+	}
+	delete(s.conflicts, upi)
+	s.save()
+	return true
+}
+
+// list returns the conflicts ordered by UPI.
+func (s *conflictStore) list() []OrcidConflict {
+	s.Lock()
+	defer s.Unlock()
+	s.load()
+	list := make([]OrcidConflict, 0, len(s.conflicts))
+	for _, c := range s.conflicts {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Upi < list[j].Upi })
+	return list
+}
+
+// checkConflict checks if the ORCID iDs of the identity system and the incoming sources (the ORCID Hub
+// access token and the Hub webhook event) disagree, including when the identity system has no ORCID iD
+// and the sources differ. It records the conflict and tells whether the stored ORCID iD should get
+// overwritten according to the conflict policy (ORCID_CONFLICT_POLICY). In the dry-run mode of the event
+// the conflict only gets collected.
+func (e *Event) checkConflict(id Identity, current OrcidID, sources map[string]OrcidID) (overwrite bool) {
+	distinct := make(map[OrcidID]bool)
+	if current != "" {
+		distinct[current] = true
+	}
+	for _, orcid := range sources {
+		if orcid != "" {
+			distinct[orcid] = true
+		}
+	}
+	if len(distinct) < 2 {
+		return true
+	}
+	now := time.Now()
+	c := OrcidConflict{
+		Upi:           id.Upi,
+		ID:            id.ID,
+		IdentityORCID: current.String(),
+		TokenORCID:    sources[orcidFromToken].String(),
+		WebhookORCID:  sources[orcidFromWebhook].String(),
+		Policy:        config.Conflicts.Policy,
+		DetectedAt:    now,
+		UpdatedAt:     now,
+	}
+	switch c.Policy {
+	case conflictKeep:
+		c.Status = conflictKept
+	case conflictReview:
+		c.Status = conflictPending
+	default:
+		c.Status, overwrite = conflictOverwritten, true
+	}
+	if e.dryRun != nil {
+		e.dryRun.addConflict(c)
+	} else {
+		c = conflicts.add(c)
+	}
+	e.logger().Warnf("ORCID iD conflict (UPI: %s, identity: %s, token: %s, webhook: %s): %s",
+		pseudonym(piiUPI, c.Upi), iif(c.IdentityORCID == "", "-", pseudonym(piiORCID, c.IdentityORCID)),
+		iif(c.TokenORCID == "", "-", pseudonym(piiORCID, c.TokenORCID)),
+		iif(c.WebhookORCID == "", "-", pseudonym(piiORCID, c.WebhookORCID)), c.Status)
+	return
+}
+
+// writeConflicts writes the ORCID iD conflict report in the given format ("csv" or "json").
+func writeConflicts(w io.Writer, format string, list []OrcidConflict) error {
+	switch format {
+	case "json":
+		if list == nil {
+			list = []OrcidConflict{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"upi", "id", "identity-orcid", "token-orcid", "webhook-orcid", "policy", "status",
+			"detected-at", "updated-at"})
+		for _, c := range list {
+			cw.Write([]string{c.Upi, fmt.Sprint(c.ID), c.IdentityORCID, c.TokenORCID, c.WebhookORCID, c.Policy,
+				c.Status, c.DetectedAt.Format(time.RFC3339), c.UpdatedAt.Format(time.RFC3339)})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unsupported format %q", format)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// consentStore keeps track of the users (UPIs) who have withdrawn their consent
+// so that no further records get pushed to the Hub on their behalf. If the path is set,
+// the list is persisted in the file.
+type consentStore struct {
+	sync.Mutex
+	path      string
+	withdrawn map[string]time.Time
+}
+
+var consents consentStore
+
+// load reads the persisted list (if it hasn't been loaded yet).
+func (s *consentStore) load() {
+	if s.withdrawn != nil {
+		return
+	}
+	s.withdrawn = make(map[string]time.Time)
+	if s.path == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read the withdrawn consent list %q: %v", s.path, err)
+		}
+		return
+	}
+	if err = json.Unmarshal(data, &s.withdrawn); err != nil {
+		log.Errorf("failed to decode the withdrawn consent list %q: %v", s.path, err)
+	}
+}
+
+// save persists the list.
+func (s *consentStore) save() {
+	if s.path == "" {
+		return
+	}
+	data, _ := json.Marshal(s.withdrawn)
+	if err := ioutil.WriteFile(s.path, data, 0600); err != nil {
+		log.Errorf("failed to store the withdrawn consent list %q: %v", s.path, err)
+	}
+}
+
+// withdraw marks that the user has withdrawn the consent.
+func (s *consentStore) withdraw(upi string) {
+	s.Lock()
+	defer s.Unlock()
+	s.load()
+	s.withdrawn[upi] = time.Now()
+	s.save()
+}
+
+// restore marks that the user has (re)granted the consent.
+func (s *consentStore) restore(upi string) {
+	s.Lock()
+	defer s.Unlock()
+	s.load()
+	if _, ok := s.withdrawn[upi]; ok {
+		delete(s.withdrawn, upi)
+		s.save()
+	}
+}
+
+// isWithdrawn checks if the user has withdrawn the consent.
+func (s *consentStore) isWithdrawn(upi string) bool {
+	s.Lock()
+	defer s.Unlock()
+	s.load()
+	_, ok := s.withdrawn[upi]
+	return ok
+}
@@ -0,0 +1,269 @@
+package main
+
+//go:generate go run gen_degree_codes.go
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	defaultDegreeCodesReloadInterval = 5 * time.Minute
+	defaultDegreeCodesReportInterval = 24 * time.Hour
+)
+
+var (
+	// the degree code mapping (the embedded default, unless DEGREE_CODES is set)
+	degreeCodes = newDegreeCodeMapping()
+	degreeCodesOnce sync.Once
+)
+
+// DegreeCodes - versioned degree code (the upper-cased degree description) to degree name mapping.
+// Optionally, the degree codes can be mapped onto the te reo Māori degree names.
+type DegreeCodes struct {
+	Version string            `json:"version"`
+	Codes   map[string]string `json:"codes"`
+	Maori   map[string]string `json:"maori,omitempty"`
+}
+
+// validate checks that the mapping has the version and the codes, and that the codes
+// are upper-case without blanks and map onto non-empty names.
+func (dc *DegreeCodes) validate() error {
+	if dc.Version == "" {
+		return errors.New("missing version")
+	}
+	if len(dc.Codes) == 0 {
+		return errors.New("no degree codes")
+	}
+	var invalid []string
+	for code, name := range dc.Codes {
+		if code == "" || code != strings.ToUpper(code) || strings.ContainsAny(code, " \t\n") || strings.TrimSpace(name) == "" {
+			invalid = append(invalid, fmt.Sprintf("%q: %q", code, name))
+		}
+	}
+	for code, name := range dc.Maori {
+		if _, ok := dc.Codes[code]; !ok || strings.TrimSpace(name) == "" {
+			invalid = append(invalid, fmt.Sprintf("maori %q: %q", code, name))
+		}
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return fmt.Errorf("invalid entries: %s", strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// degreeCodeMapping - the degree code mapping that can be loaded from the source,
+// i.e., a file path, an HTTP(S) URL, or an S3 object (s3://bucket/key), and gets
+// reloaded when the source changes. If the source cannot be loaded or it is invalid,
+// the last loaded mapping is kept.
+type degreeCodeMapping struct {
+	sync.RWMutex
+	source   string
+	version  string
+	codes    map[string]string
+	maori    map[string]string
+	checksum [sha256.Size]byte
+	loadedAt time.Time
+	// unmapped degrees (the upper-cased degree description -> the number of the lookups)
+	unmapped map[string]int
+}
+
+// newDegreeCodeMapping creates the mapping with the embedded default.
+func newDegreeCodeMapping() *degreeCodeMapping {
+	var m degreeCodeMapping
+	if err := m.load([]byte(defaultDegreeCodes)); err != nil {
+		panic("invalid embedded degree code mapping: " + err.Error())
+	}
+	m.unmapped = make(map[string]int)
+	return &m
+}
+
+// load parses, validates and replaces the mapping.
+func (m *degreeCodeMapping) load(data []byte) error {
+	var dc DegreeCodes
+	if err := json.Unmarshal(data, &dc); err != nil {
+		return err
+	}
+	if err := dc.validate(); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.version, m.codes, m.maori = dc.Version, dc.Codes, dc.Maori
+	m.checksum = sha256.Sum256(data)
+	m.loadedAt = time.Now()
+	return nil
+}
+
+// fetch reads the mapping from the source.
+func (m *degreeCodeMapping) fetch() ([]byte, error) {
+	switch source := m.source; {
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		resp, err := (&http.Client{Timeout: 30 * time.Second}).Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GET %q: %s", source, resp.Status)
+		}
+		return ioutil.ReadAll(resp.Body)
+	case strings.HasPrefix(source, "s3://"):
+		parts := strings.SplitN(strings.TrimPrefix(source, "s3://"), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid S3 location %q", source)
+		}
+		s, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		output, err := s3.New(s).GetObject(&s3.GetObjectInput{Bucket: aws.String(parts[0]), Key: aws.String(parts[1])})
+		if err != nil {
+			return nil, err
+		}
+		defer output.Body.Close()
+		return ioutil.ReadAll(output.Body)
+	default:
+		return ioutil.ReadFile(source)
+	}
+}
+
+// reload loads the mapping from the source if it has changed.
+func (m *degreeCodeMapping) reload() (changed bool, err error) {
+	if m.source == "" {
+		return false, nil
+	}
+	data, err := m.fetch()
+	if err != nil {
+		return false, err
+	}
+	m.RLock()
+	changed = sha256.Sum256(data) != m.checksum
+	m.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	if err = m.load(data); err != nil {
+		return false, fmt.Errorf("invalid degree code mapping %q: %v", m.source, err)
+	}
+	log.Infof("loaded the degree code mapping %q (version: %s)", m.source, m.info().Version)
+	return true, nil
+}
+
+// lookup returns the degree name of the degree description. The degrees that are not
+// in the mapping get recorded.
+func (m *degreeCodeMapping) lookup(desc string) (string, bool) {
+	code := strings.ToUpper(strings.TrimSpace(desc))
+	m.RLock()
+	name, ok := m.codes[code]
+	m.RUnlock()
+	if !ok && code != "" {
+		m.Lock()
+		m.unmapped[code]++
+		first := m.unmapped[code] == 1
+		m.Unlock()
+		if first {
+			log.Warnf("the degree code %q is not in the mapping", code)
+		}
+	}
+	if code != "" {
+		degreeMappings.inc(iif(ok, "mapped", "unmapped"))
+	}
+	return name, ok
+}
+
+// maoriName returns the te reo Māori degree name of the degree description.
+func (m *degreeCodeMapping) maoriName(desc string) (string, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	name, ok := m.maori[strings.ToUpper(strings.TrimSpace(desc))]
+	return name, ok
+}
+
+// DegreeCodesInfo - the summary of the loaded degree code mapping.
+type DegreeCodesInfo struct {
+	Source   string         `json:"source"`
+	Version  string         `json:"version"`
+	Count    int            `json:"count"`
+	LoadedAt time.Time      `json:"loaded-at"`
+	Unmapped map[string]int `json:"unmapped"`
+}
+
+func (m *degreeCodeMapping) info() DegreeCodesInfo {
+	m.RLock()
+	defer m.RUnlock()
+	info := DegreeCodesInfo{
+		Source:   iif(m.source == "", "embedded", m.source),
+		Version:  m.version,
+		Count:    len(m.codes),
+		LoadedAt: m.loadedAt,
+		Unmapped: make(map[string]int, len(m.unmapped)),
+	}
+	for code, count := range m.unmapped {
+		info.Unmapped[code] = count
+	}
+	return info
+}
+
+// reportUnmapped logs the list of the unmapped degrees for the data steward.
+func (m *degreeCodeMapping) reportUnmapped() {
+	info := m.info()
+	if len(info.Unmapped) == 0 {
+		return
+	}
+	codes := make([]string, 0, len(info.Unmapped))
+	for code, count := range info.Unmapped {
+		codes = append(codes, fmt.Sprintf("%s (%d)", code, count))
+	}
+	sort.Strings(codes)
+	log.Warnf("%d degree(s) not in the degree code mapping (version %s): %s",
+		len(codes), info.Version, strings.Join(codes, ", "))
+}
+
+// watch reloads the mapping every reloadInterval (if the source is set) and reports
+// the unmapped degrees every reportInterval.
+func (m *degreeCodeMapping) watch(reloadInterval, reportInterval time.Duration) {
+	var reload <-chan time.Time
+	if m.source != "" {
+		ticker := time.NewTicker(reloadInterval)
+		defer ticker.Stop()
+		reload = ticker.C
+	}
+	report := time.NewTicker(reportInterval)
+	defer report.Stop()
+	for {
+		select {
+		case <-reload:
+			if _, err := m.reload(); err != nil {
+				log.Error("failed to reload the degree code mapping: ", err)
+			}
+		case <-report.C:
+			m.reportUnmapped()
+		}
+	}
+}
+
+// setupDegreeCodes loads the degree code mapping from the source (DEGREE_CODES)
+// and starts watching it.
+func setupDegreeCodes() {
+	degreeCodesOnce.Do(func() {
+		degreeCodes.source = config.DegreeCodes.Source
+		if _, err := degreeCodes.reload(); err != nil {
+			log.Error("failed to load the degree code mapping, using the embedded one: ", err)
+		}
+		go degreeCodes.watch(config.DegreeCodes.ReloadInterval, config.DegreeCodes.ReportInterval)
+	})
+}
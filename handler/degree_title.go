@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// defaultDegreeTitleFormat - the default degree title template, e.g., "Bachelor of Science with First Class Honours".
+const defaultDegreeTitleFormat = `{{.Name}}{{with .Honours}} with {{.}}{{end}}{{with .Maori}} ({{.}}){{end}}`
+
+// honours class codes (HonorsPrefix/HonorsSuffix) and their testamur wording
+var honoursClasses = map[string]string{
+	"H1":  "First Class Honours",
+	"1":   "First Class Honours",
+	"H21": "Second Class Honours (First Division)",
+	"21":  "Second Class Honours (First Division)",
+	"H22": "Second Class Honours (Second Division)",
+	"22":  "Second Class Honours (Second Division)",
+	"H2":  "Second Class Honours",
+	"2":   "Second Class Honours",
+	"H3":  "Third Class Honours",
+	"3":   "Third Class Honours",
+	"H":   "Honours",
+	"HON": "Honours",
+	"D":   "Distinction",
+	"DIS": "Distinction",
+	"M":   "Merit",
+	"MER": "Merit",
+}
+
+var (
+	degreeTitleTemplate *template.Template
+	// include the te reo Māori name of the degree (DEGREE_TITLE_MAORI)
+	degreeTitleMaori bool
+	degreeTitleOnce  sync.Once
+	// the honours class codes that are not in honoursClasses (logged once)
+	unmappedHonoursClasses sync.Map
+)
+
+// DegreeTitle - the parts of the conferred degree title.
+type DegreeTitle struct {
+	// the degree name, e.g., "Master of Science"
+	Name string
+	// the honours class, e.g., "First Class Honours"
+	Honours string
+	// the te reo Māori name of the degree (if enabled and available)
+	Maori string
+}
+
+// honoursClass returns the testamur wording of the honours class code.
+// Unknown codes are logged (once) and omitted from the title.
+func honoursClass(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if class, ok := honoursClasses[code]; ok {
+		return class
+	}
+	if _, seen := unmappedHonoursClasses.LoadOrStore(code, true); !seen && code != "" {
+		log.Warnf("the honours class code %q is not in the mapping", code)
+	}
+	return ""
+}
+
+// setupDegreeTitle sets up the degree title template (DEGREE_TITLE_FORMAT, e.g.,
+// "{{.Name}}{{with .Honours}}, {{.}}{{end}}") and whether to include the te reo Māori
+// names (DEGREE_TITLE_MAORI). If the template is invalid, the default one is used.
+func setupDegreeTitle() {
+	degreeTitleOnce.Do(func() {
+		degreeTitleMaori = config.DegreeTitle.Maori
+		format := iif(config.DegreeTitle.Format == "", defaultDegreeTitleFormat, config.DegreeTitle.Format)
+		t, err := template.New("degree-title").Parse(format)
+		if err != nil {
+			log.Errorf("invalid DEGREE_TITLE_FORMAT %q, using the default one: %v", format, err)
+			t = template.Must(template.New("degree-title").Parse(defaultDegreeTitleFormat))
+		}
+		degreeTitleTemplate = t
+	})
+}
+
+// title composes the conferred degree title.
+func (dt DegreeTitle) title() string {
+	name := dt.Name
+	if strings.Contains(dt.Honours, "Honours") {
+		switch {
+		case !strings.Contains(name, "Honours"):
+			// NB! the honours classes apply only to the honours degrees
+			dt.Honours = ""
+		case dt.Honours == "Honours":
+			// already in the name
+			dt.Honours = ""
+		default:
+			// e.g., "Bachelor of Arts with Honours" or "Bachelor of Architecture (Honours)"
+			// -> "Bachelor of ..." + " with First Class Honours"
+			dt.Name = strings.TrimSuffix(strings.TrimSuffix(name, " with Honours"), " (Honours)")
+		}
+	}
+	setupDegreeTitle()
+	var sb strings.Builder
+	if err := degreeTitleTemplate.Execute(&sb, dt); err != nil {
+		log.Errorf("failed to compose the degree title of %q: %v", name, err)
+		return name
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// title composes the conferred degree title (the official name is looked up either
+// in the qualifications or in the degree code mapping) with the honours class and,
+// if enabled, the te reo Māori name.
+func (d *Degree) title() string {
+	name, ok := qualificationName(d.Code)
+	if !ok {
+		name, ok = degreeCodes.lookup(d.Desc)
+		if !ok {
+			name = d.Desc
+		}
+	}
+	dt := DegreeTitle{Name: name}
+	if class := strings.TrimSpace(d.HonorsSuffix); class != "" {
+		dt.Honours = honoursClass(class)
+	} else if class = strings.TrimSpace(d.HonorsPrefix); class != "" {
+		dt.Honours = honoursClass(class)
+	}
+	if setupDegreeTitle(); degreeTitleMaori {
+		dt.Maori, _ = degreeCodes.maoriName(d.Desc)
+	}
+	return dt.title()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// dry-run mode of the whole service (DRY_RUN or -dry-run)
+var dryRun bool
+
+// IdentityUpdate - the change of the user identity record that would be made.
+type IdentityUpdate struct {
+	ID         int    `json:"id"`
+	Upi        string `json:"upi"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Identifier string `json:"identifier,omitempty"`
+}
+
+// DryRun - the changes that would be made processing the event in the dry-run mode:
+// the records that would be added to the ORCID Hub affiliation task, the identity
+// record updates, the ORCID iD conflicts, the consent changes, and the SNS topic
+// the subscription to which would be confirmed.
+type DryRun struct {
+	mutex           sync.Mutex
+	Records         []Record         `json:"records"`
+	IdentityUpdates []IdentityUpdate `json:"identity-updates"`
+	Consent         string           `json:"consent,omitempty"`
+	Conflicts       []OrcidConflict  `json:"orcid-conflicts,omitempty"`
+	Subscription    string           `json:"subscription,omitempty"`
+}
+
+// isDryRun checks if the event should be processed without writing anywhere.
+func (e *Event) isDryRun() bool {
+	return dryRun || e.DryRun
+}
+
+func (dr *DryRun) addRecords(records []Record) {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	dr.Records = append(dr.Records, records...)
+}
+
+func (dr *DryRun) addIdentityUpdate(u IdentityUpdate) {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	dr.IdentityUpdates = append(dr.IdentityUpdates, u)
+}
+
+func (dr *DryRun) addConflict(c OrcidConflict) {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	dr.Conflicts = append(dr.Conflicts, c)
+}
+
+func (dr *DryRun) setConsent(consent string) {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	dr.Consent = consent
+}
+
+func (dr *DryRun) setSubscription(topicArn string) {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	dr.Subscription = topicArn
+}
+
+// report logs and returns the JSON encoded changes. In the privacy mode only the numbers
+// of the changes get logged.
+func (dr *DryRun) report() string {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	if dr.Records == nil {
+		dr.Records = []Record{}
+	}
+	if dr.IdentityUpdates == nil {
+		dr.IdentityUpdates = []IdentityUpdate{}
+	}
+	data, err := json.Marshal(dr)
+	if err != nil {
+		log.Error("failed to encode the dry-run report: ", err)
+		return ""
+	}
+	if privacy != nil {
+		log.Infof("DRY-RUN: %d record(s), %d identity update(s), %d ORCID iD conflict(s), consent: %q, subscription: %t",
+			len(dr.Records), len(dr.IdentityUpdates), len(dr.Conflicts), dr.Consent, dr.Subscription != "")
+	} else {
+		log.Infof("DRY-RUN: %s", data)
+	}
+	return string(data)
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
-	"strconv"
 	"strings"
+	"time"
 )
 
 // Degree API student-v1 degree response message.
@@ -49,24 +50,53 @@ type Qualification struct {
 // Qualifications - array of qualifications
 type Qualifications []Qualification
 
-// propagateToHub adds degree/education records to the current affiliation task.
-func (degrees Degrees) propagateToHub(email, orcid string) (count int, err error) {
+const (
+	qualificationsKey        = "qualifications"
+	defaultQualificationsTTL = 24 * time.Hour
+)
 
-	count = len(degrees)
-	if count == 0 {
-		return 0, errors.New("no degree entry")
+// loadQualifications loads the 'tertiary' qualification code -> description map.
+func loadQualifications(string) (interface{}, error) {
+	var list Qualifications
+	if err := api.get("external-organisations/v1/qualifications", &list); err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(list))
+	for _, q := range list {
+		if q.Type == "tertiary" {
+			names[q.Code] = q.Description
+		}
+	}
+	if len(names) == 0 {
+		return nil, errors.New("no tertiary qualifications")
 	}
+	return names, nil
+}
 
-	records := make([]Record, count)
-	for i, d := range degrees {
+// decodeQualifications decodes the persisted qualification code -> description map.
+func decodeQualifications(data []byte) (interface{}, error) {
+	var names map[string]string
+	err := json.Unmarshal(data, &names)
+	return names, err
+}
 
-		degreeName, ok := qualifications[d.Code]
-		if !ok {
-			degreeName, ok = degreeCodes[strings.ToUpper(d.Desc)]
-			if !ok {
-				degreeName = d.Desc
-			}
-		}
+// qualificationName returns the description of the 'tertiary' qualification.
+func qualificationName(code string) (string, bool) {
+	if qualifications == nil {
+		return "", false
+	}
+	names, err := qualifications.get(qualificationsKey)
+	if err != nil {
+		return "", false
+	}
+	name, ok := names.(map[string]string)[code]
+	return name, ok
+}
+
+// records maps the degrees onto the affiliation task records.
+func (degrees Degrees) records(email, orcid string) []Record {
+	records := make([]Record, len(degrees))
+	for i, d := range degrees {
 		date := strings.Split(d.ConferDate, "T")[0]
 		records[i] = Record{
 			AffiliationType: "education",
@@ -74,21 +104,25 @@ func (degrees Degrees) propagateToHub(email, orcid string) (count int, err error
 			LocalID:         d.ID + "/" + d.StudentDegNbr,
 			Email:           email,
 			Orcid:           orcid,
-			Role:            degreeName,
+			Role:            d.title(),
 			IsActive:        true,
 		}
 	}
-	// Make sure the task set-up is comlete
+	return records
+}
 
-	var task Task
-	err = oh.patch("api/v1/affiliations/"+strconv.Itoa(taskID), Task{ID: taskID, Records: records}, &task)
-	if err != nil {
-		log.Error("failed to update the taks: ", err)
+// propagateToHub adds degree/education records to the current affiliation task with the ORCID Hub client.
+// In the dry-run mode (dr != nil) the records only get collected.
+func (degrees Degrees) propagateToHub(c *Client, email, orcid string, dr *DryRun) (count int, err error) {
+
+	count = len(degrees)
+	if count == 0 {
+		return 0, errors.New("no degree entry")
+	}
+	if dr != nil {
+		dr.addRecords(degrees.records(email, orcid))
 		return
 	}
-	taskRecordCountMutex.Lock()
-	taskRecordCount += count
-	taskRecordCountMutex.Unlock()
-
+	err = addTaskRecords(c, degrees.records(email, orcid))
 	return
 }
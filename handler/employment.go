@@ -2,7 +2,6 @@ package main
 
 import (
 	"errors"
-	"strconv"
 )
 
 // Employment API empoyment-v1 response message.
@@ -48,15 +47,9 @@ type Employment struct {
 	UniServicesFTE       int    `json:"uniServicesFTE"`
 }
 
-// propagateToHub adds employment records to the current affiliation task.
-func (emp *Employment) propagateToHub(email, orcid string) (count int, err error) {
-
-	count = len(emp.Job)
-	if count == 0 {
-		return 0, errors.New("no job entries")
-	}
-
-	records := make([]Record, count)
+// records maps the employment job entries onto the affiliation task records.
+func (emp *Employment) records(email, orcid string) []Record {
+	records := make([]Record, len(emp.Job))
 	for i, job := range emp.Job {
 		records[i] = Record{
 			AffiliationType: "employment",
@@ -70,17 +63,21 @@ func (emp *Employment) propagateToHub(email, orcid string) (count int, err error
 			IsActive:        true,
 		}
 	}
-	// Make sure the task set-up is comlete
+	return records
+}
 
-	var task Task
-	err = oh.patch("api/v1/affiliations/"+strconv.Itoa(taskID), Task{ID: taskID, Records: records}, &task)
-	if err != nil {
-		log.Error("failed to update the taks: ", err)
+// propagateToHub adds employment records to the current affiliation task with the ORCID Hub client.
+// In the dry-run mode (dr != nil) the records only get collected.
+func (emp *Employment) propagateToHub(c *Client, email, orcid string, dr *DryRun) (count int, err error) {
+
+	count = len(emp.Job)
+	if count == 0 {
+		return 0, errors.New("no job entries")
+	}
+	if dr != nil {
+		dr.addRecords(emp.records(email, orcid))
 		return
 	}
-	taskRecordCountMutex.Lock()
-	taskRecordCount += count
-	taskRecordCountMutex.Unlock()
-
+	err = addTaskRecords(c, emp.records(email, orcid))
 	return
 }
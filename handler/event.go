@@ -1,6 +1,14 @@
 package main
 
-import "github.com/aws/aws-lambda-go/events"
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"go.uber.org/zap"
+)
 
 // Event - a generic message suitable for both EMP Update event and
 // ORCIDHub Webhook propagagted event (with wrapped in SQS message batch):
@@ -11,6 +19,146 @@ type Event struct {
 	Subject int    `json:"subject,string"`
 	Type    string `json:"type"`
 	URL     string `json:"url"`
+	// Source of the event, e.g., the Kafka topic
+	Source string `json:"source"`
 	// SQS Message if used SQS
 	Records []events.SQSMessage
+	// Batch of messages posted by Kafka HTTP sink connector
+	Batch []Event `json:"-"`
+	// the SNS message the event was delivered with (its signature gets verified before the event is handled)
+	SNS *SNSMessage `json:"sns,omitempty"`
+	// DryRun - process the event without writing anywhere
+	DryRun bool `json:"dry-run,omitempty"`
+
+	// the changes collected in the dry-run mode
+	dryRun *DryRun
+	// the identity records looked up within the batch
+	identities *cache
+	// the correlation IDs: the event (message) ID, the SQS message ID and the AWS Lambda or HTTP request ID
+	id, sqsMessageID, requestID string
+	// the event scoped logger
+	log *zap.SugaredLogger
+	// the incoming trace context and the span of the event
+	parent spanContext
+	span   *span
+}
+
+// UnmarshalJSON decodes the event message. Besides the flat event message it
+// accepts the payloads posted by Kafka HTTP sink connector (a raw topic message or
+// a Kafka record envelope), CloudEvents (structured mode), SNS notifications,
+// EventBridge events, or a batch (an array) of any of these.
+func (e *Event) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(data, &batch); err != nil {
+			return err
+		}
+		e.Batch = make([]Event, 0, len(batch))
+		for _, m := range batch {
+			var be Event
+			if err := json.Unmarshal(m, &be); err != nil {
+				log.Errorf("failed to decode the batch message %s: %v", m, err)
+				continue
+			}
+			e.Batch = append(e.Batch, be)
+		}
+		return nil
+	}
+
+	var m envelope
+	if err := json.Unmarshal(data, &m); err == nil {
+		switch {
+		case m.TopicArn != "" && m.MessageID != "":
+			return e.decodeSNSMessage(data)
+		case m.SpecVersion != "":
+			return e.decodeCloudEvent(data)
+		case m.DetailType != "" && m.Detail != nil:
+			return e.decodeEventBridgeEvent(data)
+		case m.isKafkaMessage():
+			if m.Topic != "" && m.Value != nil {
+				return e.decodeKafkaRecord(data)
+			}
+			return e.decodeTopicMessage("", data)
+		}
+	}
+
+	type event Event
+	return json.Unmarshal(data, (*event)(e))
+}
+
+// envelope is used to probe the message for the envelope or the schema specific fields.
+type envelope struct {
+	kafkaMessage
+	// CloudEvents
+	SpecVersion string `json:"specversion"`
+	// SNS
+	TopicArn  string `json:"TopicArn"`
+	MessageID string `json:"MessageId"`
+	// EventBridge
+	DetailType string          `json:"detail-type"`
+	Detail     json.RawMessage `json:"detail"`
+}
+
+// applyAttributes maps the envelope attributes (e.g., CloudEvents context attributes)
+// onto the event unless the event payload has already set them.
+func (e *Event) applyAttributes(typ, subject, source string) {
+	if e.Subject == 0 && e.EPPN == "" && subject != "" {
+		if id, err := strconv.Atoi(subject); err == nil {
+			e.Subject = id
+		} else if strings.Contains(subject, "@") {
+			e.EPPN = subject
+		}
+	}
+	if e.Type == "" {
+		e.Type = typ
+	}
+	if e.Source == "" {
+		e.Source = source
+	}
+}
+
+// resyncEventType is the type of the event that triggers the full
+// resynchronisation of the user profile irrespective of the event source.
+const resyncEventType = "RESYNC"
+
+// refreshesEmployment checks if the event should trigger the update of the employment records.
+func (e *Event) refreshesEmployment() bool {
+	return e.Type == resyncEventType || e.Source != studentTopic
+}
+
+// refreshesEducation checks if the event should trigger the update of the education records.
+func (e *Event) refreshesEducation() bool {
+	return e.Type == resyncEventType || e.Source != employmentTopic
+}
+
+// isBatch checks if the event is a batch of event messages.
+func (e *Event) isBatch() bool {
+	return e.Records != nil || e.Batch != nil
+}
+
+// messages returns the flattened list of the event messages of the batch
+// that can be processed.
+func (e *Event) messages() (list []Event) {
+	var batch = e.Batch
+	for _, r := range e.Records {
+		var m Event
+		json.Unmarshal([]byte(r.Body), &m)
+		m.sqsMessageID = r.MessageId
+		if a, ok := r.MessageAttributes[traceParentHeader]; ok && a.StringValue != nil {
+			m.parent, _ = parseTraceParent(*a.StringValue)
+		}
+		batch = append(batch, m)
+	}
+	for _, m := range batch {
+		if m.requestID == "" {
+			m.requestID = e.requestID
+		}
+		if m.isBatch() {
+			list = append(list, m.messages()...)
+		} else if m.Subject != 0 || m.isHubEvent() {
+			list = append(list, m)
+		}
+	}
+	return
 }
@@ -0,0 +1,51 @@
+// +build ignore
+
+// Generates degree_codes.go embedding the default degree code mapping (data/degree_codes.json).
+// Run with: go generate ./handler
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+const (
+	source = "data/degree_codes.json"
+	target = "degree_codes.go"
+)
+
+func main() {
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var mapping struct {
+		Version string            `json:"version"`
+		Codes   map[string]string `json:"codes"`
+		Maori   map[string]string `json:"maori"`
+	}
+	if err = json.Unmarshal(data, &mapping); err != nil {
+		log.Fatalf("invalid %s: %v", source, err)
+	}
+	if mapping.Version == "" || len(mapping.Codes) == 0 {
+		log.Fatalf("invalid %s: missing version or codes", source)
+	}
+	if bytes.Contains(data, []byte("`")) {
+		log.Fatalf("invalid %s: backquotes are not supported", source)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "// Code generated by gen_degree_codes.go from %s; DO NOT EDIT.\n\n", source)
+	sb.WriteString("package main\n\n")
+	fmt.Fprintf(&sb, "// defaultDegreeCodes - the default degree code mapping (version %s).\n", mapping.Version)
+	sb.WriteString("const defaultDegreeCodes = `")
+	sb.Write(bytes.TrimSpace(data))
+	sb.WriteString("`\n")
+	if err = ioutil.WriteFile(target, []byte(sb.String()), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
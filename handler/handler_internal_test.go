@@ -3,18 +3,50 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"text/template"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/protobuf/proto"
 )
 
 var (
@@ -43,8 +75,8 @@ func setupTests(t *testing.T) {
 
 	server = httptest.NewServer(createMockHandler(t))
 
-	APIBaseURL = server.URL + "/service"
-	OHBaseURL = server.URL
+	config.APIURL = server.URL + "/service"
+	config.HubURL = server.URL
 	api.baseURL = server.URL + "/service"
 	oh.baseURL = server.URL
 
@@ -86,6 +118,24 @@ func TestCore(t *testing.T) {
 	t.Run("ProcessRegistration", testProcessRegistration)
 	t.Run("ProcessEmpUpdate", testProcessEmpUpdate)
 	t.Run("ProcessMixed", testProcessMixed)
+	t.Run("ProcessKafka", testProcessKafka)
+	t.Run("ProcessBySource", testProcessBySource)
+	t.Run("SNSSubscription", testSNSSubscription)
+	t.Run("HubEvents", testHubEvents)
+	t.Run("Readiness", testReadiness)
+	t.Run("EventQueue", testEventQueue)
+	t.Run("AdminAPI", testAdminAPI)
+	t.Run("DryRun", testDryRun)
+	t.Run("Backfill", testBackfill)
+	t.Run("Reconcile", testReconcile)
+	t.Run("Replay", testReplay)
+	t.Run("BatchIdentityCache", testBatchIdentityCache)
+	t.Run("BatchErrors", testBatchErrors)
+	t.Run("OrcidConflicts", testOrcidConflicts)
+	t.Run("PrivacyMode", testPrivacyMode)
+	t.Run("EventLogging", testEventLogging)
+	t.Run("Metrics", testMetrics)
+	t.Run("Tracing", testTracing)
 	t.Run("HealthCheck", testHealthCheck)
 	t.Run("MalformatedPayload", testMalformatedPayload)
 }
@@ -129,16 +179,17 @@ func testMalformatedPayload(t *testing.T) {
 		t.Skip()
 	}
 
-	var fatalCallCount int
-	logFatal = func(args ...interface{}) { fatalCallCount++; t.Log("*** FATAL: ", args) }
 	malformatResponse = true
 
-	(&Task{ID: 123456}).activate()
-	newTask()
+	(&Task{ID: 123456}).activate(&oh)
+	assert.NotNil(t, newTask(&oh))
+	defer func(id int) { taskID = id }(taskID)
+	taskID = 0
+	assert.NotNil(t, setupTask(&oh))
+	_, err := (&Event{Subject: 208013283, Type: resyncEventType}).handle()
+	assert.NotNil(t, err, "the event should fail if the task can't be created")
 
 	malformatResponse = false
-	logFatal = log.Fatal
-	assert.Equal(t, 1, fatalCallCount)
 }
 
 func testHandler(t *testing.T) {
@@ -177,7 +228,7 @@ func testIdentityAPICient(t *testing.T) {
 	// c.ApiKey = os.Getenv("APIKEY")
 	// c.BaseURL = "https://api.dev.auckland.ac.nz"
 
-	c.baseURL = APIBaseURL
+	c.baseURL = config.APIURL
 	var id Identity
 	c.get("identity/integrations/v3/identity/rcir178", &id)
 	assert.NotEqual(t, -1, id.ID)
@@ -190,9 +241,10 @@ func testIdentityAPICient(t *testing.T) {
 
 	var idNotFound Identity
 	err = c.get("identity/integrations/v3/identity/rad42", &idNotFound)
-	if err != nil {
-		t.Error(err)
-	}
+	require.NotNil(t, err, "non-2xx responses should fail")
+	assert.True(t, isNotFound(err))
+	assert.Contains(t, err.Error(), "404")
+	assert.Nil(t, c.lookup("identity/integrations/v3/identity/rad42", &idNotFound))
 	assert.Equal(t, 0, idNotFound.ID)
 
 	malformatResponse = true
@@ -213,7 +265,7 @@ func testStudentAPICient(t *testing.T) {
 	// c.ApiKey = os.Getenv("APIKEY")
 	// c.BaseURL = "https://api.dev.auckland.ac.nz"
 
-	c.baseURL = APIBaseURL
+	c.baseURL = config.APIURL
 	var degrees Degrees
 
 	c.get("student/integrations/v1/student/208013283/degree/", &degrees)
@@ -234,7 +286,7 @@ func testStudentAPICient(t *testing.T) {
 	// malformated message:
 	c.get("student/integrations/v1/student/208013283/degree/", &degrees)
 	malformatResponse = true
-	_, err := degrees.propagateToHub("rpaw058@auckland.ac.nz", "0000-0003-1255-9023")
+	_, err := degrees.propagateToHub(&oh, "rpaw058@auckland.ac.nz", "0000-0003-1255-9023", nil)
 	assert.NotNil(t, err)
 	malformatResponse = false
 
@@ -245,7 +297,7 @@ func testEmploymentAPICient(t *testing.T) {
 
 	malformatResponse = false
 	c.apiKey = os.Getenv("APIKEY")
-	c.baseURL = APIBaseURL
+	c.baseURL = config.APIURL
 
 	var emp Employment
 	err := c.get("employment/integrations/v1/employee/rcir178", &emp)
@@ -253,20 +305,20 @@ func testEmploymentAPICient(t *testing.T) {
 		t.Error(err)
 	}
 
-	count, err := emp.propagateToHub("rcir178@auckland.ac.nz", "0000-0001-8228-7153")
+	count, err := emp.propagateToHub(&oh, "rcir178@auckland.ac.nz", "0000-0001-8228-7153", nil)
 	assert.NotZero(t, count)
 	assert.Nil(t, err)
 
 	// malformated message:
 	malformatResponse = true
-	count, err = emp.propagateToHub("rcir178@auckland.ac.nz", "0000-0001-8228-7153")
+	count, err = emp.propagateToHub(&oh, "rcir178@auckland.ac.nz", "0000-0001-8228-7153", nil)
 	assert.Equal(t, 1, count)
 	assert.NotNil(t, err)
 	malformatResponse = false
 
 	// no jobs
 	emp.Job = nil
-	count, err = emp.propagateToHub("rcir178@auckland.ac.nz", "0000-0001-8228-7153")
+	count, err = emp.propagateToHub(&oh, "rcir178@auckland.ac.nz", "0000-0001-8228-7153", nil)
 	assert.Zero(t, count)
 	assert.NotNil(t, err)
 }
@@ -277,13 +329,12 @@ func testAccessToken(t *testing.T) {
 	malformatResponse = false
 	c.clientID = os.Getenv("CLIENT_ID")
 	c.clientSecret = os.Getenv("CLIENT_SECRET")
-	c.baseURL = OHBaseURL
+	c.baseURL = config.HubURL
 	err := c.getAccessToken("oauth/token")
 	assert.Nil(t, err)
 	assert.NotEmpty(t, c.accessToken)
 
 	// malformated message
-	logFatal = func(args ...interface{}) {}
 	malformatResponse = true
 
 	c.accessToken = ""
@@ -297,7 +348,6 @@ func testAccessToken(t *testing.T) {
 	oh.accessToken = at
 
 	malformatResponse = false
-	logFatal = log.Fatal
 }
 
 func testGetOrcidToken(t *testing.T) {
@@ -306,7 +356,7 @@ func testGetOrcidToken(t *testing.T) {
 	malformatResponse = false
 	c.clientID = os.Getenv("CLIENT_ID")
 	c.clientSecret = os.Getenv("CLIENT_SECRET")
-	c.baseURL = OHBaseURL
+	c.baseURL = config.HubURL
 	c.getAccessToken("oauth/token")
 	var tokens []struct {
 		AccessToken  string `json:"access_token"`
@@ -371,7 +421,6 @@ func testProcessRegistration(t *testing.T) {
 	assert.NotNil(t, err)
 
 	// malformatted messages:
-	logFatal = func(args ...interface{}) {}
 	malformatResponse = true
 
 	e = Event{Type: "CREATED", EPPN: "djim087@auckland.ac.nz", ORCID: "0000-0002-3008-0422"}
@@ -380,7 +429,6 @@ func testProcessRegistration(t *testing.T) {
 	assert.NotNil(t, err)
 
 	malformatResponse = false
-	// logFatal = log.Fatal
 }
 
 func testHealthCheck(t *testing.T) {
@@ -419,7 +467,7 @@ func TestIdentityGetORCID(t *testing.T) {
          "type":"NSN"
       },
       {
-         "id":"http://orcid.org/1234-1234-1234-ABCD",
+         "id":"http://orcid.org/0000-0002-1694-233x",
          "type":"ORCID"
       },
       {
@@ -427,7 +475,11 @@ func TestIdentityGetORCID(t *testing.T) {
          "type":"UID"
       }
    ]}`), &id)
-	assert.Equal(t, "1234-1234-1234-ABCD", id.GetORCID())
+	assert.Equal(t, "0000-0002-1694-233X", id.GetORCID())
+
+	// invalid ORCID iDs get ignored
+	id.ExtIds[2].ID = "http://orcid.org/1234-1234-1234-ABCD"
+	assert.Equal(t, "", id.GetORCID())
 
 	json.Unmarshal([]byte(`{
    "extIds":[
@@ -475,12 +527,12 @@ func testIdentityGetOrcidAccessToken(t *testing.T) {
 		"id":123443,
 		"upi":"rcir178ABC"
    }`), &id)
-	token, ok := id.GetOrcidAccessToken()
+	token, ok := id.GetOrcidAccessToken(&oh)
 	assert.False(t, ok)
 	_ = token
 
 	id.Emails[0].Email = "rad42@mailinator.com"
-	token, ok = id.GetOrcidAccessToken()
+	token, ok = id.GetOrcidAccessToken(&oh)
 	assert.True(t, ok)
 	assert.True(t, isValidUUID(token.AccessToken))
 	if !live {
@@ -488,7 +540,7 @@ func testIdentityGetOrcidAccessToken(t *testing.T) {
 	}
 
 	id.EmailAddress = "rcir178@auckland.ac.nz"
-	token, ok = id.GetOrcidAccessToken()
+	token, ok = id.GetOrcidAccessToken(&oh)
 	assert.True(t, ok)
 	assert.True(t, isValidUUID(token.AccessToken))
 	if !live {
@@ -496,7 +548,7 @@ func testIdentityGetOrcidAccessToken(t *testing.T) {
 	}
 
 	id.Upi = "rcir178"
-	token, ok = id.GetOrcidAccessToken()
+	token, ok = id.GetOrcidAccessToken(&oh)
 	assert.True(t, ok)
 	assert.True(t, isValidUUID(token.AccessToken))
 	if !live {
@@ -504,7 +556,7 @@ func testIdentityGetOrcidAccessToken(t *testing.T) {
 	}
 
 	id.ExtIds[0].Type = "ORCID"
-	token, ok = id.GetOrcidAccessToken()
+	token, ok = id.GetOrcidAccessToken(&oh)
 	assert.True(t, ok)
 	assert.True(t, isValidUUID(token.AccessToken))
 	if !live {
@@ -514,12 +566,12 @@ func testIdentityGetOrcidAccessToken(t *testing.T) {
 	// no update scope
 	id.Upi = "dthn666"
 	id.ExtIds = nil
-	token, ok = id.GetOrcidAccessToken()
+	token, ok = id.GetOrcidAccessToken(&oh)
 	assert.False(t, ok)
 
 	// malformated message
 	malformatResponse = true
-	token, ok = id.GetOrcidAccessToken()
+	token, ok = id.GetOrcidAccessToken(&oh)
 	assert.False(t, ok)
 	malformatResponse = false
 }
@@ -560,7 +612,6 @@ func testProcessEmpUpdate(t *testing.T) {
 
 	// Malformatted
 
-	logFatal = func(args ...interface{}) {}
 	malformatResponse = true
 	_, err = (&Event{
 		Records: []events.SQSMessage{
@@ -570,7 +621,6 @@ func testProcessEmpUpdate(t *testing.T) {
 		},
 	}).handle()
 	malformatResponse = false
-	logFatal = log.Fatal
 	assert.NotNil(t, err)
 }
 
@@ -629,7 +679,8 @@ func testProcessMixed(t *testing.T) {
 	}).handle()
 
 	if !live {
-		assert.True(t, taskRecordCount == 9, "The number of records should be 8, got: %d.", taskRecordCount)
+		// NB! the 'UPDATED' webhook event re-syncs the user
+		assert.True(t, taskRecordCount == 10, "The number of records should be 10, got: %d.", taskRecordCount)
 	}
 	assert.NotNil(t, err)
 
@@ -643,7 +694,6 @@ func testProcessMixed(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Equal(t, 3, counter)
 
-	logFatal = func(args ...interface{}) {}
 	malformatResponse = true
 	counter = 0
 	assert.NotNil(t, err)
@@ -656,7 +706,6 @@ func testProcessMixed(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 1, counter)
 	malformatResponse = false
-	logFatal = log.Fatal
 }
 
 func TestIsValidUPIAndID(t *testing.T) {
@@ -668,3 +717,2610 @@ func TestIsValidUPIAndID(t *testing.T) {
 	assert.False(t, isValidUPI("abcdd34"))
 	assert.False(t, isValidUPI("abcd23x"))
 }
+
+func TestKafkaEventDecoding(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload string
+		subject int
+		typ     string
+		source  string
+		isError bool
+	}{
+		{"EmploymentMessage", `{
+			"header": {"messageId": "6b1c1d7e", "eventType": "JOB_UPDATE", "timestamp": "2019-11-20T01:02:03Z"},
+			"employeeId": "484378182",
+			"upi": "rcir178",
+			"positionNumber": "60015481"
+		}`, 484378182, "JOB_UPDATE", employmentTopic, false},
+		{"StudentMessage", `{
+			"header": {"messageId": "6b1c1d7f", "eventType": "DEGREE_CONFERRED"},
+			"studentId": "208013283",
+			"upi": "rpaw053",
+			"degreeCode": "MESTU-DG"
+		}`, 208013283, "DEGREE_CONFERRED", studentTopic, false},
+		{"KafkaRecord", `{
+			"topic": "nz-ac-auckland-employment",
+			"partition": 0,
+			"offset": 42,
+			"key": "477579437",
+			"value": {"header": {"eventType": "JOB_UPDATE"}, "employeeId": "477579437"}
+		}`, 477579437, "JOB_UPDATE", employmentTopic, false},
+		{"KafkaRecordWithStringValueAndHeaders", `{
+			"topic": "nz-ac-auckland-student",
+			"offset": 43,
+			"headers": [{"key": "eventType", "value": "ENROLMENT"}],
+			"value": "{\"studentId\": \"8524255\"}"
+		}`, 8524255, "ENROLMENT", studentTopic, false},
+		{"FlatMessage", `{"subject": "4306445"}`, 4306445, "", "", false},
+		{"UnknownTopic", `{"topic": "nz-ac-auckland-library", "value": {"employeeId": "4306445"}}`, 0, "", "", true},
+		{"MissingID", `{"topic": "nz-ac-auckland-student", "value": {"upi": "rpaw053"}}`, 0, "", "", true},
+		{"InvalidID", `{"employeeId": "ABC4306445"}`, 0, "", "", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var e Event
+			err := json.Unmarshal([]byte(tc.payload), &e)
+			if tc.isError {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tc.subject, e.Subject)
+			assert.Equal(t, tc.typ, e.Type)
+			assert.Equal(t, tc.source, e.Source)
+			assert.False(t, e.isBatch())
+		})
+	}
+
+	var e Event
+	err := json.Unmarshal([]byte(`[
+		{"topic": "nz-ac-auckland-employment", "offset": 1, "value": {"employeeId": "484378182"}},
+		{"topic": "nz-ac-auckland-student", "offset": 2, "value": {"studentId": "208013283"}},
+		{"topic": "nz-ac-auckland-student", "offset": 3, "value": {"upi": "rpaw053"}},
+		{"studentId": "477579437"},
+		[{"employeeId": "8524255"}]
+	]`), &e)
+	require.Nil(t, err)
+	assert.True(t, e.isBatch())
+	assert.Len(t, e.Batch, 4)
+
+	var subjects []int
+	for _, m := range e.messages() {
+		subjects = append(subjects, m.Subject)
+	}
+	assert.Equal(t, []int{484378182, 208013283, 477579437, 8524255}, subjects)
+}
+
+func testProcessKafka(t *testing.T) {
+
+	taskRecordCount = 0
+	taskID = 0
+	withAnIncomleteTask = true
+	malformatResponse = false
+
+	var e Event
+	err := json.Unmarshal([]byte(`[
+		{"topic": "nz-ac-auckland-employment", "offset": 1, "value": {"employeeId": "484378182"}},
+		{"topic": "nz-ac-auckland-student", "offset": 2, "value": "{\"studentId\": \"208013283\"}"}
+	]`), &e)
+	require.Nil(t, err)
+
+	counter = 0
+	_, err = e.handle()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, counter)
+	if !live {
+		assert.True(t, taskRecordCount > 0, "The number of records should be > 0.")
+	}
+}
+
+func testProcessBySource(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	withAnIncomleteTask = true
+	malformatResponse = false
+
+	// NB! the incomplete task already has 2 records
+	for _, tc := range []struct {
+		event Event
+		count int
+	}{
+		{Event{Subject: 208013283, Source: employmentTopic}, 4},
+		{Event{Subject: 208013283, Source: studentTopic}, 5},
+		{Event{Subject: 208013283, Source: studentTopic, Type: resyncEventType}, 7},
+		{Event{Subject: 208013283}, 7},
+	} {
+		taskRecordCount = 0
+		taskID = 0
+		_, err := tc.event.handle()
+		assert.Nil(t, err)
+		assert.Equal(t, tc.count, taskRecordCount, "event: %#v", tc.event)
+	}
+}
+
+const snsTestCertURL = "https://sns.ap-southeast-2.amazonaws.com/SimpleNotificationService-test.pem"
+
+var (
+	snsTestKey  *rsa.PrivateKey
+	snsTestOnce sync.Once
+)
+
+// signSNSMessage signs the SNS message with the test key whose certificate is registered as
+// the SNS signing certificate (snsTestCertURL) and returns the JSON encoded message.
+func signSNSMessage(t *testing.T, m *SNSMessage) string {
+	snsTestOnce.Do(func() {
+		var err error
+		snsTestKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		require.Nil(t, err)
+		template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "sns.amazonaws.com"}}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &snsTestKey.PublicKey, snsTestKey)
+		require.Nil(t, err)
+		cert, err := x509.ParseCertificate(der)
+		require.Nil(t, err)
+		snsCertificates.Store(snsTestCertURL, cert)
+	})
+	if m.SignatureVersion == "" {
+		m.SignatureVersion = "1"
+	}
+	if m.SigningCertURL == "" {
+		m.SigningCertURL = snsTestCertURL
+	}
+	hash, algorithm := crypto.SHA1, crypto.SHA1.New()
+	if m.SignatureVersion == "2" {
+		hash, algorithm = crypto.SHA256, crypto.SHA256.New()
+	}
+	algorithm.Write([]byte(m.stringToSign()))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, snsTestKey, hash, algorithm.Sum(nil))
+	require.Nil(t, err)
+	m.Signature = base64.StdEncoding.EncodeToString(signature)
+	data, err := json.Marshal(m)
+	require.Nil(t, err)
+	return string(data)
+}
+
+// snsAttributes returns the SNS message attributes given as name-value pairs.
+func snsAttributes(pairs ...string) map[string]struct {
+	Type  string `json:"Type"`
+	Value string `json:"Value"`
+} {
+	attributes := make(map[string]struct {
+		Type  string `json:"Type"`
+		Value string `json:"Value"`
+	})
+	for i := 0; i+1 < len(pairs); i += 2 {
+		attributes[pairs[i]] = struct {
+			Type  string `json:"Type"`
+			Value string `json:"Value"`
+		}{"String", pairs[i+1]}
+	}
+	return attributes
+}
+
+func TestEnvelopeDecoding(t *testing.T) {
+	confirmation := SNSMessage{
+		Type:             snsSubscriptionConfirmation,
+		MessageID:        "165545c9-2a5c-472c-8df2-7ff2be2b3b1b",
+		Token:            "2336412f37",
+		TopicArn:         "arn:aws:sns:ap-southeast-2:123456789012:orcidhub",
+		Message:          "You have chosen to subscribe to the topic...",
+		Timestamp:        "2019-11-21T18:43:48.000Z",
+		SubscribeURL:     "https://sns.ap-southeast-2.amazonaws.com/?Action=ConfirmSubscription&Token=2336412f37",
+		SignatureVersion: "2",
+	}
+	notification := SNSMessage{
+		Type:              snsNotification,
+		MessageID:         "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+		TopicArn:          "arn:aws:sns:ap-southeast-2:123456789012:orcidhub",
+		Subject:           "Employment update",
+		Message:           `{"subject": "484378182"}`,
+		Timestamp:         "2019-11-21T18:43:48.000Z",
+		MessageAttributes: snsAttributes("source", "nz-ac-auckland-employment"),
+	}
+	notificationWithAttributes := SNSMessage{
+		Type:              snsNotification,
+		MessageID:         "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf325",
+		TopicArn:          "arn:aws:sns:ap-southeast-2:123456789012:orcidhub",
+		MessageAttributes: snsAttributes("type", "RESYNC", "subject", "208013283"),
+	}
+	for _, tc := range []struct {
+		name    string
+		payload string
+		event   Event
+		isError bool
+	}{
+		{"CloudEvent", `{
+			"specversion": "1.0",
+			"id": "A234-1234-1234",
+			"source": "nz-ac-auckland-employment",
+			"type": "RESYNC",
+			"subject": "484378182"
+		}`, Event{Subject: 484378182, Type: "RESYNC", Source: employmentTopic, id: "A234-1234-1234"}, false},
+		{"CloudEventWithData", `{
+			"specversion": "1.0",
+			"id": "A234-1234-1235",
+			"source": "/orcidhub/webhook",
+			"type": "nz.orcidhub.webhook",
+			"datacontenttype": "application/json",
+			"data": {"type": "CREATED", "eppn": "rcir178@auckland.ac.nz", "orcid": "0000-0001-8228-7153"}
+		}`, Event{EPPN: "rcir178@auckland.ac.nz", ORCID: "0000-0001-8228-7153", Type: "CREATED", Source: "/orcidhub/webhook", id: "A234-1234-1235"}, false},
+		{"CloudEventWithKafkaMessage", `{
+			"specversion": "1.0",
+			"id": "A234-1234-1236",
+			"source": "kafka",
+			"type": "nz.ac.auckland.student",
+			"data": {"header": {"eventType": "DEGREE_CONFERRED"}, "studentId": "208013283"}
+		}`, Event{Subject: 208013283, Type: "DEGREE_CONFERRED", Source: studentTopic, id: "A234-1234-1236"}, false},
+		{"CloudEventWithBase64Data", `{
+			"specversion": "1.0",
+			"id": "A234-1234-1237",
+			"source": "test",
+			"type": "UPDATE",
+			"data_base64": "eyJzdWJqZWN0IjogIjQzMDY0NDUifQ=="
+		}`, Event{Subject: 4306445, Type: "UPDATE", Source: "test", id: "A234-1234-1237"}, false},
+		{"CloudEventUnsupportedVersion", `{"specversion": "0.3", "id": "1", "source": "test", "type": "PING"}`, Event{}, true},
+		{"EventBridge", `{
+			"version": "0",
+			"id": "6a7e8feb-b491-4cf7-a9f1-bf3703467718",
+			"detail-type": "RESYNC",
+			"source": "nz.ac.auckland.hr",
+			"time": "2019-11-21T18:43:48Z",
+			"detail": {"subject": "477579437"}
+		}`, Event{Subject: 477579437, Type: "RESYNC", Source: "nz.ac.auckland.hr", id: "6a7e8feb-b491-4cf7-a9f1-bf3703467718"}, false},
+		{"SNSNotification", signSNSMessage(t, &notification), Event{Subject: 484378182, Source: employmentTopic,
+			id: "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324", SNS: &notification}, false},
+		{"SNSNotificationWithAttributes", signSNSMessage(t, &notificationWithAttributes), Event{Subject: 208013283,
+			Type: "RESYNC", id: "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf325", SNS: &notificationWithAttributes}, false},
+		{"SNSSubscriptionConfirmation", signSNSMessage(t, &confirmation), Event{
+			Type:   snsSubscriptionConfirmation,
+			URL:    "https://sns.ap-southeast-2.amazonaws.com/?Action=ConfirmSubscription&Token=2336412f37",
+			Source: "arn:aws:sns:ap-southeast-2:123456789012:orcidhub",
+			SNS:    &confirmation,
+		}, false},
+		{"SNSInvalidMessage", signSNSMessage(t, &SNSMessage{
+			Type:      snsNotification,
+			MessageID: "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf326",
+			TopicArn:  "arn:aws:sns:ap-southeast-2:123456789012:orcidhub",
+			Message:   "NOT JSON",
+		}), Event{}, true},
+		{"SNSUnsignedMessage", `{
+			"Type": "Notification",
+			"MessageId": "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf327",
+			"TopicArn": "arn:aws:sns:ap-southeast-2:123456789012:orcidhub",
+			"Message": "{\"subject\": \"484378182\"}"
+		}`, Event{}, true},
+		{"SNSTamperedMessage", strings.Replace(signSNSMessage(t, &SNSMessage{
+			Type:      snsNotification,
+			MessageID: "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf328",
+			TopicArn:  "arn:aws:sns:ap-southeast-2:123456789012:orcidhub",
+			Message:   `{"subject": "484378182"}`,
+		}), "484378182", "208013283", 1), Event{}, true},
+		{"SNSForeignCertificate", signSNSMessage(t, &SNSMessage{
+			Type:           snsNotification,
+			MessageID:      "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf329",
+			TopicArn:       "arn:aws:sns:ap-southeast-2:123456789012:orcidhub",
+			Message:        `{"subject": "484378182"}`,
+			SigningCertURL: "https://sns.ap-southeast-2.amazonaws.com.example.com/SimpleNotificationService.pem",
+		}), Event{}, true},
+		{"SNSOtherRegionCertificate", signSNSMessage(t, &SNSMessage{
+			Type:           snsNotification,
+			MessageID:      "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf32a",
+			TopicArn:       "arn:aws:sns:ap-southeast-2:123456789012:orcidhub",
+			Message:        `{"subject": "484378182"}`,
+			SigningCertURL: "https://sns.us-east-1.amazonaws.com/SimpleNotificationService-test.pem",
+		}), Event{}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var e Event
+			err := json.Unmarshal([]byte(tc.payload), &e)
+			if err == nil {
+				err = e.SNS.verify()
+			}
+			if tc.isError {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tc.event, e)
+		})
+	}
+
+	// the signature gets verified only when the event is handled
+	var e Event
+	require.Nil(t, json.Unmarshal([]byte(strings.Replace(signSNSMessage(t, &notification), "484378182", "208013283", 1)), &e))
+	_, err := e.handle()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "signature")
+}
+
+func TestBinaryCloudEvent(t *testing.T) {
+	req := httptest.NewRequest("POST", "/handle", strings.NewReader(`{"eppn": "rcir178@auckland.ac.nz", "orcid": "0000-0001-8228-7153"}`))
+	req.Header.Set("ce-specversion", "1.0")
+	req.Header.Set("ce-id", "A234-1234-1234")
+	req.Header.Set("ce-type", "CREATED")
+	req.Header.Set("ce-source", "/orcidhub/webhook")
+	e, err := eventFromRequest(req)
+	require.Nil(t, err)
+	assert.Equal(t, Event{EPPN: "rcir178@auckland.ac.nz", ORCID: "0000-0001-8228-7153", Type: "CREATED", Source: "/orcidhub/webhook", id: "A234-1234-1234"}, e)
+
+	// no data
+	req = httptest.NewRequest("POST", "/handle", nil)
+	req.Header.Set("ce-specversion", "1.0")
+	req.Header.Set("ce-type", "RESYNC")
+	req.Header.Set("ce-subject", "484378182")
+	e, err = eventFromRequest(req)
+	require.Nil(t, err)
+	assert.Equal(t, Event{Subject: 484378182, Type: "RESYNC"}, e)
+
+	req = httptest.NewRequest("POST", "/handle", nil)
+	req.Header.Set("ce-specversion", "0.3")
+	_, err = eventFromRequest(req)
+	assert.NotNil(t, err)
+
+	// not a CloudEvent
+	req = httptest.NewRequest("POST", "/handle", nil)
+	_, err = eventFromRequest(req)
+	assert.NotNil(t, err)
+}
+
+func testSNSSubscription(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	m := SNSMessage{
+		Type:         snsSubscriptionConfirmation,
+		MessageID:    "165545c9-2a5c-472c-8df2-7ff2be2b3b1b",
+		Token:        "2336412f37",
+		TopicArn:     "arn:aws:sns:ap-southeast-2:123456789012:orcidhub",
+		Timestamp:    "2019-11-21T18:43:48.000Z",
+		SubscribeURL: server.URL + "/sns/?Action=ConfirmSubscription&Token=2336412f37",
+	}
+	var e Event
+	require.Nil(t, json.Unmarshal([]byte(signSNSMessage(t, &m)), &e))
+	_, err := e.handle()
+	assert.NotNil(t, err, "only SNS URLs should be followed")
+
+	defer func(f func(string) string) { snsURL = f }(snsURL)
+	snsURL = func(region string) string {
+		if region == "ap-southeast-2" {
+			return server.URL + "/sns"
+		}
+		return "https://sns." + region + ".amazonaws.com"
+	}
+	cert, _ := snsCertificates.Load(snsTestCertURL)
+	snsCertificates.Store(server.URL+"/sns/SimpleNotificationService-test.pem", cert)
+	m.SigningCertURL = server.URL + "/sns/SimpleNotificationService-test.pem"
+	e = Event{}
+	require.Nil(t, json.Unmarshal([]byte(signSNSMessage(t, &m)), &e))
+	output, err := e.handle()
+	assert.Nil(t, err)
+	assert.Equal(t, "subscription confirmed", output)
+
+	// the confirmation survives the queue persistence
+	data, err := json.Marshal(e)
+	require.Nil(t, err)
+	var qe Event
+	require.Nil(t, json.Unmarshal(data, &qe))
+	output, err = qe.handle()
+	assert.Nil(t, err)
+	assert.Equal(t, "subscription confirmed", output)
+
+	// the subscription URL has to be on the endpoint of the topic region
+	m.SubscribeURL = "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription&Token=2336412f37"
+	e = Event{}
+	require.Nil(t, json.Unmarshal([]byte(signSNSMessage(t, &m)), &e))
+	_, err = e.handle()
+	assert.NotNil(t, err)
+	// as well as the signing certificate
+	m.TopicArn = "arn:aws:sns:us-east-1:123456789012:orcidhub"
+	e = Event{}
+	require.Nil(t, json.Unmarshal([]byte(signSNSMessage(t, &m)), &e))
+	_, err = e.handle()
+	assert.NotNil(t, err)
+	m.TopicArn = "arn:aws:sns:ap-southeast-2:123456789012:orcidhub"
+
+	m.SubscribeURL = server.URL + "/sns/UNKNOWN"
+	e = Event{}
+	require.Nil(t, json.Unmarshal([]byte(signSNSMessage(t, &m)), &e))
+	_, err = e.handle()
+	assert.NotNil(t, err)
+
+	// dry-run does not confirm the subscription
+	mockRequestsMutex.Lock()
+	snsConfirmations = nil
+	mockRequestsMutex.Unlock()
+	e = Event{}
+	require.Nil(t, json.Unmarshal([]byte(signSNSMessage(t, &m)), &e))
+	e.DryRun = true
+	output, err = e.handle()
+	require.Nil(t, err)
+	var dr DryRun
+	require.Nil(t, json.Unmarshal([]byte(output), &dr))
+	assert.Equal(t, m.TopicArn, dr.Subscription)
+	mockRequestsMutex.Lock()
+	assert.Empty(t, snsConfirmations)
+	mockRequestsMutex.Unlock()
+
+	// only the signed SNS messages get confirmed
+	for _, e := range []Event{
+		{Type: snsSubscriptionConfirmation, URL: server.URL + "/sns/?Action=ConfirmSubscription&Token=2336412f37"},
+		{Type: snsSubscriptionConfirmation, SNS: &SNSMessage{Type: snsSubscriptionConfirmation,
+			TopicArn: m.TopicArn, SubscribeURL: server.URL + "/sns/?Action=ConfirmSubscription&Token=2336412f37",
+			SignatureVersion: "1", SigningCertURL: m.SigningCertURL, Signature: m.Signature}},
+	} {
+		_, err = e.handle()
+		assert.NotNil(t, err)
+	}
+	var flat Event
+	require.Nil(t, json.Unmarshal([]byte(`{"type": "SubscriptionConfirmation", "url": "`+server.URL+
+		`/sns/?Action=ConfirmSubscription&Token=2336412f37"}`), &flat))
+	_, err = flat.handle()
+	assert.NotNil(t, err)
+
+	output, err = (&Event{Type: snsUnsubscribeConfirmation}).handle()
+	assert.Nil(t, err)
+	assert.Empty(t, output)
+}
+
+func testHubEvents(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "consents")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { consents = consentStore{} }()
+
+	taskID = 0
+	withAnIncomleteTask = true
+	malformatResponse = false
+	identifierRequests = nil
+
+	// without the consent store the ORCID iD gets cleared and the withdrawal is kept in memory
+	var buf bytes.Buffer
+	defer func(l *zap.SugaredLogger) { log = l }(log)
+	log = zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		zapcore.AddSync(&buf), zap.InfoLevel)).Sugar()
+	output, err := (&Event{Type: hubTokenRevoked, EPPN: "rpaw053@auckland.ac.nz", ORCID: "0000-0002-9398-4322"}).handle()
+	require.Nil(t, err)
+	assert.Contains(t, output, "consent withdrawn")
+	assert.Equal(t, []string{"DELETE /service/identity/integrations/v3/identity/208013283/identifier/ORCID"}, identifierRequests)
+	assert.True(t, consents.isWithdrawn("rpaw053"))
+	assert.Contains(t, buf.String(), "CONSENT_STORE")
+	assert.Contains(t, buf.String(), `"event-type":"REVOKED"`, "the event scoped logger should be used")
+	identifierRequests = nil
+	consents = consentStore{path: filepath.Join(dir, "consents.json")}
+
+	// the event fails (and gets retried) if the ORCID iD couldn't be removed
+	failIdentifierRequests = true
+	_, err = (&Event{Type: hubTokenRevoked, EPPN: "rpaw053@auckland.ac.nz", ORCID: "0000-0002-9398-4322"}).handle()
+	failIdentifierRequests = false
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "503")
+	assert.False(t, consents.isWithdrawn("rpaw053"))
+	identifierRequests = nil
+
+	// the updates of the users who have withdrawn the consent get logged with the event logger
+	buf.Reset()
+	consents.withdraw("rcir178")
+	_, err = (&Event{Type: hubUserUpdated, EPPN: "rcir178@auckland.ac.nz"}).handle()
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), `"event-type":"UPDATED"`)
+	consents.restore("rcir178")
+
+	// the events of any other type do not withdraw the consent
+	for _, typ := range []string{"PING", "UNKNOWN", ""} {
+		_, err = (&Event{Type: typ, EPPN: "rpaw053@auckland.ac.nz"}).processHubEvent()
+		require.NotNil(t, err, typ)
+		assert.Contains(t, err.Error(), "unhandled event")
+	}
+	output, err = (&Event{Type: "PING", EPPN: "rpaw053@auckland.ac.nz"}).handle()
+	assert.Nil(t, err)
+	assert.Equal(t, "GNIP", output)
+	assert.Empty(t, identifierRequests)
+	assert.False(t, consents.isWithdrawn("rpaw053"))
+
+	// unlinked ORCID iD is not the one stored in the identity system
+	output, err = (&Event{Type: hubOrcidUnlinked, EPPN: "rpaw053@auckland.ac.nz", ORCID: "0000-0003-1255-9023"}).handle()
+	assert.Nil(t, err)
+	assert.Contains(t, output, "consent withdrawn")
+	assert.Empty(t, identifierRequests)
+	assert.True(t, consents.isWithdrawn("rpaw053"))
+
+	output, err = (&Event{Type: hubTokenRevoked, EPPN: "rpaw053@auckland.ac.nz", ORCID: "0000-0002-9398-4322"}).handle()
+	assert.Nil(t, err)
+	assert.Contains(t, output, "consent withdrawn")
+	assert.Equal(t, []string{"DELETE /service/identity/integrations/v3/identity/208013283/identifier/ORCID"}, identifierRequests)
+
+	// the list gets persisted
+	consents = consentStore{path: consents.path}
+	assert.True(t, consents.isWithdrawn("rpaw053"))
+
+	// further updates get suppressed
+	taskRecordCount = 0
+	output, err = (&Event{Type: hubUserUpdated, EPPN: "rpaw053@auckland.ac.nz", ORCID: "0000-0003-1255-9023"}).handle()
+	assert.Nil(t, err)
+	assert.Empty(t, output)
+	_, err = (&Event{Subject: 208013283}).handle()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, taskRecordCount)
+
+	// re-linking the ORCID account restores the updates
+	output, err = (&Event{Type: hubUserCreated, EPPN: "rpaw053@auckland.ac.nz", ORCID: "0000-0003-1255-9023"}).handle()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, output)
+	assert.False(t, consents.isWithdrawn("rpaw053"))
+	assert.NotZero(t, taskRecordCount)
+
+	_, err = (&Event{Type: hubUserDeleted, EPPN: "rad42@auckland.ac.nz"}).handle()
+	assert.NotNil(t, err)
+
+	_, err = (&Event{Type: hubUserDeleted, EPPN: "rad42xyz@auckland.ac.nz"}).handle()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid UPI")
+}
+
+func TestAuthenticator(t *testing.T) {
+	var (
+		now  = time.Now()
+		body = `{"subject": "484378182"}`
+		ok   = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { rw.WriteHeader(http.StatusNoContent) })
+	)
+	serve := func(a *authenticator, req *http.Request) int {
+		rw := httptest.NewRecorder()
+		a.wrap(ok).ServeHTTP(rw, req)
+		return rw.Code
+	}
+	newRequest := func(body string, headers ...string) *http.Request {
+		req := httptest.NewRequest("POST", "/handle", strings.NewReader(body))
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		return req
+	}
+
+	a := &authenticator{seen: make(map[string]time.Time), now: time.Now}
+	assert.False(t, a.isEnabled())
+	assert.Equal(t, http.StatusNoContent, serve(a, newRequest(body)))
+
+	// API key
+	a = &authenticator{apiKey: "SECRET-KEY", apiKeyHeader: defaultAPIKeyHeader}
+	assert.Equal(t, http.StatusUnauthorized, serve(a, newRequest(body)))
+	assert.Equal(t, http.StatusForbidden, serve(a, newRequest(body, "apikey", "WRONG-KEY")))
+	assert.Equal(t, http.StatusNoContent, serve(a, newRequest(body, "apikey", "SECRET-KEY")))
+
+	// HMAC signature
+	a = &authenticator{
+		secret:    []byte("WEBHOOK-SECRET"),
+		tolerance: defaultSignatureTolerance * time.Second,
+		seen:      make(map[string]time.Time),
+		now:       func() time.Time { return now },
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	signature := a.sign(ts, []byte(body))
+	assert.Equal(t, http.StatusUnauthorized, serve(a, newRequest(body)))
+	assert.Equal(t, http.StatusForbidden, serve(a, newRequest(body, signatureHeader, signature, signatureTimestampHeader, "ABC")))
+	assert.Equal(t, http.StatusForbidden, serve(a, newRequest(`{"subject": "208013283"}`, signatureHeader, signature, signatureTimestampHeader, ts)))
+	assert.Equal(t, http.StatusNoContent, serve(a, newRequest(body, signatureHeader, "sha256="+signature, signatureTimestampHeader, ts)))
+	// replay
+	assert.Equal(t, http.StatusForbidden, serve(a, newRequest(body, signatureHeader, signature, signatureTimestampHeader, ts)))
+	// stale
+	ts = strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)
+	assert.Equal(t, http.StatusForbidden, serve(a, newRequest(body, signatureHeader, a.sign(ts, []byte(body)), signatureTimestampHeader, ts)))
+	// expired signatures get evicted
+	a.now = func() time.Time { return now.Add(time.Hour) }
+	ts = strconv.FormatInt(now.Add(time.Hour).Unix(), 10)
+	assert.Equal(t, http.StatusNoContent, serve(a, newRequest(body, signatureHeader, a.sign(ts, []byte(body)), signatureTimestampHeader, ts)))
+	assert.Len(t, a.seen, 1)
+
+	// client certificates
+	a = &authenticator{requireClientCert: true, allowedClients: map[string]bool{"kafka-connect": true, "orcidhub.org.nz": true}}
+	withCert := func(req *http.Request, cn string, dnsNames ...string) *http.Request {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}, DNSNames: dnsNames}
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return req
+	}
+	assert.Equal(t, http.StatusUnauthorized, serve(a, newRequest(body)))
+	assert.Equal(t, http.StatusForbidden, serve(a, withCert(newRequest(body), "intruder")))
+	assert.Equal(t, http.StatusNoContent, serve(a, withCert(newRequest(body), "kafka-connect")))
+	assert.Equal(t, http.StatusNoContent, serve(a, withCert(newRequest(body), "ORCID Hub", "orcidhub.org.nz")))
+
+	// all the methods
+	a.apiKey, a.apiKeyHeader = "SECRET-KEY", defaultAPIKeyHeader
+	assert.Equal(t, http.StatusUnauthorized, serve(a, withCert(newRequest(body), "kafka-connect")))
+	assert.Equal(t, http.StatusNoContent, serve(a, withCert(newRequest(body, "apikey", "SECRET-KEY"), "kafka-connect")))
+
+	// request body size limit (with and without the authentication)
+	for _, a := range []*authenticator{{maxBodySize: 32}, {maxBodySize: 32, apiKey: "SECRET-KEY", apiKeyHeader: defaultAPIKeyHeader}} {
+		assert.Equal(t, http.StatusNoContent, serve(a, newRequest(body, "apikey", "SECRET-KEY")))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, serve(a, newRequest(strings.Repeat(" ", 32)+body, "apikey", "SECRET-KEY")))
+		// the body size is not known in advance
+		req := newRequest("", "apikey", "SECRET-KEY")
+		req.Body, req.ContentLength = ioutil.NopCloser(strings.NewReader(strings.Repeat(" ", 32)+body)), -1
+		assert.Equal(t, http.StatusRequestEntityTooLarge, serve(a, req))
+	}
+
+	defer func(c Config) { config = c }(config)
+	os.Setenv("WEBHOOK_APIKEY", "SECRET-KEY")
+	os.Setenv("TLS_CLIENT_ALLOW", "kafka-connect, orcidhub.org.nz")
+	os.Setenv("TLS_CERT_FILE", "server.crt")
+	os.Setenv("TLS_KEY_FILE", "server.key")
+	for _, key := range []string{"WEBHOOK_APIKEY", "TLS_CLIENT_ALLOW", "TLS_CERT_FILE", "TLS_KEY_FILE"} {
+		defer os.Unsetenv(key)
+	}
+	require.Nil(t, setConfig(""))
+	a = newAuthenticator()
+	assert.True(t, a.isEnabled())
+	assert.Equal(t, defaultAPIKeyHeader, a.apiKeyHeader)
+	assert.Equal(t, map[string]bool{"kafka-connect": true, "orcidhub.org.nz": true}, a.allowedClients)
+	assert.EqualValues(t, defaultMaxBodySize, a.maxBodySize)
+}
+
+func TestRouter(t *testing.T) {
+	router := newRouter(&authenticator{apiKey: "SECRET-KEY", apiKeyHeader: defaultAPIKeyHeader}, nil, nil)
+
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.True(t, isValidUUID(rw.Header().Get(requestIDHeader)))
+
+	// the caller request ID
+	req := httptest.NewRequest("GET", "/healthz", nil)
+	req.Header.Set(requestIDHeader, "REQUEST-123")
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, req)
+	assert.Equal(t, "REQUEST-123", rw.Header().Get(requestIDHeader))
+
+	// the event handling requires authentication
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest("POST", "/handle", strings.NewReader(`{"type": "PING"}`)))
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	req = httptest.NewRequest("POST", "/handle", strings.NewReader(`{"type": "ABC"`))
+	req.Header.Set("apikey", "SECRET-KEY")
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rw.Code)
+
+	req = httptest.NewRequest("POST", "/handle", strings.NewReader(`{"type": "ABC"}`))
+	req.Header.Set("apikey", "SECRET-KEY")
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Contains(t, rw.Body.String(), "unhandled event")
+}
+
+func testReadiness(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	malformatResponse = false
+	withAnIncomleteTask = true
+	taskID = 0
+	setup(dryRun)
+	lastReadiness.checks = nil
+
+	router := newRouter(&authenticator{}, nil, nil)
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.JSONEq(t, `{"status": "ok", "checks": {"hub": "ok", "api": "ok", "task": "ok"}}`, rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest("POST", "/handle", strings.NewReader(`{"type": "PING"}`)))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.JSONEq(t, `{"message": "GNIP"}`, rw.Body.String())
+
+	defer func(url string) { apiHealthCheckURL = url }(apiHealthCheckURL)
+	apiHealthCheckURL = "NOT-FOUND"
+	taskID = 0
+	// the result is cached for a few seconds
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	lastReadiness.checkedAt = time.Now().Add(-readinessTTL - time.Second)
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	checks, ready := readiness()
+	assert.False(t, ready)
+	assert.Equal(t, "ok", checks["hub"])
+	assert.Contains(t, checks["api"], "404")
+	assert.Contains(t, checks["task"], "not initialised")
+
+	// no task is created in the dry-run mode
+	defer func(d bool) { dryRun = d }(dryRun)
+	dryRun = true
+	apiHealthCheckURL = "external-organisations/v1/qualifications"
+	checks, ready = readiness()
+	assert.True(t, ready, checks)
+	assert.Contains(t, checks["task"], "dry run")
+	lastReadiness.checks = nil
+}
+
+func testEventQueue(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "queue")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	malformatResponse = false
+	withAnIncomleteTask = true
+
+	q, err := newEventQueue(dir, 2)
+	require.Nil(t, err)
+	router := newRouter(&authenticator{}, q, nil)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, httptest.NewRequest("POST", "/handle", strings.NewReader(body)))
+		return rw
+	}
+	status := func(id string) (qe QueuedEvent) {
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, httptest.NewRequest("GET", "/events/"+id, nil))
+		require.Equal(t, http.StatusOK, rw.Code)
+		require.Nil(t, json.Unmarshal(rw.Body.Bytes(), &qe))
+		return
+	}
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, post(`{"type": `).Code)
+	assert.Equal(t, http.StatusBadRequest, post(`{"type": "ABC"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, post(`[{"unknown": 123}]`).Code)
+	// the SNS messages get verified before they are queued
+	assert.Equal(t, http.StatusBadRequest, post(`{"Type": "Notification", "MessageId": "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf327",
+		"TopicArn": "arn:aws:sns:ap-southeast-2:123456789012:orcidhub", "Message": "{\"subject\": \"484378182\"}"}`).Code)
+
+	var accepted struct{ ID, Status string }
+	rw := post(`{"type": "PING"}`)
+	require.Equal(t, http.StatusAccepted, rw.Code)
+	require.Nil(t, json.Unmarshal(rw.Body.Bytes(), &accepted))
+	assert.True(t, isValidUUID(accepted.ID))
+	assert.Equal(t, eventQueued, accepted.Status)
+	assert.Equal(t, "/events/"+accepted.ID, rw.Header().Get("Location"))
+	first := accepted.ID
+
+	rw = post(`[{"subject": "484378182"}, {"topic": "nz-ac-auckland-student", "value": {"studentId": "208013283"}}]`)
+	require.Equal(t, http.StatusAccepted, rw.Code)
+	require.Nil(t, json.Unmarshal(rw.Body.Bytes(), &accepted))
+	second := accepted.ID
+	qe := status(second)
+	assert.Equal(t, eventQueued, qe.Status)
+	assert.Empty(t, qe.Events, "the events should not be exposed")
+	qe, _ = q.get(second)
+	require.Len(t, qe.Events, 2)
+	assert.Equal(t, studentTopic, qe.Events[1].Source)
+
+	// the queue is full
+	assert.Equal(t, http.StatusServiceUnavailable, post(`{"type": "PING"}`).Code)
+
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest("GET", "/events/UNKNOWN", nil))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+
+	// the queued events survive the restart
+	q, err = newEventQueue(dir, 10)
+	require.Nil(t, err)
+	assert.Equal(t, 2, len(q.pending))
+	router = newRouter(&authenticator{}, q, nil)
+
+	q.start(1)
+	for i := 0; i < 100 && (status(first).Status != eventDone || status(second).Status != eventDone); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	q.stop()
+
+	qe = status(first)
+	assert.Equal(t, eventDone, qe.Status)
+	assert.Equal(t, 1, qe.Attempts)
+	assert.Empty(t, qe.Message, "the message should not be exposed")
+	qe, _ = q.get(first)
+	assert.Equal(t, "GNIP", qe.Message)
+	qe = status(second)
+	assert.Equal(t, eventDone, qe.Status, qe.Error)
+
+	// purging of the processed events
+	q.retention = 0
+	q.purge()
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest("GET", "/events/"+first, nil))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+	// the failed events get retried with the back-off
+	assert.Equal(t, time.Minute, q.backoff(1))
+	assert.Equal(t, 4*time.Minute, q.backoff(3))
+	assert.Equal(t, maxQueueRetryDelay, q.backoff(100))
+	q = &eventQueue{dir: dir, retention: defaultQueueRetention, maxAttempts: 3, retryDelay: time.Millisecond,
+		entries: make(map[string]*QueuedEvent), pending: make(chan string, 10), quit: make(chan struct{})}
+	router = newRouter(&authenticator{}, q, nil)
+	rw = post(`{"subject": "1233"}`)
+	require.Equal(t, http.StatusAccepted, rw.Code)
+	require.Nil(t, json.Unmarshal(rw.Body.Bytes(), &accepted))
+	failed := accepted.ID
+	q.start(1)
+	for i := 0; i < 200 && status(failed).Status != eventFailed; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	q.stop()
+	qe = status(failed)
+	assert.Equal(t, eventFailed, qe.Status)
+	assert.Equal(t, 3, qe.Attempts)
+	assert.Contains(t, qe.Error, "failed to retrieve the identity record")
+
+	q.retention = 0
+	q.purge()
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest("GET", "/events/"+failed, nil))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Empty(t, files)
+}
+
+func testAdminAPI(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	malformatResponse = false
+	withAnIncomleteTask = true
+	taskID = 0
+
+	router := newRouter(&authenticator{}, nil, &authenticator{apiKey: "ADMIN-KEY", apiKeyHeader: defaultAdminAPIKeyHeader})
+	call := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set(defaultAdminAPIKeyHeader, "ADMIN-KEY")
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest("GET", "/admin/users/rcir178", nil))
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	rw = call("GET", "/admin/users/rcir178", "")
+	require.Equal(t, http.StatusOK, rw.Code)
+	var report userReport
+	require.Nil(t, json.Unmarshal(rw.Body.Bytes(), &report))
+	assert.Equal(t, "rcir178", report.Identity.Upi)
+	require.NotNil(t, report.Token)
+	assert.Equal(t, "0000-0001-8228-7153", report.Token.ORCID)
+	assert.Contains(t, report.Token.Scopes, "/activities/update")
+	assert.NotEmpty(t, report.Records)
+	assert.Equal(t, "0000-0001-8228-7153", report.Records[0].Orcid)
+	assert.NotContains(t, rw.Body.String(), "ecf16b31-ad54-4ba2-ae55-e97fb90e211a", "the access token should not be exposed")
+
+	assert.Equal(t, http.StatusBadRequest, call("GET", "/admin/users/ABC", "").Code)
+	assert.Equal(t, http.StatusNotFound, call("GET", "/admin/users/66666666", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, call("DELETE", "/admin/users/rcir178", "").Code)
+
+	rw = call("POST", "/admin/users/rcir178/resync", "")
+	assert.Equal(t, http.StatusOK, rw.Code, rw.Body.String())
+
+	rw = call("GET", "/admin/task", "")
+	require.Equal(t, http.StatusOK, rw.Code)
+	var task taskReport
+	require.Nil(t, json.Unmarshal(rw.Body.Bytes(), &task))
+	assert.NotZero(t, task.ID)
+	assert.NotZero(t, task.RecordCount)
+
+	for _, action := range []string{"activate", "rotate"} {
+		rw = call("POST", "/admin/task/"+action, "")
+		require.Equal(t, http.StatusOK, rw.Code)
+		require.Nil(t, json.Unmarshal(rw.Body.Bytes(), &task))
+		assert.Equal(t, 999, task.ID)
+		assert.Zero(t, task.RecordCount)
+	}
+	assert.Equal(t, http.StatusMethodNotAllowed, call("GET", "/admin/task/activate", "").Code)
+
+	// nothing gets written in the dry-run mode
+	dryRun = true
+	mockRequestsMutex.Lock()
+	hubWrites = nil
+	mockRequestsMutex.Unlock()
+	for _, action := range []string{"activate", "rotate"} {
+		rw = call("POST", "/admin/task/"+action, "")
+		require.Equal(t, http.StatusOK, rw.Code)
+		assert.Contains(t, rw.Body.String(), `"dry-run":true`)
+		assert.Contains(t, rw.Body.String(), `"action":"`+action+`"`)
+		assert.Equal(t, 999, taskID)
+	}
+	mockRequestsMutex.Lock()
+	assert.Empty(t, hubWrites)
+	mockRequestsMutex.Unlock()
+	dryRun = false
+
+	// the ORCID Hub is not reachable
+	url := oh.baseURL
+	oh.baseURL = "http://127.0.0.1:1"
+	for _, action := range []string{"rotate", "activate"} {
+		rw = call("POST", "/admin/task/"+action, "")
+		assert.Equal(t, http.StatusBadGateway, rw.Code, rw.Body.String())
+		assert.Contains(t, rw.Body.String(), "failed to create a new affiliation task")
+	}
+	assert.Zero(t, taskID)
+	oh.baseURL = url
+
+	// the ORCID Hub fails to create the task
+	failHubWrites = true
+	for _, action := range []string{"rotate", "activate"} {
+		rw = call("POST", "/admin/task/"+action, "")
+		assert.Equal(t, http.StatusBadGateway, rw.Code, rw.Body.String())
+		assert.Contains(t, rw.Body.String(), "500")
+	}
+	failHubWrites = false
+	assert.Zero(t, taskID)
+
+	defer loggingLevel.SetLevel(loggingLevel.Level())
+	rw = call("PUT", "/admin/loglevel", `{"level": "debug"}`)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, zap.DebugLevel, loggingLevel.Level())
+	rw = call("GET", "/admin/loglevel", "")
+	assert.JSONEq(t, `{"level": "debug"}`, rw.Body.String())
+
+	rw = call("GET", "/admin/degree-codes", "")
+	require.Equal(t, http.StatusOK, rw.Code)
+	var info DegreeCodesInfo
+	require.Nil(t, json.Unmarshal(rw.Body.Bytes(), &info))
+	assert.Equal(t, "embedded", info.Source)
+	assert.NotZero(t, info.Count)
+	assert.Equal(t, http.StatusOK, call("POST", "/admin/degree-codes/reload", "").Code)
+}
+
+func testDryRun(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	defer func() { consents = consentStore{} }()
+	consents = consentStore{}
+	taskID = 0
+	withAnIncomleteTask = true
+	malformatResponse = false
+	setup(dryRun)
+	identifierRequests = nil
+	count := taskRecordCount
+
+	// per-event dry-run makes no changes on the Hub (not even the task set-up)
+	taskID = 0
+	mockRequestsMutex.Lock()
+	hubWrites = nil
+	mockRequestsMutex.Unlock()
+	output, err := (&Event{Subject: 208013283, Type: resyncEventType, DryRun: true}).handle()
+	require.Nil(t, err)
+	assert.Zero(t, taskID)
+	mockRequestsMutex.Lock()
+	assert.Empty(t, hubWrites)
+	mockRequestsMutex.Unlock()
+	setup(dryRun)
+	var dr DryRun
+	require.Nil(t, json.Unmarshal([]byte(output), &dr))
+	assert.Len(t, dr.Records, 5)
+	for _, r := range dr.Records {
+		assert.Equal(t, "0000-0003-1255-9023", r.Orcid)
+	}
+	// the ORCID iD of the token differs from the one in the identity record
+	require.Len(t, dr.IdentityUpdates, 1)
+	assert.Equal(t, "PUT", dr.IdentityUpdates[0].Method)
+	assert.Equal(t, count, taskRecordCount, "no records should be added to the task")
+
+	// batch inherits the dry-run
+	output, err = (&Event{Batch: []Event{{Subject: 208013283, Source: studentTopic}, {Subject: 484378182}}, DryRun: true}).handle()
+	require.Nil(t, err)
+	assert.Contains(t, output, `"affiliation-type":"education"`)
+	assert.Equal(t, count, taskRecordCount)
+
+	// global dry-run
+	dryRun = true
+	defer func() { dryRun = false }()
+	output, err = (&Event{Type: hubTokenRevoked, EPPN: "rpaw053@auckland.ac.nz", ORCID: "0000-0002-9398-4322"}).handle()
+	require.Nil(t, err)
+	dr = DryRun{}
+	require.Nil(t, json.Unmarshal([]byte(output), &dr))
+	assert.Equal(t, "withdrawn", dr.Consent)
+	require.Len(t, dr.IdentityUpdates, 1)
+	assert.Equal(t, "DELETE", dr.IdentityUpdates[0].Method)
+	assert.Equal(t, "identity/integrations/v3/identity/208013283/identifier/ORCID", dr.IdentityUpdates[0].Path)
+	assert.False(t, consents.isWithdrawn("rpaw053"))
+
+	output, err = (&Event{Type: hubUserCreated, EPPN: "rpaw053@auckland.ac.nz", ORCID: "0000-0003-1255-9023"}).handle()
+	require.Nil(t, err)
+	dr = DryRun{}
+	require.Nil(t, json.Unmarshal([]byte(output), &dr))
+	assert.Equal(t, "restored", dr.Consent)
+	assert.Len(t, dr.Records, 5)
+	require.Len(t, dr.IdentityUpdates, 1)
+	assert.Equal(t, "PUT", dr.IdentityUpdates[0].Method)
+	assert.Contains(t, dr.IdentityUpdates[0].Identifier, "0000-0003-1255-9023")
+
+	assert.Empty(t, identifierRequests)
+	assert.Equal(t, count, taskRecordCount)
+}
+
+func testBackfill(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	taskID = 0
+	withAnIncomleteTask = true
+	malformatResponse = false
+
+	// NB! dthn666 has granted only the read access and dthn777 has no tokens
+	users, err := hubUsers()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"rpaw053", "rcir178"}, users)
+
+	users, err = readUserList(strings.NewReader("UPI,name\nrpaw053,Roshan\n# comment\n\n484378182\nABC\ndthn777\n"))
+	require.Nil(t, err)
+	assert.Equal(t, []string{"rpaw053", "484378182", "dthn777"}, users)
+
+	dir, err := ioutil.TempDir("", "backfill")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "checkpoint.txt")
+
+	cp, err := openCheckpoint(fn)
+	require.Nil(t, err)
+	setup(dryRun)
+	count := taskRecordCount
+	summary := backfill(users, 2, cp, false, time.Minute)
+	cp.close()
+	assert.Equal(t, 3, summary.Total)
+	assert.Equal(t, 2, summary.Processed)
+	assert.Equal(t, 1, summary.Failed)
+	assert.Contains(t, summary.Failures, userPseudonym("dthn777"))
+	assert.True(t, taskRecordCount > count)
+
+	data, err := ioutil.ReadFile(fn)
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{"rpaw053", "484378182"}, strings.Fields(string(data)))
+
+	// resume: only the failed user gets processed
+	cp, err = openCheckpoint(fn)
+	require.Nil(t, err)
+	defer cp.close()
+	summary = backfill(users, 1, cp, true, time.Minute)
+	assert.Equal(t, 2, summary.Skipped)
+	assert.Equal(t, 1, summary.Failed)
+	assert.Zero(t, summary.Processed)
+}
+
+func testReconcile(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	malformatResponse = false
+	setup(dryRun)
+
+	diffs, err := reconcileUser("rpaw053")
+	require.Nil(t, err)
+	statuses := make(map[string][]string)
+	for _, d := range diffs {
+		assert.Equal(t, "0000-0003-1255-9023", d.ORCID)
+		statuses[d.Status] = append(statuses[d.Status], d.AffiliationType+":"+d.Role)
+	}
+	assert.Equal(t, []string{"employment:Developer"}, statuses[affiliationStale])
+	assert.Equal(t, []string{"employment:Lecturer"}, statuses[affiliationExtra])
+	assert.Equal(t, []string{"education:MEngSt-NOT-EXISTING", "education:Diploma in Business"}, statuses[affiliationMissing])
+	for _, d := range diffs {
+		if d.Status == affiliationStale {
+			assert.Equal(t, 1002, d.PutCode)
+			assert.Equal(t, []string{`end-date: "2019-10-31" != "2019-11-15"`}, d.Differences)
+		}
+	}
+
+	var buf bytes.Buffer
+	require.Nil(t, writeDiffs(&buf, "csv", diffs))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.Nil(t, err)
+	assert.Len(t, rows, len(diffs)+1)
+	assert.Equal(t, "status", rows[0][2])
+
+	buf.Reset()
+	require.Nil(t, writeDiffs(&buf, "json", nil))
+	assert.JSONEq(t, "[]", buf.String())
+	assert.NotNil(t, writeDiffs(&buf, "xml", diffs))
+
+	_, err = reconcileUser("dthn666")
+	assert.NotNil(t, err)
+}
+
+func TestReadEvents(t *testing.T) {
+	for _, tc := range []struct {
+		name, input string
+		subjects    []int
+	}{
+		{"single", `{"subject": "208013283", "type": "RESYNC"}`, []int{208013283}},
+		{"stream", `{"subject": "208013283"}
+			{"subject": "484378182"}`, []int{208013283, 484378182}},
+		{"SQS", `{"Records": [{"messageId": "1", "body": "{\"subject\": \"484378182\"}"}]}`, []int{0}},
+		{"CloudWatch export", `{"timestamp": 1581288600000, "message": "{\"subject\": \"484378182\"}"}
+{"timestamp": 1581288600001, "message": "2020-02-10T00:50:00.000Z\tINFO\t{\"subject\": \"208013283\"}"}`, []int{484378182, 208013283}},
+		{"CloudWatch lines", `2020-02-10T00:50:00.000Z	a0b1c2	{"subject": "484378182"}
+
+2020-02-10T00:50:01.000Z	a0b1c3	{"subject": "208013283", "type": "RESYNC"}`, []int{484378182, 208013283}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			events, err := readEvents(strings.NewReader(tc.input))
+			require.Nil(t, err)
+			require.Len(t, events, len(tc.subjects))
+			for i, e := range events {
+				assert.Equal(t, tc.subjects[i], e.Subject)
+			}
+		})
+	}
+
+	events, err := readEvents(strings.NewReader(`{"Records": [{"messageId": "1", "body": "{\"subject\": \"484378182\"}"}]}`))
+	require.Nil(t, err)
+	assert.Len(t, events[0].messages(), 1)
+
+	_, err = readEvents(strings.NewReader("2020-02-10T00:50:00.000Z INFO {\"subject\": \"ABC\"}"))
+	assert.NotNil(t, err)
+}
+
+func testReplay(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	taskID = 0
+	withAnIncomleteTask = true
+	malformatResponse = false
+	setup(dryRun)
+	count := taskRecordCount
+
+	events, err := readEvents(strings.NewReader(`{"subject": "208013283", "type": "RESYNC"}
+		[{"subject": "484378182"}, {"subject": "208013283", "source": "nz-ac-auckland-student"}]
+		{"type": "UNKNOWN"}`))
+	require.Nil(t, err)
+	results := replay("test.jsonl", events, true)
+	require.Len(t, results, 3)
+	assert.Equal(t, "test.jsonl", results[0].Source)
+	assert.Equal(t, 1, results[0].Index)
+	assert.Empty(t, results[0].Error)
+	assert.Contains(t, results[0].Message, `"records":[{`)
+	assert.Empty(t, results[1].Error)
+	assert.Contains(t, results[1].Message, `"affiliation-type":"education"`)
+	assert.NotEmpty(t, results[2].Error)
+	assert.Equal(t, count, taskRecordCount, "nothing should be written in the dry-run mode")
+}
+
+func TestDegreeCodeMapping(t *testing.T) {
+	m := newDegreeCodeMapping()
+	info := m.info()
+	assert.Equal(t, "embedded", info.Source)
+	assert.NotEmpty(t, info.Version)
+	assert.True(t, info.Count > 300)
+
+	name, ok := m.lookup("phd")
+	assert.True(t, ok)
+	assert.Equal(t, "Doctor of Philosophy", name)
+	count := metricValue(degreeMappings, "unmapped")
+	_, ok = m.lookup("MEngSt-NOT-EXISTING")
+	assert.False(t, ok)
+	m.lookup("MEngSt-NOT-EXISTING")
+	assert.Equal(t, map[string]int{"MENGST-NOT-EXISTING": 2}, m.info().Unmapped)
+	assert.Equal(t, count+2, metricValue(degreeMappings, "unmapped"))
+
+	for _, data := range []string{
+		`{"version": "1", "codes": {}}`,
+		`{"codes": {"PHD": "Doctor of Philosophy"}}`,
+		`{"version": "1", "codes": {"phd": "Doctor of Philosophy"}}`,
+		`{"version": "1", "codes": {"PHD": " "}}`,
+		`{"version": "1", "codes": {"PH D": "Doctor of Philosophy"}}`,
+		`{"version": "1", "codes": {"PHD": "Doctor of Philosophy"}, "maori": {"MSC": "Tohu Paerua Pūtaiao"}}`,
+		`[]`,
+	} {
+		assert.NotNil(t, m.load([]byte(data)), data)
+	}
+	assert.Equal(t, info.Version, m.info().Version, "invalid mapping should not get loaded")
+
+	dir, err := ioutil.TempDir("", "degree-codes")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	m.source = filepath.Join(dir, "degree_codes.json")
+
+	_, err = m.reload()
+	assert.NotNil(t, err)
+
+	require.Nil(t, ioutil.WriteFile(m.source, []byte(`{"version": "2", "codes": {"MENGST": "Master of Engineering Studies"}}`), 0600))
+	changed, err := m.reload()
+	require.Nil(t, err)
+	assert.True(t, changed)
+	info = m.info()
+	assert.Equal(t, "2", info.Version)
+	assert.Equal(t, 1, info.Count)
+	name, ok = m.lookup("MEngSt")
+	assert.True(t, ok)
+	assert.Equal(t, "Master of Engineering Studies", name)
+
+	changed, err = m.reload()
+	require.Nil(t, err)
+	assert.False(t, changed)
+
+	// the last valid mapping is kept
+	require.Nil(t, ioutil.WriteFile(m.source, []byte(`{"version": "3", "codes": {"": "?"}}`), 0600))
+	_, err = m.reload()
+	assert.NotNil(t, err)
+	assert.Equal(t, "2", m.info().Version)
+
+	// HTTP(S) source
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, `{"version": "4", "codes": {"PHD": "Doctor of Philosophy"}}`)
+	}))
+	defer server.Close()
+	m.source = server.URL + "/degree_codes.json"
+	changed, err = m.reload()
+	require.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "4", m.info().Version)
+
+	m.source = "s3://bucket-only"
+	_, err = m.reload()
+	assert.NotNil(t, err)
+}
+
+func TestCache(t *testing.T) {
+	var (
+		calls   int32
+		fail    int32
+		release = make(chan struct{})
+		now     = time.Now()
+	)
+	c := newCache(time.Minute, func(key string) (interface{}, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if key == "slow" {
+			<-release
+		}
+		if atomic.LoadInt32(&fail) != 0 {
+			return nil, fmt.Errorf("failed to load %q", key)
+		}
+		return map[string]string{"key": key, "call": strconv.Itoa(int(n))}, nil
+	})
+	c.now = func() time.Time { return now }
+
+	v, err := c.get("A")
+	require.Nil(t, err)
+	assert.Equal(t, "1", v.(map[string]string)["call"])
+	v, _ = c.get("A")
+	assert.Equal(t, "1", v.(map[string]string)["call"], "the value should be cached")
+
+	// expired
+	now = now.Add(2 * time.Minute)
+	v, _ = c.get("A")
+	assert.Equal(t, "2", v.(map[string]string)["call"])
+
+	// the concurrent look-ups share the load
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.get("slow")
+			assert.Nil(t, err)
+			assert.Equal(t, "slow", v.(map[string]string)["key"])
+		}()
+	}
+	for {
+		c.Lock()
+		n := len(c.calls)
+		c.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// last-known-good value
+	atomic.StoreInt32(&fail, 1)
+	now = now.Add(2 * time.Minute)
+	v, err = c.get("A")
+	require.Nil(t, err)
+	assert.Equal(t, "2", v.(map[string]string)["call"])
+	_, err = c.get("B")
+	assert.NotNil(t, err)
+	// the failed load gets retried only after the retry interval
+	n := atomic.LoadInt32(&calls)
+	_, err = c.get("A")
+	require.Nil(t, err)
+	assert.Equal(t, n, atomic.LoadInt32(&calls))
+	now = now.Add(time.Minute)
+	_, err = c.get("A")
+	require.Nil(t, err)
+	assert.Equal(t, n+1, atomic.LoadInt32(&calls))
+
+	// persisted last-known-good value
+	dir, err := ioutil.TempDir("", "cache")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	decoder := func(data []byte) (interface{}, error) {
+		var m map[string]string
+		err := json.Unmarshal(data, &m)
+		return m, err
+	}
+	atomic.StoreInt32(&fail, 0)
+	c.persist(dir, decoder)
+	c.refresh()
+	v, _ = c.get("A")
+	call := v.(map[string]string)["call"]
+
+	atomic.StoreInt32(&fail, 1)
+	restarted := newCache(time.Minute, c.loader).persist(dir, decoder)
+	v, err = restarted.get("A")
+	require.Nil(t, err)
+	assert.Equal(t, call, v.(map[string]string)["call"])
+	_, err = restarted.get("C")
+	assert.NotNil(t, err)
+}
+
+func testBatchIdentityCache(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	taskID = 0
+	withAnIncomleteTask = true
+	malformatResponse = false
+
+	identities := newCache(0, loadIdentity)
+	var calls int32
+	loader := identities.loader
+	identities.loader = func(key string) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return loader(key)
+	}
+	e := Event{
+		Batch: []Event{
+			{Subject: 208013283, Source: studentTopic},
+			{Subject: 208013283, Source: employmentTopic},
+			{Subject: 208013283},
+			{Subject: 484378182},
+		},
+		DryRun:     true,
+		identities: identities,
+	}
+	_, err := e.handle()
+	require.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	name, ok := qualificationName("MED-DG")
+	assert.True(t, ok)
+	assert.Equal(t, "Master of Education", name)
+}
+
+func testBatchErrors(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	taskID = 0
+	withAnIncomleteTask = true
+	malformatResponse = false
+
+	// all the messages succeeded
+	output, err := (&Event{Batch: []Event{{Subject: 208013283}, {Type: "PING", Subject: 484378182}}}).handle()
+	assert.Nil(t, err)
+	assert.Contains(t, output, "; ")
+
+	// only the failed messages get reported and the rest get processed
+	taskRecordCount = 0
+	output, err = (&Event{Records: []events.SQSMessage{
+		{Body: `{"subject":"208013283"}`},
+		{Body: `{"type":"DELETED","eppn":"rad42xyz@auckland.ac.nz"}`},
+	}}).handle()
+	require.NotNil(t, err)
+	require.IsType(t, errorList{}, err)
+	assert.Len(t, err.(errorList), 1)
+	assert.Contains(t, err.Error(), "invalid UPI")
+	assert.Contains(t, output, "; ")
+	assert.NotZero(t, taskRecordCount)
+
+	// empty batch
+	output, err = (&Event{Records: []events.SQSMessage{}}).handle()
+	assert.Nil(t, err)
+	assert.Empty(t, output)
+}
+
+func TestDegreeTitle(t *testing.T) {
+	setupDegreeTitle()
+
+	for _, tc := range []struct {
+		title, name, honours string
+	}{
+		{"Master of Science", "Master of Science", ""},
+		{"Bachelor of Arts with Second Class Honours (First Division)", "Bachelor of Arts with Honours", "21"},
+		{"Bachelor of Arts with Honours", "Bachelor of Arts with Honours", "HON"},
+		{"Bachelor of Architecture with First Class Honours", "Bachelor of Architecture (Honours)", "H1"},
+		{"Bachelor of Architecture (Honours)", "Bachelor of Architecture (Honours)", "H"},
+		// the honours classes apply only to the honours degrees
+		{"Master of Science", "Master of Science", "H1"},
+		{"Bachelor of Science", "Bachelor of Science", "HON"},
+		{"Master of Business Administration with Distinction", "Master of Business Administration", "D"},
+		// unknown honours class codes are omitted
+		{"Master of Arts", "Master of Arts", "Gold Medal"},
+		{"Bachelor of Arts with Honours", "Bachelor of Arts with Honours", "H9"},
+	} {
+		dt := DegreeTitle{Name: tc.name}
+		if tc.honours != "" {
+			dt.Honours = honoursClass(tc.honours)
+		}
+		assert.Equal(t, tc.title, dt.title())
+	}
+
+	assert.Empty(t, honoursClass("XYZ"))
+	_, ok := unmappedHonoursClasses.Load("XYZ")
+	assert.True(t, ok)
+
+	d := Degree{Desc: "PhD", HonorsPrefix: " ", HonorsSuffix: " "}
+	assert.Equal(t, "Doctor of Philosophy", d.title())
+	d.HonorsSuffix = "h1"
+	assert.Equal(t, "Doctor of Philosophy", d.title())
+
+	defer func(maori bool, tmpl *template.Template) {
+		degreeTitleMaori, degreeTitleTemplate = maori, tmpl
+	}(degreeTitleMaori, degreeTitleTemplate)
+	degreeTitleMaori = true
+	d.HonorsSuffix = ""
+	assert.Equal(t, "Doctor of Philosophy (Tohu Kairangi)", d.title())
+	d.Desc = "MEngSt"
+	assert.Equal(t, "Master of Engineering Studies", d.title())
+
+	degreeTitleTemplate = template.Must(template.New("").Parse(`{{with .Maori}}{{.}} | {{end}}{{.Name}}{{with .Honours}}, {{.}}{{end}}`))
+	d.Desc, d.HonorsPrefix = "PHD", "D"
+	assert.Equal(t, "Tohu Kairangi | Doctor of Philosophy, Distinction", d.title())
+}
+
+func TestOrcidID(t *testing.T) {
+	for value, expected := range map[string]string{
+		"0000-0002-1825-0097":                        "0000-0002-1825-0097",
+		"0000000218250097":                           "0000-0002-1825-0097",
+		" 0000-0002-1694-233x ":                      "0000-0002-1694-233X",
+		"https://orcid.org/0000-0002-1825-0097":      "0000-0002-1825-0097",
+		"http://orcid.org/0000-0002-1825-0097/":      "0000-0002-1825-0097",
+		"orcid.org/0000-0002-1825-0097":              "0000-0002-1825-0097",
+		"https://sandbox.orcid.org/0000000218250097": "0000-0002-1825-0097",
+	} {
+		orcid, err := parseOrcidID(value)
+		assert.Nil(t, err, value)
+		assert.Equal(t, expected, orcid.String(), value)
+	}
+	for _, value := range []string{
+		"",
+		"0000-0002-1825-0098",
+		"0000-0002-1825-009",
+		"0000-0002-18250-097",
+		"0000-0002-1825-00977",
+		"0000-000X-1825-0097",
+		"1234-1234-1234-ABCD",
+		"https://example.com/0000-0002-1825-0097",
+		"ftp://orcid.org/0000-0002-1825-0097",
+	} {
+		assert.False(t, isValidOrcidID(value), value)
+	}
+
+	defer func(c Config) { config = c }(config)
+	require.Nil(t, setConfig(""))
+	assert.Equal(t, "https://orcid.org/0000-0002-1825-0097", OrcidID("0000-0002-1825-0097").URI())
+	config.ORCIDBaseURI = orcidSandboxURI
+	assert.Equal(t, "https://sandbox.orcid.org/0000-0002-1825-0097", OrcidID("0000-0002-1825-0097").URI())
+
+	// invalid ORCID iDs don't get written into the identity system
+	var dr DryRun
+	id := Identity{ID: 12345, Upi: "abcd123"}
+	(&Event{dryRun: &dr}).updateOrcid(id, "0000-0001-6666-7153", orcidFromWebhook)
+	assert.Empty(t, dr.IdentityUpdates)
+	(&Event{dryRun: &dr}).updateOrcid(id, "https://sandbox.orcid.org/0000-0001-6666-7156", orcidFromWebhook)
+	require.Len(t, dr.IdentityUpdates, 1)
+	assert.Equal(t, "https://sandbox.orcid.org/0000-0001-6666-7156", dr.IdentityUpdates[0].Identifier)
+
+	// the webhook events with invalid ORCID iDs get rejected
+	_, err := (&Event{Type: hubUserCreated, EPPN: "rpaw053@auckland.ac.nz", ORCID: "0000-0001-6666-7153"}).processHubEvent()
+	assert.NotNil(t, err)
+}
+
+func testOrcidConflicts(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	defer func(c Config) {
+		config = c
+		conflicts = conflictStore{}
+	}(config)
+	dir, err := ioutil.TempDir("", "conflicts")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	conflicts = conflictStore{path: filepath.Join(dir, "conflicts.json")}
+
+	malformatResponse = false
+	withAnIncomleteTask = true
+	taskID = 0
+	setup(dryRun)
+
+	// the ORCID iD of the token (0000-0003-1255-9023) differs from the one in the identity record
+	config.Conflicts.Policy = conflictReview
+	output, err := (&Event{Subject: 208013283, Type: resyncEventType, DryRun: true}).handle()
+	require.Nil(t, err)
+	var dr DryRun
+	require.Nil(t, json.Unmarshal([]byte(output), &dr))
+	assert.Empty(t, dr.IdentityUpdates)
+	require.Len(t, dr.Conflicts, 1)
+	assert.Equal(t, conflictPending, dr.Conflicts[0].Status)
+	assert.Empty(t, conflicts.list(), "dry-run should not add to the review queue")
+
+	id := Identity{ID: 208013283, Upi: "rpaw053"}
+	id.ExtIds = append(id.ExtIds, struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	}{"https://sandbox.orcid.org/0000-0002-9398-4322", "ORCID"})
+
+	identifierRequests = nil
+	(&Event{}).updateOrcid(id, "0000-0003-1255-9023", orcidFromToken)
+	(&Event{}).updateOrcid(id, "0000-0002-1825-0097", orcidFromWebhook)
+	assert.Empty(t, identifierRequests)
+	c, ok := conflicts.get("rpaw053")
+	require.True(t, ok)
+	assert.Equal(t, "0000-0002-9398-4322", c.IdentityORCID)
+	assert.Equal(t, "0000-0003-1255-9023", c.TokenORCID)
+	assert.Equal(t, "0000-0002-1825-0097", c.WebhookORCID)
+	assert.Equal(t, conflictPending, c.Status)
+
+	// the identity record has no ORCID iD, but the token and the webhook event disagree
+	dr = DryRun{}
+	config.Conflicts.Policy = conflictReview
+	noOrcid := Identity{ID: 208013283, Upi: "rpaw053", EmailAddress: "roshan.pawar@auckland.ac.nz"}
+	(&Event{dryRun: &dr}).updateOrcid(noOrcid, "0000-0002-1825-0097", orcidFromWebhook)
+	assert.Empty(t, dr.IdentityUpdates)
+	require.Len(t, dr.Conflicts, 1)
+	assert.Empty(t, dr.Conflicts[0].IdentityORCID)
+	assert.Equal(t, "0000-0003-1255-9023", dr.Conflicts[0].TokenORCID)
+	assert.Equal(t, "0000-0002-1825-0097", dr.Conflicts[0].WebhookORCID)
+	// ... or agree
+	dr = DryRun{}
+	(&Event{dryRun: &dr}).updateOrcid(noOrcid, "0000-0003-1255-9023", orcidFromWebhook)
+	assert.Empty(t, dr.Conflicts)
+	require.Len(t, dr.IdentityUpdates, 1)
+
+	// the queue gets persisted
+	conflicts = conflictStore{path: conflicts.path}
+	var buf bytes.Buffer
+	require.Nil(t, writeConflicts(&buf, "csv", conflicts.list()))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.Nil(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, []string{"rpaw053", "208013283", "0000-0002-9398-4322", "0000-0003-1255-9023", "0000-0002-1825-0097",
+		conflictReview, conflictPending}, rows[1][:7])
+
+	config.Conflicts.Policy = conflictKeep
+	(&Event{}).updateOrcid(id, "0000-0003-1255-9023", orcidFromToken)
+	assert.Empty(t, identifierRequests)
+	c, _ = conflicts.get("rpaw053")
+	assert.Equal(t, conflictKept, c.Status)
+
+	config.Conflicts.Policy = conflictOverwrite
+	(&Event{}).updateOrcid(id, "0000-0003-1255-9023", orcidFromToken)
+	assert.Equal(t, []string{"PUT /service/identity/integrations/v3/identity/208013283/identifier/ORCID"}, identifierRequests)
+	c, _ = conflicts.get("rpaw053")
+	assert.Equal(t, conflictOverwritten, c.Status)
+
+	// admin API
+	router := newRouter(&authenticator{}, nil, &authenticator{apiKey: "ADMIN-KEY", apiKeyHeader: defaultAdminAPIKeyHeader})
+	call := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set(defaultAdminAPIKeyHeader, "ADMIN-KEY")
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+		return rw
+	}
+	rw := call("GET", "/admin/conflicts", "")
+	require.Equal(t, http.StatusOK, rw.Code)
+	var list []OrcidConflict
+	require.Nil(t, json.Unmarshal(rw.Body.Bytes(), &list))
+	assert.Len(t, list, 1)
+	rw = call("GET", "/admin/conflicts?status=pending", "")
+	assert.Equal(t, "[]\n", rw.Body.String())
+	rw = call("GET", "/admin/conflicts?format=csv", "")
+	assert.Contains(t, rw.Body.String(), "rpaw053,208013283")
+
+	assert.Equal(t, http.StatusNotFound, call("DELETE", "/admin/conflicts/abcd123", "").Code)
+	assert.Equal(t, http.StatusBadRequest, call("POST", "/admin/conflicts/rpaw053/resolve", `{"orcid": "0000-0002-1825-0098"}`).Code)
+	identifierRequests = nil
+	dryRun = true
+	rw = call("POST", "/admin/conflicts/rpaw053/resolve", `{"orcid": "https://orcid.org/0000-0003-1255-9023"}`)
+	dryRun = false
+	require.Equal(t, http.StatusOK, rw.Code, rw.Body.String())
+	assert.Contains(t, rw.Body.String(), `"dry-run":true`)
+	assert.Empty(t, identifierRequests)
+	_, ok = conflicts.get("rpaw053")
+	assert.True(t, ok)
+	rw = call("POST", "/admin/conflicts/rpaw053/resolve", `{"orcid": "https://orcid.org/0000-0003-1255-9023"}`)
+	require.Equal(t, http.StatusOK, rw.Code, rw.Body.String())
+	assert.Len(t, identifierRequests, 1)
+	_, ok = conflicts.get("rpaw053")
+	assert.False(t, ok)
+
+	conflicts.add(OrcidConflict{Upi: "rpaw053", Status: conflictPending})
+	assert.Equal(t, http.StatusOK, call("DELETE", "/admin/conflicts/rpaw053", "").Code)
+	assert.Empty(t, conflicts.list())
+}
+
+func testPrivacyMode(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "privacy")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	var cfg Config
+	cfg.Privacy.Enabled = true
+	cfg.Privacy.Key = "0123456789ABCDEF"
+	cfg.Privacy.AuditLog = filepath.Join(dir, "audit.log")
+	require.Nil(t, setPrivacy(cfg))
+	defer setPrivacy(Config{})
+	defer func() { consents = consentStore{} }()
+	consents = consentStore{path: filepath.Join(dir, "consents.json")}
+
+	var buf bytes.Buffer
+	defer func(l *zap.SugaredLogger) { log = l }(log)
+	log = zap.New(zapcore.NewCore(zapcore.NewConsoleEncoder(loggerCfg.EncoderConfig),
+		zapcore.Lock(zapcore.AddSync(&buf)), zap.InfoLevel)).Sugar()
+
+	upi := pseudonym(piiUPI, "rpaw053")
+	assert.Regexp(t, `^upi:[0-9a-f]{16}$`, upi)
+	assert.Equal(t, upi, pseudonym(piiUPI, "rpaw053"))
+	assert.Equal(t, upi, userPseudonym("rpaw053"))
+	assert.NotEqual(t, upi, pseudonym(piiEPPN, "rpaw053"))
+	assert.Equal(t, "id:", idPseudonym(208013283)[:3])
+	assert.Empty(t, pseudonym(piiEmail, ""))
+	assert.Equal(t, "/admin/users/"+upi+"/resync", pathPseudonym("/admin/users/rpaw053/resync"))
+
+	taskID = 0
+	withAnIncomleteTask = true
+	malformatResponse = false
+	output, err := (&Event{Type: hubUserUpdated, EPPN: "rpaw053@auckland.ac.nz", ORCID: "0000-0002-9398-4322"}).handle()
+	assert.Nil(t, err)
+	assert.Contains(t, output, upi)
+	responses := output
+	output, err = (&Event{Type: hubTokenRevoked, EPPN: "rpaw053@auckland.ac.nz", ORCID: "0000-0002-9398-4322"}).handle()
+	assert.Nil(t, err)
+	assert.Contains(t, output, "the consent withdrawn (UPI: "+upi)
+	responses += output
+	_, err = (&Event{Subject: 208013283, Type: resyncEventType}).handle()
+	assert.Nil(t, err)
+	_, err = (&Event{EPPN: "rpaw053@auckland.ac.nz", Type: "UNKNOWN"}).handle()
+	require.NotNil(t, err)
+	responses += err.Error()
+
+	// the ORCID iD conflicts resolved or dismissed by the operators
+	router := newRouter(&authenticator{}, nil, &authenticator{apiKey: "ADMIN-KEY", apiKeyHeader: defaultAdminAPIKeyHeader})
+	call := func(method, url, body string) int {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set(defaultAdminAPIKeyHeader, "ADMIN-KEY")
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	conflicts.add(OrcidConflict{Upi: "rpaw053", Status: conflictPending})
+	assert.Equal(t, http.StatusOK, call("POST", "/admin/conflicts/rpaw053/resolve", `{"orcid": "0000-0002-9398-4322"}`))
+	conflicts.add(OrcidConflict{Upi: "rpaw053", Status: conflictPending})
+	assert.Equal(t, http.StatusOK, call("DELETE", "/admin/conflicts/rpaw053", ""))
+
+	// only the numbers of the changes get logged in the dry-run mode
+	_, err = (&Event{Subject: 208013283, Type: resyncEventType, DryRun: true}).handle()
+	assert.Nil(t, err)
+	assert.Regexp(t, `DRY-RUN: \d+ record\(s\)`, buf.String())
+
+	// the user report
+	req := httptest.NewRequest("GET", "/admin/users/rpaw053", nil)
+	req.Header.Set(defaultAdminAPIKeyHeader, "ADMIN-KEY")
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code, rw.Body.String())
+	var report userReport
+	require.Nil(t, json.Unmarshal(rw.Body.Bytes(), &report))
+	assert.Equal(t, upi, report.Identity.Upi)
+	require.NotNil(t, report.Token)
+	assert.Equal(t, pseudonym(piiORCID, "0000-0003-1255-9023"), report.Token.ORCID)
+	assert.NotEmpty(t, report.Records)
+	responses += rw.Body.String()
+
+	// no personal identifiers in the logs or the responses
+	logs := buf.String()
+	assert.Contains(t, logs, upi)
+	for _, pii := range []string{"rpaw053", "208013283", "0000-0002-9398-4322", "roshan_pawarasjdfkasdjfajs_@auckland.ac.nz",
+		"0000-0003-1255-9023", "roshan.pawar@auckland.ac.nz"} {
+		assert.NotContains(t, logs, pii)
+		assert.NotContains(t, responses, pii)
+	}
+
+	// the audit log holds the mapping (once per identifier) and is accessible only by the owner
+	info, err := os.Stat(cfg.Privacy.AuditLog)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	data, err := ioutil.ReadFile(cfg.Privacy.AuditLog)
+	require.Nil(t, err)
+	var (
+		mapping = make(map[string]string)
+		count   int
+	)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry struct {
+			Pseudonym string `json:"pseudonym"`
+			Value     string `json:"value"`
+		}
+		require.Nil(t, json.Unmarshal([]byte(line), &entry))
+		mapping[entry.Pseudonym] = entry.Value
+		count++
+	}
+	assert.Equal(t, len(mapping), count)
+	assert.Equal(t, "rpaw053", mapping[upi])
+	assert.Equal(t, "208013283", mapping[idPseudonym(208013283)])
+
+	// the key is required
+	cfg.Privacy.Key, cfg.Privacy.AuditLog = "SHORT", ""
+	err = cfg.validate()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "privacy.key (PRIVACY_KEY)")
+	assert.Contains(t, err.Error(), "privacy.audit-log (PRIVACY_AUDIT_LOG)")
+}
+
+func testEventLogging(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	var buf bytes.Buffer
+	cfg := newLoggerConfig(logJSON, zap.NewAtomicLevelAt(zap.DebugLevel), false)
+	defer func(l *zap.SugaredLogger) { log = l }(log)
+	log = zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(cfg.EncoderConfig),
+		zapcore.Lock(zapcore.AddSync(&buf)), zap.DebugLevel)).Sugar()
+
+	taskID = 0
+	withAnIncomleteTask = true
+	malformatResponse = false
+	_, err := (&Event{
+		Records: []events.SQSMessage{
+			{MessageId: "SQS-MESSAGE-1", Body: `{"subject":"208013283","type":"RESYNC"}`},
+			{MessageId: "SQS-MESSAGE-2", Body: `{"subject":"484378182","type":"RESYNC"}`},
+		},
+		requestID: "LAMBDA-REQUEST-ID",
+	}).handle()
+	assert.Nil(t, err)
+
+	var (
+		handled  = make(map[string]map[string]interface{})
+		upstream = make(map[string]int)
+		records  int
+	)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		require.Nil(t, json.Unmarshal([]byte(line), &entry), line)
+		require.Contains(t, entry, "message")
+		require.Contains(t, entry, "level")
+		require.Contains(t, entry, "time")
+		switch entry["message"] {
+		case "event handled":
+			handled[entry["sqs-message-id"].(string)] = entry
+		case "affiliation records added":
+			records++
+		case "upstream call":
+			if id, ok := entry["event-id"].(string); ok {
+				upstream[id]++
+			}
+			assert.Contains(t, []interface{}{upstreamAPI, upstreamHub}, entry["upstream"])
+			assert.NotContains(t, entry["endpoint"], "208013283")
+			assert.Contains(t, entry, "latency")
+			assert.Contains(t, entry, "status")
+		}
+	}
+	require.Len(t, handled, 2)
+	for sqsMessageID, subject := range map[string]string{"SQS-MESSAGE-1": "208013283", "SQS-MESSAGE-2": "484378182"} {
+		entry := handled[sqsMessageID]
+		require.NotNil(t, entry, sqsMessageID)
+		assert.Equal(t, "LAMBDA-REQUEST-ID", entry["request-id"])
+		assert.Equal(t, subject, entry["subject"])
+		assert.Equal(t, outcomeOK, entry["outcome"])
+		assert.NotEmpty(t, entry["event-id"])
+		assert.Contains(t, entry, "latency")
+		assert.Contains(t, entry, "task-id")
+		// the outbound calls are logged with the event ID
+		assert.NotZero(t, upstream[entry["event-id"].(string)], sqsMessageID)
+	}
+	assert.NotEqual(t, handled["SQS-MESSAGE-1"]["event-id"], handled["SQS-MESSAGE-2"]["event-id"])
+	assert.NotZero(t, records)
+
+	// the ORCID Hub calls of the Hub events are logged with the event ID as well
+	buf.Reset()
+	_, err = (&Event{Type: hubUserUpdated, EPPN: "rpaw053@auckland.ac.nz", ORCID: "0000-0002-1825-0097", DryRun: true}).handle()
+	assert.Nil(t, err)
+	var hubCalls int
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		require.Nil(t, json.Unmarshal([]byte(line), &entry), line)
+		if entry["message"] == "upstream call" && entry["upstream"] == upstreamHub {
+			hubCalls++
+			assert.NotEmpty(t, entry["event-id"], line)
+		} else if strings.HasPrefix(entry["message"].(string), "ORCID iD conflict") {
+			assert.NotEmpty(t, entry["event-id"], line)
+		}
+	}
+	assert.NotZero(t, hubCalls)
+
+	// the UPI gets logged only as the keyed hash (even if the privacy mode is off)
+	assert.NotContains(t, handled["SQS-MESSAGE-1"], "upi")
+	assert.Equal(t, upiHash("rpaw053"), handled["SQS-MESSAGE-1"]["upi-hash"])
+	assert.Regexp(t, `^upi:[0-9a-f]{16}$`, upiHash("rpaw053"))
+	defer func(key []byte) { logHashKey = key }(logHashKey)
+	var c Config
+	c.Log.HashKey = "0123456789ABCDEF"
+	setLogHashKey(c)
+	hash := upiHash("rpaw053")
+	assert.NotEqual(t, upiHash("rcir178"), hash)
+	c.Log.HashKey, c.Privacy.Key = "", "0123456789ABCDEF"
+	setLogHashKey(c)
+	assert.Equal(t, hash, upiHash("rpaw053"))
+	setLogHashKey(Config{})
+	assert.NotEqual(t, hash, upiHash("rpaw053"))
+
+	// no records get logged as added in the dry-run mode
+	buf.Reset()
+	_, err = (&Event{Subject: 208013283, Type: resyncEventType, DryRun: true}).handle()
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), "event handled")
+	assert.NotContains(t, buf.String(), "affiliation records added")
+
+	assert.Equal(t, "identity/integrations/v3/identity/{upi}", endpointTemplate("identity/integrations/v3/identity/rpaw053"))
+	assert.Equal(t, "/service/student/integrations/v1/student/{id}/degree/",
+		endpointTemplate("/service/student/integrations/v1/student/208013283/degree/"))
+	assert.Equal(t, "orcid/api/v3.0/{orcid}/employments", endpointTemplate("orcid/api/v3.0/0000-0002-9398-4322/employments"))
+	assert.Equal(t, "api/v1/tokens/{email}", endpointTemplate("api/v1/tokens/rpaw053@auckland.ac.nz"))
+	assert.Equal(t, "console", newLoggerConfig(logConsole, zap.NewAtomicLevel(), false).Encoding)
+}
+
+// scrapeMetrics returns the metric samples exposed at /metrics.
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	rw := httptest.NewRecorder()
+	newRouter(&authenticator{}, nil, nil).ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Header().Get("Content-Type"), "text/plain")
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(rw.Body.String()), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		require.True(t, i > 0, line)
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		require.Nil(t, err, line)
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+// metricValue returns the current value of the metric series with the label values.
+func metricValue(m *metric, labels ...string) float64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.get(labels).value
+}
+
+func testMetrics(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	defer func(enabled bool) { emfEnabled = enabled }(emfEnabled)
+	emfEnabled = true
+	// flush the metrics recorded so far
+	require.Nil(t, writeEMF(ioutil.Discard, defaultMetricsNamespace, time.Now()))
+	before := scrapeMetrics(t)
+
+	taskID = 0
+	withAnIncomleteTask = true
+	malformatResponse = false
+	_, err := (&Event{Subject: 208013283, Type: "RESYNC"}).handle()
+	assert.Nil(t, err)
+	_, err = (&Event{Type: "NOT-A-TYPE"}).handle()
+	assert.NotNil(t, err)
+
+	after := scrapeMetrics(t)
+	delta := func(sample string) float64 { return after[sample] - before[sample] }
+	assert.Equal(t, 1.0, delta(`orcidhub_events_total{outcome="ok",type="RESYNC"}`))
+	assert.Equal(t, 1.0, delta(`orcidhub_events_total{outcome="failed",type="NOT-A-TYPE"}`))
+	assert.Equal(t, 1.0, delta(`orcidhub_event_duration_seconds_count{type="RESYNC"}`))
+	assert.Equal(t, 1.0, delta(`orcidhub_event_duration_seconds_bucket{type="RESYNC",le="+Inf"}`))
+	assert.True(t, delta(`orcidhub_records_total{affiliation_type="employment"}`) > 0)
+	assert.True(t, delta(`orcidhub_records_total{affiliation_type="education"}`) > 0)
+	degreeCodes.lookup("METRICS-NOT-EXISTING")
+	assert.Equal(t, after[`orcidhub_degree_mappings_total{outcome="unmapped"}`]+1,
+		scrapeMetrics(t)[`orcidhub_degree_mappings_total{outcome="unmapped"}`])
+	assert.Contains(t, after, "orcidhub_task_records")
+	assert.Contains(t, after, "orcidhub_task_age_seconds")
+	assert.Contains(t, after, "orcidhub_task_activations_total")
+
+	var upstreamCalls float64
+	for sample := range after {
+		if strings.HasPrefix(sample, "orcidhub_upstream_requests_total{") {
+			assert.NotContains(t, sample, "208013283")
+			assert.NotContains(t, sample, "@")
+			upstreamCalls += delta(sample)
+		}
+	}
+	assert.True(t, upstreamCalls > 0)
+	assert.Contains(t, after, `orcidhub_upstream_request_duration_seconds_count{`+
+		`endpoint="/service/employment/integrations/v1/employee/{id}",method="GET",upstream="uoa-api"}`)
+
+	// CloudWatch EMF: only the metrics recorded since the last flush
+	var buf bytes.Buffer
+	require.Nil(t, writeEMF(&buf, "Test/Namespace", time.Now()))
+	var found bool
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry struct {
+			AWS struct {
+				Timestamp         int64
+				CloudWatchMetrics []struct {
+					Namespace  string
+					Dimensions [][]string
+					Metrics    []struct{ Name, Unit string }
+				}
+			} `json:"_aws"`
+			Type          string
+			Outcome       string
+			EventsHandled float64
+		}
+		require.Nil(t, json.Unmarshal([]byte(line), &entry), line)
+		require.Len(t, entry.AWS.CloudWatchMetrics, 1)
+		assert.Equal(t, "Test/Namespace", entry.AWS.CloudWatchMetrics[0].Namespace)
+		assert.NotZero(t, entry.AWS.Timestamp)
+		if entry.Type == "RESYNC" && entry.Outcome == outcomeOK && entry.EventsHandled > 0 {
+			found = true
+			assert.Equal(t, 1.0, entry.EventsHandled)
+			assert.Equal(t, [][]string{{"type", "outcome"}}, entry.AWS.CloudWatchMetrics[0].Dimensions)
+		}
+	}
+	assert.True(t, found, buf.String())
+	buf.Reset()
+	require.Nil(t, writeEMF(&buf, "Test/Namespace", time.Now()))
+	assert.NotContains(t, buf.String(), "EventsHandled")
+	assert.Contains(t, buf.String(), "TaskRecords")
+
+	// no histogram observations get dropped
+	for i := 0; i < 2*maxEMFValues+50; i++ {
+		eventDuration.observe(float64(i), "EMF-TEST")
+	}
+	buf.Reset()
+	require.Nil(t, writeEMF(&buf, "Test/Namespace", time.Now()))
+	var observations int
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry struct {
+			Type          string
+			EventDuration []float64
+		}
+		require.Nil(t, json.Unmarshal([]byte(line), &entry), line)
+		if entry.Type == "EMF-TEST" {
+			assert.True(t, len(entry.EventDuration) <= maxEMFValues)
+			observations += len(entry.EventDuration)
+		}
+	}
+	assert.Equal(t, 2*maxEMFValues+50, observations)
+
+	// the failed ORCID Hub calls are not counted
+	taskID = 0
+	require.Nil(t, setupTask(&oh))
+	activations, added := metricValue(taskActivations), metricValue(recordsAdded, "employment")
+	failHubWrites = true
+	(&Task{ID: taskID}).activate(&oh)
+	assert.NotNil(t, addTaskRecords(&oh, []Record{{AffiliationType: "employment"}}))
+	failHubWrites = false
+	assert.Equal(t, activations, metricValue(taskActivations))
+	assert.Equal(t, added, metricValue(recordsAdded, "employment"))
+	(&Task{ID: taskID}).activate(&oh)
+	assert.Equal(t, activations+1, metricValue(taskActivations))
+
+	// the metrics require the admin API key
+	router := newRouter(&authenticator{}, nil, &authenticator{apiKey: "ADMIN-KEY", apiKeyHeader: defaultAdminAPIKeyHeader})
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set(defaultAdminAPIKeyHeader, "ADMIN-KEY")
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), "orcidhub_events_total")
+}
+
+func testTracing(t *testing.T) {
+	if live {
+		t.Skip()
+	}
+
+	var (
+		mutex sync.Mutex
+		spans []*tracepb.Span
+	)
+	decode := func(t *testing.T, req *http.Request) (list []*tracepb.Span) {
+		assert.Equal(t, otlpTracesPath, req.URL.Path)
+		assert.Equal(t, "application/x-protobuf", req.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(req.Body)
+		require.Nil(t, err)
+		var r coltracepb.ExportTraceServiceRequest
+		require.Nil(t, proto.Unmarshal(body, &r))
+		for _, rs := range r.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				list = append(list, ss.Spans...)
+			}
+		}
+		return
+	}
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		list := decode(t, req)
+		mutex.Lock()
+		defer mutex.Unlock()
+		spans = append(spans, list...)
+	}))
+	defer collector.Close()
+	attribute := func(s *tracepb.Span, key string) string {
+		for _, a := range s.Attributes {
+			if a.Key == key {
+				return a.Value.GetStringValue()
+			}
+		}
+		return ""
+	}
+	hexID := hex.EncodeToString
+
+	var cfg Config
+	cfg.Tracing.Endpoint = collector.URL + "/"
+	cfg.Tracing.ServiceName = defaultServiceName
+	setTracing(cfg)
+	defer setTracing(Config{})
+
+	const (
+		traceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+		traceParent = "00-" + traceID + "-00f067aa0ba902b7-01"
+	)
+	sc, ok := parseTraceParent(traceParent)
+	require.True(t, ok)
+	assert.Equal(t, traceParent, sc.traceParent())
+	for _, tp := range []string{"", "00-" + traceID + "-0000000000000000-01", "ff-" + traceID + "-00f067aa0ba902b7-01",
+		"00-" + strings.ToUpper(traceID) + "-00f067aa0ba902b7-01", "00-" + traceID + "-00f067aa0ba902b7-01-00", "00-XYZ"} {
+		_, ok := parseTraceParent(tp)
+		assert.False(t, ok, tp)
+	}
+
+	traceparent := traceParent
+	taskID = 0
+	withAnIncomleteTask = true
+	malformatResponse = false
+	_, err := (&Event{
+		Records: []events.SQSMessage{
+			{MessageId: "SQS-MESSAGE-1", Body: `{"subject":"208013283","type":"RESYNC"}`,
+				MessageAttributes: map[string]events.SQSMessageAttribute{
+					traceParentHeader: {StringValue: &traceparent, DataType: "String"}}},
+			{MessageId: "SQS-MESSAGE-2", Body: `{"subject":"484378182","type":"RESYNC"}`},
+		},
+	}).handle()
+	assert.Nil(t, err)
+	tracing.flush()
+
+	mutex.Lock()
+	byID := make(map[string]*tracepb.Span)
+	for _, s := range spans {
+		byID[hexID(s.SpanId)] = s
+	}
+	var batch, event1, event2 *tracepb.Span
+	for _, s := range spans {
+		switch {
+		case s.Name == "batch":
+			batch = s
+		case s.Name == "event RESYNC" && attribute(s, "messaging.message_id") == "SQS-MESSAGE-1":
+			event1 = s
+		case s.Name == "event RESYNC" && attribute(s, "messaging.message_id") != "":
+			event2 = s
+		}
+	}
+	require.NotNil(t, batch)
+	require.NotNil(t, event1)
+	require.NotNil(t, event2)
+	// the message trace context is taken from the SQS message attributes
+	assert.Equal(t, traceID, hexID(event1.TraceId))
+	assert.Equal(t, "00f067aa0ba902b7", hexID(event1.ParentSpanId))
+	assert.Equal(t, tracepb.Span_SPAN_KIND_CONSUMER, event1.Kind)
+	// otherwise the message is a part of the batch trace
+	assert.Equal(t, batch.TraceId, event2.TraceId)
+	assert.Equal(t, batch.SpanId, event2.ParentSpanId)
+
+	stages := make(map[string]int)
+	for _, s := range spans {
+		if bytes.Equal(s.ParentSpanId, event1.SpanId) && s.Kind == tracepb.Span_SPAN_KIND_INTERNAL {
+			stages[s.Name]++
+			assert.Equal(t, traceID, hexID(s.TraceId))
+		}
+	}
+	assert.Equal(t, map[string]int{"identity": 1, "employment": 1, "degrees": 1, "hub employment": 1,
+		"hub education": 1}, stages)
+	var calls int
+	for _, s := range spans {
+		if s.Kind != tracepb.Span_SPAN_KIND_CLIENT {
+			continue
+		}
+		assert.NotContains(t, s.Name, "208013283")
+		if parent, ok := byID[hexID(s.ParentSpanId)]; ok && bytes.Equal(parent.ParentSpanId, event1.SpanId) {
+			calls++
+			assert.Contains(t, []string{"employment", "degrees", "hub employment", "hub education"}, parent.Name)
+		}
+	}
+	assert.Equal(t, 4, calls)
+	mutex.Unlock()
+
+	// all the upstream calls of an event are recorded in the event trace
+	time.Sleep(10 * time.Millisecond)
+	tracing.flush()
+	mutex.Lock()
+	spans = nil
+	mutex.Unlock()
+	taskID = 0
+	for _, e := range []Event{
+		{Subject: 208013283, Type: "RESYNC", parent: sc},
+		{Type: hubUserUpdated, EPPN: "rpaw053@auckland.ac.nz", ORCID: "0000-0003-1255-9023", parent: sc},
+	} {
+		_, err := e.handle()
+		assert.Nil(t, err)
+	}
+	// NB! the ORCID iD gets updated asynchronously
+	time.Sleep(10 * time.Millisecond)
+	tracing.flush()
+	mutex.Lock()
+	endpoints := make(map[string]bool)
+	for _, s := range spans {
+		if s.Kind == tracepb.Span_SPAN_KIND_CLIENT {
+			endpoints[s.Name] = true
+			assert.Equal(t, traceID, hexID(s.TraceId), s.Name)
+		}
+	}
+	mutex.Unlock()
+	assert.True(t, endpoints["GET /api/v1/tasks"], "the task set-up")
+	assert.True(t, endpoints["PATCH /api/v1/affiliations/{id}"], "the task records")
+	assert.True(t, endpoints["GET /api/v1/tokens/{orcid}"] || endpoints["GET /api/v1/tokens/{email}"], "the token look-up")
+	assert.True(t, endpoints["GET /service/identity/integrations/v3/identity/{upi}"], "the identity look-up")
+
+	// the outbound calls carry the trace context
+	var header string
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header = req.Header.Get(traceParentHeader)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+	mutex.Lock()
+	spans = nil
+	mutex.Unlock()
+	c := Client{Client: http.Client{Transport: &tracingTransport{}}, baseURL: upstream.URL, name: upstreamAPI}
+	s := startSpan(sc, "test", spanInternal)
+	require.NotNil(t, c.in(s).get("identity/integrations/v3/identity/rpaw053", nil))
+	s.finish(nil)
+	hsc, ok := parseTraceParent(header)
+	require.True(t, ok, header)
+	assert.Equal(t, sc.TraceID(), hsc.TraceID())
+	assert.NotEqual(t, s.context().SpanID(), hsc.SpanID())
+	tracing.flush()
+	mutex.Lock()
+	var call *tracepb.Span
+	for _, cs := range spans {
+		if cs.Kind == tracepb.Span_SPAN_KIND_CLIENT {
+			call = cs
+		}
+	}
+	mutex.Unlock()
+	require.NotNil(t, call)
+	assert.Equal(t, "GET /identity/integrations/v3/identity/{upi}", call.Name)
+	sid := s.context().SpanID()
+	assert.Equal(t, sid[:], call.ParentSpanId)
+	var status int64
+	for _, a := range call.Attributes {
+		if a.Key == "http.status_code" {
+			status = a.Value.GetIntValue()
+		}
+	}
+	assert.Equal(t, int64(500), status)
+	assert.Equal(t, tracepb.Status_STATUS_CODE_ERROR, call.Status.GetCode())
+
+	// the trace context of the HTTP request
+	req := httptest.NewRequest("POST", "/handle", strings.NewReader(`{"subject":"208013283","type":"RESYNC"}`))
+	req.Header.Set(traceParentHeader, traceParent)
+	e, err := eventFromRequest(req)
+	require.Nil(t, err)
+	assert.Equal(t, sc, e.parent)
+
+	// the tracer gets shut down (the periodic export stops) and the remaining spans get exported
+	previous := tracing
+	exported := make(chan int, 1)
+	collector2 := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		exported <- len(decode(t, req))
+	}))
+	defer collector2.Close()
+	cfg.Tracing.Endpoint = collector2.URL
+	setTracing(cfg)
+	mutex.Lock()
+	spans = nil
+	mutex.Unlock()
+	_, ps := previous.tracer.Start(context.Background(), "test")
+	ps.End()
+	previous.flush()
+	mutex.Lock()
+	assert.Empty(t, spans, "the previous tracer wasn't shut down")
+	mutex.Unlock()
+	startSpan(sc, "test", spanInternal).finish(nil)
+	tracing.shutdown()
+	select {
+	case n := <-exported:
+		assert.Equal(t, 1, n)
+	default:
+		t.Error("the remaining spans weren't exported")
+	}
+	startSpan(sc, "test", spanInternal).finish(nil)
+	tracing.flush()
+	select {
+	case <-exported:
+		t.Error("the span export wasn't stopped")
+	default:
+	}
+	tracing.shutdown()
+}
+
+func TestConfig(t *testing.T) {
+	keys := []string{"ENV", "ORCID_BASE_URI", "ORCID_HUB_URL", "UOA_API_URL", "APIKEY", "BATCH_SIZE",
+		"TASK_RETENTION", "WEBHOOK_SIGNATURE_TOLERANCE", "TLS_CLIENT_ALLOW", "QUEUE_WORKERS",
+		"MAX_BODY_SIZE", "QUEUE_MAX_ATTEMPTS", "QUEUE_RETRY_DELAY", "ORCID_CONFLICT_POLICY"}
+	for _, key := range keys {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Unsetenv(key)
+	}
+
+	for _, env := range []string{"", productionEnv} {
+		cfg, err := newConfig("", withEnv(env))
+		require.Nil(t, err)
+		assert.True(t, cfg.isProduction())
+		assert.Equal(t, orcidProductionURI, cfg.ORCIDBaseURI)
+		assert.Equal(t, "https://orcidhub.org.nz", cfg.HubURL)
+		assert.Equal(t, "https://api.auckland.ac.nz/service", cfg.APIURL)
+		assert.Equal(t, defaultBatchSize, cfg.Task.BatchSize)
+	}
+	os.Setenv("ENV", "tst")
+	cfg, err := newConfig("")
+	require.Nil(t, err)
+	assert.False(t, cfg.isProduction())
+	assert.Equal(t, "tst", cfg.Env)
+	assert.Equal(t, orcidSandboxURI, cfg.ORCIDBaseURI)
+	assert.Equal(t, "https://test.orcidhub.org.nz", cfg.HubURL)
+	assert.Equal(t, "https://api.test.auckland.ac.nz/service", cfg.APIURL)
+	assert.Contains(t, cfg.String(), "hub-url: https://test.orcidhub.org.nz")
+	os.Unsetenv("ENV")
+
+	// unknown environments require explicit URLs
+	_, err = newConfig("", withEnv("uat"))
+	assert.NotNil(t, err)
+	os.Setenv("ORCID_BASE_URI", "https://sandbox.orcid.org")
+	os.Setenv("ORCID_HUB_URL", "https://uat.orcidhub.org.nz/")
+	os.Setenv("UOA_API_URL", "https://api.uat.auckland.ac.nz/service")
+	cfg, err = newConfig("", withEnv("uat"))
+	require.Nil(t, err)
+	assert.Equal(t, orcidSandboxURI, cfg.ORCIDBaseURI)
+	assert.Equal(t, "https://uat.orcidhub.org.nz", cfg.HubURL)
+
+	// the production environment cannot use the sandbox
+	_, err = newConfig("", withEnv(productionEnv))
+	assert.NotNil(t, err)
+
+	os.Setenv("ORCID_BASE_URI", "https://example.com/")
+	os.Setenv("UOA_API_URL", "api.auckland.ac.nz")
+	_, err = newConfig("", withEnv("dev"))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "ORCID_BASE_URI")
+	assert.Contains(t, err.Error(), "UOA_API_URL")
+	for _, key := range []string{"ORCID_BASE_URI", "ORCID_HUB_URL", "UOA_API_URL"} {
+		os.Unsetenv(key)
+	}
+
+	// the configuration file and the environment overrides
+	dir, err := ioutil.TempDir("", "config")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.yaml")
+	require.Nil(t, ioutil.WriteFile(filename, []byte(`
+env: dev
+api-key: API-KEY-1234
+client-id: CLIENT-ID
+task:
+  batch-size: 100
+  retention: 2h
+orcid-conflicts:
+  policy: review
+server:
+  port: "5050"
+  webhook:
+    secret: WEBHOOK-SECRET
+`), 0600))
+	os.Setenv("BATCH_SIZE", "200")
+	os.Setenv("WEBHOOK_SIGNATURE_TOLERANCE", "60")
+	os.Setenv("TLS_CLIENT_ALLOW", "kafka-connect, orcidhub.org.nz")
+	cfg, err = newConfig(filename)
+	require.NotNil(t, err, "the client certificate verification requires TLS")
+	assert.Contains(t, err.Error(), "TLS_CLIENT_ALLOW")
+	os.Unsetenv("TLS_CLIENT_ALLOW")
+
+	cfg, err = newConfig(filename)
+	require.Nil(t, err)
+	assert.Equal(t, "dev", cfg.Env)
+	assert.Equal(t, orcidSandboxURI, cfg.ORCIDBaseURI)
+	assert.Equal(t, Secret("API-KEY-1234"), cfg.APIKey)
+	assert.Equal(t, 200, cfg.Task.BatchSize)
+	assert.Equal(t, 2*time.Hour, cfg.Task.Retention)
+	assert.Equal(t, conflictReview, cfg.Conflicts.Policy)
+	assert.Equal(t, "5050", cfg.Server.Port)
+	assert.Equal(t, time.Minute, cfg.Server.Webhook.SignatureTolerance)
+	assert.Equal(t, defaultAPIKeyHeader, cfg.Server.Webhook.APIKeyHeader)
+
+	// the secrets are redacted
+	output := cfg.String()
+	assert.NotContains(t, output, "API-KEY-1234")
+	assert.NotContains(t, output, "WEBHOOK-SECRET")
+	assert.Contains(t, output, "api-key: '******'")
+	assert.NotContains(t, output, "CLIENT-ID")
+	assert.Contains(t, output, "client-id: '******'")
+	assert.Contains(t, output, "retention: 2h0m0s")
+
+	// all the invalid values get reported
+	os.Setenv("BATCH_SIZE", "0")
+	os.Setenv("TASK_RETENTION", "a week")
+	os.Setenv("QUEUE_WORKERS", "0")
+	os.Setenv("MAX_BODY_SIZE", "-1")
+	os.Setenv("QUEUE_MAX_ATTEMPTS", "0")
+	os.Setenv("QUEUE_RETRY_DELAY", "0s")
+	os.Setenv("ORCID_CONFLICT_POLICY", "unknown")
+	_, err = newConfig(filename)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "TASK_RETENTION")
+	os.Unsetenv("TASK_RETENTION")
+	_, err = newConfig(filename)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "task.batch-size (BATCH_SIZE)")
+	assert.Contains(t, err.Error(), "server.queue.workers (QUEUE_WORKERS)")
+	assert.Contains(t, err.Error(), "server.max-body-size (MAX_BODY_SIZE)")
+	assert.Contains(t, err.Error(), "server.queue.max-attempts (QUEUE_MAX_ATTEMPTS)")
+	assert.Contains(t, err.Error(), "server.queue.retry-delay (QUEUE_RETRY_DELAY)")
+	assert.Contains(t, err.Error(), "orcid-conflicts.policy (ORCID_CONFLICT_POLICY)")
+
+	// unknown keys are not allowed
+	require.Nil(t, ioutil.WriteFile(filename, []byte("env: dev\nbatch-size: 100\n"), 0600))
+	_, err = newConfig(filename)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "batch-size")
+	_, err = newConfig(filepath.Join(dir, "missing.yaml"))
+	assert.NotNil(t, err)
+}
+
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	parameters map[string]string
+}
+
+func (f fakeSSM) GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	value, ok := f.parameters[aws.StringValue(input.Name)]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "parameter not found", nil)
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Value: aws.String(value)}}, nil
+}
+
+type fakeKMS struct {
+	kmsiface.KMSAPI
+}
+
+func (fakeKMS) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	if !bytes.HasPrefix(input.CiphertextBlob, []byte("ENCRYPTED:")) {
+		return nil, fmt.Errorf("invalid ciphertext")
+	}
+	return &kms.DecryptOutput{Plaintext: bytes.TrimPrefix(input.CiphertextBlob, []byte("ENCRYPTED:"))}, nil
+}
+
+func TestSecrets(t *testing.T) {
+	for _, key := range []string{"APIKEY", "CLIENT_ID", "CLIENT_SECRET", "SECRETS_PROVIDER", "VAULT_ADDR", "VAULT_SECRET_PATH"} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Unsetenv(key)
+	}
+
+	os.Setenv("APIKEY", "ENV-KEY")
+	value, err := envSecrets{}.secret("APIKEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "ENV-KEY", value)
+
+	// Docker/Kubernetes secrets
+	dir, err := ioutil.TempDir("", "secrets")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "APIKEY"), []byte("FILE-KEY\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "client_secret"), []byte("FILE-SECRET"), 0600)
+	fs := fileSecrets{dir: dir}
+	for key, expected := range map[string]string{"APIKEY": "FILE-KEY", "CLIENT_SECRET": "FILE-SECRET", "CLIENT_ID": ""} {
+		value, err = fs.secret(key)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, value, key)
+	}
+
+	// SSM Parameter Store
+	ps := &ssmSecrets{
+		client: fakeSSM{parameters: map[string]string{"/dev/ORCIDHUB-INTEGRATION/CLIENT_ID": "SSM-ID"}},
+		prefix: "/dev" + awsPsPrefix,
+	}
+	value, err = ps.secret("CLIENT_ID")
+	assert.Nil(t, err)
+	assert.Equal(t, "SSM-ID", value)
+	value, err = ps.secret("CLIENT_SECRET")
+	assert.Nil(t, err)
+	assert.Empty(t, value)
+
+	// Vault stub (KV version 2 and 1)
+	var vaultRequests int
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vaultRequests++
+		if r.Header.Get("X-Vault-Token") != "VAULT-TOKEN" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/orcidhub-integration":
+			io.WriteString(w, `{"data": {"data": {"APIKEY": "VAULT-KEY", "CLIENT_ID": "VAULT-ID"}, "metadata": {"version": 3}}}`)
+		case "/v1/kv/orcidhub-integration":
+			io.WriteString(w, `{"data": {"CLIENT_SECRET": "VAULT-SECRET"}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer vault.Close()
+
+	vs := &vaultSecrets{addr: vault.URL + "/", token: "VAULT-TOKEN", path: "secret/data/orcidhub-integration"}
+	for key, expected := range map[string]string{"APIKEY": "VAULT-KEY", "CLIENT_ID": "VAULT-ID", "CLIENT_SECRET": ""} {
+		value, err = vs.secret(key)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, value, key)
+	}
+	assert.Equal(t, 1, vaultRequests, "the secret should be read only once")
+	value, err = (&vaultSecrets{addr: vault.URL, token: "VAULT-TOKEN", path: "/kv/orcidhub-integration"}).secret("CLIENT_SECRET")
+	assert.Nil(t, err)
+	assert.Equal(t, "VAULT-SECRET", value)
+	value, err = (&vaultSecrets{addr: vault.URL, token: "VAULT-TOKEN", path: "secret/data/missing"}).secret("APIKEY")
+	assert.Nil(t, err)
+	assert.Empty(t, value)
+	// the failed read gets retried
+	vs = &vaultSecrets{addr: vault.URL, token: "WRONG", path: "secret/data/orcidhub-integration"}
+	_, err = vs.secret("APIKEY")
+	assert.NotNil(t, err)
+	vs.token = "VAULT-TOKEN"
+	value, err = vs.secret("APIKEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "VAULT-KEY", value)
+
+	// KMS encrypted values have to be explicitly marked
+	ks := &kmsSecrets{
+		provider: configSecrets{
+			"APIKEY":        kmsPrefix + base64.StdEncoding.EncodeToString([]byte("ENCRYPTED:KMS-KEY")),
+			"CLIENT_ID":     "LOOKS+LIKE+A+VERY+LONG+BASE64+ENCODED+KMS+ENCRYPTED+VALUE",
+			"CLIENT_SECRET": kmsPrefix + "!!!",
+		},
+		client: fakeKMS{},
+	}
+	value, err = ks.secret("APIKEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "KMS-KEY", value)
+	value, err = ks.secret("CLIENT_ID")
+	assert.Nil(t, err)
+	assert.Equal(t, "LOOKS+LIKE+A+VERY+LONG+BASE64+ENCODED+KMS+ENCRYPTED+VALUE", value)
+	_, err = ks.secret("CLIENT_SECRET")
+	assert.NotNil(t, err)
+
+	// the Lambda function decrypts the unprefixed values that look encrypted as before
+	legacyValue := "ENCRYPTED:LEGACY-KMS-KEY" + strings.Repeat(">", 20)
+	ks = &kmsSecrets{
+		provider: configSecrets{
+			"APIKEY":        base64.StdEncoding.EncodeToString([]byte(legacyValue)),
+			"CLIENT_ID":     "LOOKS+LIKE+A+VERY+LONG+BASE64+ENCODED+KMS+ENCRYPTED+VALUE",
+			"CLIENT_SECRET": "SHORT+SECRET",
+		},
+		client: fakeKMS{},
+		legacy: true,
+	}
+	value, err = ks.secret("APIKEY")
+	assert.Nil(t, err)
+	assert.Equal(t, strings.TrimPrefix(legacyValue, "ENCRYPTED:"), value)
+	_, err = ks.secret("CLIENT_ID")
+	assert.NotNil(t, err)
+	value, err = ks.secret("CLIENT_SECRET")
+	assert.Nil(t, err)
+	assert.Equal(t, "SHORT+SECRET", value)
+
+	// the provider selected by the configuration falls back to the configuration values
+	os.Setenv("SECRETS_PROVIDER", secretsFromVault)
+	os.Setenv("VAULT_ADDR", vault.URL)
+	os.Setenv("VAULT_TOKEN", "VAULT-TOKEN")
+	os.Setenv("VAULT_SECRET_PATH", "secret/data/orcidhub-integration")
+	os.Setenv("CLIENT_SECRET", "ENV-SECRET")
+	defer os.Unsetenv("VAULT_TOKEN")
+	cfg, err := newConfig("")
+	require.Nil(t, err)
+	assert.Equal(t, awsPsPrefix, cfg.Secrets.SSMPrefix)
+	assert.NotContains(t, cfg.String(), "VAULT-TOKEN")
+	p := newSecretsProvider(cfg)
+	for key, expected := range map[string]string{"APIKEY": "VAULT-KEY", "CLIENT_ID": "VAULT-ID", "CLIENT_SECRET": "ENV-SECRET"} {
+		value, err = p.secret(key)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, value, key)
+	}
+
+	os.Unsetenv("VAULT_SECRET_PATH")
+	_, err = newConfig("")
+	assert.NotNil(t, err)
+	os.Setenv("SECRETS_PROVIDER", "keychain")
+	_, err = newConfig("")
+	assert.NotNil(t, err)
+	cfg, err = newConfig("", withEnv("dev"))
+	assert.NotNil(t, err)
+	assert.Equal(t, "/dev"+awsPsPrefix, cfg.Secrets.SSMPrefix)
+}
+
+func TestRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(loggerCfg.EncoderConfig), zapcore.AddSync(&buf), zap.DebugLevel)
+	defer func(l *zap.SugaredLogger, r *redactor) { log, redaction = l, r }(log, redaction)
+	log = zap.New(newRedactingCore(core)).Sugar()
+
+	var cfg Config
+	cfg.APIKey = "CONFIGURED-API-KEY"
+	cfg.Server.Admin.APIKey = "CONFIGURED-ADMIN-KEY"
+	cfg.Log.Redact = []string{"pin"}
+	setRedaction(cfg)
+
+	// the Hub access token gets redacted (the response body doesn't get logged)
+	mock := httptest.NewServer(createMockHandler(t))
+	defer mock.Close()
+	c := Client{baseURL: mock.URL}
+	require.Nil(t, c.getAccessToken("oauth/token"))
+	assert.Equal(t, "7jsxDZceygy2xNbK2M23sD5eyHimtx", c.accessToken)
+	log.Debugf("GET %s (Authorization: Bearer %s)", "/api/v1/tasks", c.accessToken)
+
+	log.Infof("token: %+v", Token{AccessToken: "ORCID-ACCESS-TOKEN", RefreshToken: "ORCID-REFRESH-TOKEN"})
+	log.Info(`{"access_token": "ORCID-ACCESS-TOKEN", "refresh_token":"ORCID-REFRESH-TOKEN", "orcid": "0000-0002-9398-4322"}`)
+	log.Debug("client_id=CLIENT-ID&client_secret=CLIENT-SECRET&grant_type=client_credentials")
+	log.Debug("APIKEY: ", "CONFIGURED-API-KEY")
+	log.Debugf("GET %q (apikey: %s)", "/identity", "ANOTHER-API-KEY")
+	log.Infow("structured", "apikey", "ANOTHER-API-KEY", "PIN", "1234", "header", "X-Admin-Key CONFIGURED-ADMIN-KEY",
+		"error", fmt.Errorf("refresh_token=ORCID-REFRESH-TOKEN expired"))
+	log.With("access-token", "ORCID-ACCESS-TOKEN").Info("with the token")
+	log.Error("failed to read the secret \"CLIENT_SECRET\": permission denied")
+
+	output := buf.String()
+	for _, secret := range []string{"7jsxDZceygy2xNbK2M23sD5eyHimtx", "ORCID-ACCESS-TOKEN", "ORCID-REFRESH-TOKEN",
+		"CLIENT-SECRET", "CONFIGURED-API-KEY", "ANOTHER-API-KEY", "CONFIGURED-ADMIN-KEY", "1234"} {
+		assert.NotContains(t, output, secret)
+	}
+	assert.Contains(t, output, redacted)
+	assert.Contains(t, output, "0000-0002-9398-4322")
+	assert.Contains(t, output, "client_id=CLIENT-ID")
+	assert.Contains(t, output, "Bearer "+redacted)
+	assert.Contains(t, output, `failed to read the secret \"CLIENT_SECRET\": permission denied`)
+	assert.NotContains(t, output, "expires_in", "the response body should not be logged")
+	assert.Equal(t, 10, strings.Count(output, "\n"))
+}
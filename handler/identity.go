@@ -23,24 +23,57 @@ type Identity struct {
 	Upi string `json:"upi"`
 }
 
-// GetORCID returns the principal part of ORCID iD
-// if the identify has an ORCID.
+// loadIdentity retrieves the identity record by the UPI or the employee/student ID.
+func loadIdentity(upiOrID string) (interface{}, error) {
+	return getIdentity(&api, upiOrID)
+}
+
+// getIdentity retrieves the identity record with the client.
+func getIdentity(c *Client, upiOrID string) (id Identity, err error) {
+	err = c.lookup("identity/integrations/v3/identity/"+upiOrID, &id)
+	return
+}
+
+// identity retrieves the user identity record. Within a batch the identity
+// records get looked up only once.
+func (e *Event) identity(upiOrID string) (Identity, error) {
+	s := e.stage("identity")
+	if e.identities == nil {
+		id, err := getIdentity(api.with(e.logger()).in(s), upiOrID)
+		s.finish(err)
+		return id, err
+	}
+	id, err := e.identities.get(upiOrID)
+	s.finish(err)
+	if err != nil {
+		return Identity{}, err
+	}
+	return id.(Identity), nil
+}
+
+// GetORCID returns the principal part of ORCID iD (in the canonical form)
+// if the identify has an ORCID. Invalid ORCID iDs get ignored.
 func (id *Identity) GetORCID() string {
 	if id.ExtIds == nil {
 		return ""
 	}
 	for _, eid := range id.ExtIds {
 		if eid.Type == "ORCID" {
-			parts := strings.Split(eid.ID, "/")
-			return parts[len(parts)-1]
+			orcid, err := parseOrcidID(eid.ID)
+			if err != nil {
+				log.Warnf("the identity record (ID: %s, UPI: %s) has an invalid ORCID iD: %v",
+					idPseudonym(id.ID), pseudonym(piiUPI, id.Upi), err)
+				return ""
+			}
+			return orcid.String()
 		}
 	}
 	return ""
 }
 
-// GetOrcidAccessToken gets the ORCID API token to verify that the user
-// has granted access to the university.
-func (id *Identity) GetOrcidAccessToken() (token Token, ok bool) {
+// GetOrcidAccessToken gets the ORCID API token with the ORCID Hub client to verify that
+// the user has granted access to the university.
+func (id *Identity) GetOrcidAccessToken(c *Client) (token Token, ok bool) {
 	if id.EmailAddress == "" || id.Upi == "" {
 		return
 	}
@@ -48,9 +81,9 @@ func (id *Identity) GetOrcidAccessToken() (token Token, ok bool) {
 	orcid := id.GetORCID()
 
 	if orcid != "" {
-		err := oh.get("api/v1/tokens/"+orcid, &tokens)
+		err := c.lookup("api/v1/tokens/"+orcid, &tokens)
 		if err != nil {
-			log.Error(err)
+			c.logger().Error(err)
 		} else if len(tokens) > 0 {
 			goto TOKEN_FOUND
 		}
@@ -64,9 +97,9 @@ func (id *Identity) GetOrcidAccessToken() (token Token, ok bool) {
 		}
 		for _, oid := range otherIDs {
 			if oid != "" {
-				err := oh.get("api/v1/tokens/"+oid, &tokens)
+				err := c.lookup("api/v1/tokens/"+oid, &tokens)
 				if err != nil {
-					log.Error(err)
+					c.logger().Error(err)
 				} else if len(tokens) > 0 {
 					goto TOKEN_FOUND
 				}
@@ -83,27 +116,73 @@ TOKEN_FOUND:
 	return
 }
 
-// updateOrcid updates the user ORCID iD.
-func (id *Identity) updateOrcid(ORCID string) {
-	currentORCID := id.GetORCID()
-	if ORCID == currentORCID {
+// updateOrcid updates the user ORCID iD (invalid ORCID iDs get rejected). If the identity record
+// already has a different ORCID iD or the ORCID iDs of the access token and the webhook event
+// disagree, the conflict gets recorded and the ORCID iD gets updated only if the conflict policy
+// allows it. In the dry-run mode of the event the update only gets collected.
+func (e *Event) updateOrcid(id Identity, ORCID, source string) {
+	if ORCID == "" {
 		return
 	}
-
-	var orcidURI string
-	if env == "" {
-		orcidURI = "https://orcid.org/" + ORCID
-	} else {
-		orcidURI = "https://sandbox.orcid.org/" + ORCID
+	orcid, err := parseOrcidID(ORCID)
+	if err != nil {
+		e.logger().Errorf("rejected the update of the identity record (ID: %s, UPI: %s): %v",
+			idPseudonym(id.ID), pseudonym(piiUPI, id.Upi), err)
+		return
 	}
+	sources := map[string]OrcidID{source: orcid}
+	if source == orcidFromWebhook {
+		// NB! the ORCID iD of the access token is compared as well
+		if token, ok := id.GetOrcidAccessToken(oh.with(e.logger()).in(e.span)); ok {
+			if tokenORCID, err := parseOrcidID(token.ORCID); err == nil {
+				sources[orcidFromToken] = tokenORCID
+			}
+		}
+	}
+	current := OrcidID(id.GetORCID())
+	if !e.checkConflict(id, current, sources) || orcid == current {
+		return
+	}
+	id.writeOrcid(api.with(e.logger()).in(e.span), orcid, e.dryRun)
+}
+
+// writeOrcid stores the user ORCID iD in the identity system with the client. In the dry-run
+// mode (dr != nil) the update only gets collected.
+func (id *Identity) writeOrcid(c *Client, orcid OrcidID, dr *DryRun) error {
+	orcidURI := orcid.URI()
 
 	// Add ORCID ID if the user doesn't have one
 	var resp struct {
 		StatusCode string `json:"statusCode"`
 	}
 
-	err := api.put(fmt.Sprintf("identity/integrations/v3/identity/%d/identifier/ORCID", id.ID), map[string]string{"identifier": orcidURI}, &resp)
+	path := fmt.Sprintf("identity/integrations/v3/identity/%d/identifier/ORCID", id.ID)
+	if dr != nil {
+		dr.addIdentityUpdate(IdentityUpdate{ID: id.ID, Upi: id.Upi, Method: "PUT", Path: path, Identifier: orcidURI})
+		return nil
+	}
+	err := c.put(path, map[string]string{"identifier": orcidURI}, &resp)
+	if err != nil {
+		c.logger().Error("failed to update or add ORCID: ", err)
+	}
+	return err
+}
+
+// removeOrcid removes the user ORCID iD from the identity record with the client. In the
+// dry-run mode (dr != nil) the removal only gets collected.
+func (id *Identity) removeOrcid(c *Client, dr *DryRun) error {
+	path := fmt.Sprintf("identity/integrations/v3/identity/%d/identifier/ORCID", id.ID)
+	if dr != nil {
+		dr.addIdentityUpdate(IdentityUpdate{ID: id.ID, Upi: id.Upi, Method: "DELETE", Path: path})
+		return nil
+	}
+	err := c.do("DELETE", path, nil, nil)
+	if isNotFound(err) {
+		// NB! the ORCID iD has already been removed
+		return nil
+	}
 	if err != nil {
-		log.Error("failed to update or add ORCID: ", err)
+		c.logger().Error("failed to remove ORCID: ", err)
 	}
+	return err
 }
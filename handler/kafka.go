@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Kafka topics the HTTP sink connector is subscribed to.
+const (
+	employmentTopic = "nz-ac-auckland-employment"
+	studentTopic    = "nz-ac-auckland-student"
+)
+
+// KafkaHeader - a single Kafka record header (key/value pair).
+type KafkaHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// KafkaMessageHeader - the common header block of the UoA integration topic messages.
+type KafkaMessageHeader struct {
+	MessageID string `json:"messageId"`
+	EventType string `json:"eventType"`
+	Source    string `json:"source"`
+	Timestamp string `json:"timestamp"`
+}
+
+// KafkaRecord - a Kafka record as it gets posted by the HTTP sink connector when
+// the record envelope is included, e.g.:
+//
+//	{
+//	  "topic": "nz-ac-auckland-employment",
+//	  "partition": 0,
+//	  "offset": 1234,
+//	  "key": "484378182",
+//	  "headers": [{"key": "eventType", "value": "JOB_UPDATE"}],
+//	  "value": {"header": {...}, "employeeId": "484378182", ...}
+//	}
+//
+// The value can be either a JSON object or a JSON encoded string
+// (if the connector uses StringConverter for the record values).
+type KafkaRecord struct {
+	Topic     string          `json:"topic"`
+	Partition int             `json:"partition"`
+	Offset    int64           `json:"offset"`
+	Timestamp int64           `json:"timestamp"`
+	Key       string          `json:"key"`
+	Headers   []KafkaHeader   `json:"headers"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// header returns the value of the record header by its key.
+func (r *KafkaRecord) header(key string) string {
+	for _, h := range r.Headers {
+		if strings.EqualFold(h.Key, key) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// EmploymentMessage - nz-ac-auckland-employment topic message.
+type EmploymentMessage struct {
+	Header         KafkaMessageHeader `json:"header"`
+	EmployeeID     string             `json:"employeeId"`
+	Upi            string             `json:"upi"`
+	PositionNumber string             `json:"positionNumber"`
+	EffectiveDate  string             `json:"effectiveDate"`
+}
+
+// StudentMessage - nz-ac-auckland-student topic message.
+type StudentMessage struct {
+	Header     KafkaMessageHeader `json:"header"`
+	StudentID  string             `json:"studentId"`
+	Upi        string             `json:"upi"`
+	DegreeCode string             `json:"degreeCode"`
+	ConferDate string             `json:"conferDate"`
+}
+
+// kafkaMessage is used to probe the message for the fields specific to each topic schema.
+type kafkaMessage struct {
+	Topic      string             `json:"topic"`
+	Value      json.RawMessage    `json:"value"`
+	Header     KafkaMessageHeader `json:"header"`
+	EmployeeID json.RawMessage    `json:"employeeId"`
+	StudentID  json.RawMessage    `json:"studentId"`
+}
+
+// isKafkaMessage checks if the message is a (wrapped) Kafka topic message.
+func (m *kafkaMessage) isKafkaMessage() bool {
+	return (m.Topic != "" && m.Value != nil) || m.EmployeeID != nil || m.StudentID != nil
+}
+
+// decodeKafkaRecord maps the Kafka record onto the event.
+func (e *Event) decodeKafkaRecord(data []byte) error {
+	var r KafkaRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	value := []byte(r.Value)
+	// StringConverter encoded values:
+	if len(value) > 0 && value[0] == '"' {
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil {
+			return err
+		}
+		value = []byte(s)
+	}
+	if err := e.decodeTopicMessage(r.Topic, value); err != nil {
+		return fmt.Errorf("failed to decode %q topic message (offset: %d): %v", r.Topic, r.Offset, err)
+	}
+	if t := r.header("eventType"); t != "" {
+		e.Type = t
+	}
+	return nil
+}
+
+// decodeTopicMessage maps the topic message onto the event. If the topic is not known,
+// the schema is inferred from the message content.
+func (e *Event) decodeTopicMessage(topic string, data []byte) (err error) {
+	var (
+		id     string
+		header KafkaMessageHeader
+	)
+	if topic == "" {
+		var m kafkaMessage
+		if err = json.Unmarshal(data, &m); err != nil {
+			return
+		}
+		topic = iif(m.StudentID != nil, studentTopic, employmentTopic)
+	}
+	switch topic {
+	case employmentTopic:
+		var m EmploymentMessage
+		if err = json.Unmarshal(data, &m); err != nil {
+			return
+		}
+		id, header = m.EmployeeID, m.Header
+	case studentTopic:
+		var m StudentMessage
+		if err = json.Unmarshal(data, &m); err != nil {
+			return
+		}
+		id, header = m.StudentID, m.Header
+	default:
+		return fmt.Errorf("unsupported topic %q", topic)
+	}
+	if id == "" {
+		return fmt.Errorf("missing employee/student ID")
+	}
+	e.Subject, err = strconv.Atoi(id)
+	if err != nil {
+		return fmt.Errorf("invalid ID %q: %v", id, err)
+	}
+	e.Type = header.EventType
+	e.Source = topic
+	if e.id == "" {
+		e.id = header.MessageID
+	}
+	return
+}
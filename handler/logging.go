@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// log formats (LOG_FORMAT)
+const (
+	logJSON    = "json"
+	logConsole = "console"
+)
+
+// event outcomes
+const (
+	outcomeOK     = "ok"
+	outcomeFailed = "failed"
+)
+
+// newLoggerConfig returns the logging configuration of the format. The JSON log entries have
+// the consistent field names, e.g.:
+//
+//	{"level":"info","time":"2019-08-01T10:22:31.000+1200","caller":"handler/common.go:140",
+//	 "message":"event handled","event-id":"...","request-id":"...","subject":"484378182",
+//	 "upi-hash":"upi:4f0a5e0c0d3f1b2a","task-id":781,"latency":"1.2s","outcome":"ok"}
+func newLoggerConfig(format string, level zap.AtomicLevel, development bool) zap.Config {
+	cfg := zap.Config{
+		Level:       level,
+		Development: development,
+		Encoding:    logConsole,
+		EncoderConfig: zapcore.EncoderConfig{
+			TimeKey:        "T",
+			LevelKey:       "L",
+			NameKey:        "N",
+			CallerKey:      "C",
+			MessageKey:     "M",
+			StacktraceKey:  "S",
+			LineEnding:     zapcore.DefaultLineEnding,
+			EncodeLevel:    zapcore.CapitalLevelEncoder,
+			EncodeTime:     zapcore.ISO8601TimeEncoder,
+			EncodeDuration: zapcore.StringDurationEncoder,
+			EncodeCaller:   zapcore.ShortCallerEncoder,
+		},
+		OutputPaths:      []string{"stderr"},
+		ErrorOutputPaths: []string{"stderr"},
+	}
+	if format == logJSON {
+		ec := &cfg.EncoderConfig
+		cfg.Encoding = logJSON
+		ec.TimeKey, ec.LevelKey, ec.NameKey, ec.CallerKey = "time", "level", "logger", "caller"
+		ec.MessageKey, ec.StacktraceKey = "message", "stacktrace"
+		ec.EncodeLevel = zapcore.LowercaseLevelEncoder
+	}
+	return cfg
+}
+
+// isValidLogFormat checks if the log format is supported.
+func isValidLogFormat(format string) bool {
+	return format == logJSON || format == logConsole
+}
+
+// logger returns the event scoped logger with the correlation IDs (the event ID, the SQS message ID,
+// the Lambda or HTTP request ID, the trace ID) and the subject of the event. The event gets an ID if it hasn't got one.
+func (e *Event) logger() *zap.SugaredLogger {
+	if e.log != nil {
+		return e.log
+	}
+	if e.id == "" {
+		e.id = uuid.New().String()
+	}
+	fields := []interface{}{"event-id", e.id}
+	if e.sqsMessageID != "" {
+		fields = append(fields, "sqs-message-id", e.sqsMessageID)
+	}
+	if e.requestID != "" {
+		fields = append(fields, "request-id", e.requestID)
+	}
+	if e.Type != "" {
+		fields = append(fields, "event-type", e.Type)
+	}
+	if e.span != nil {
+		fields = append(fields, "trace-id", e.span.context().TraceID().String())
+	}
+	if e.Subject != 0 {
+		fields = append(fields, "subject", idPseudonym(e.Subject))
+	}
+	if e.EPPN != "" {
+		if upi := strings.Split(e.EPPN, "@")[0]; isValidUPI(upi) {
+			fields = append(fields, "upi-hash", upiHash(upi))
+		}
+	}
+	e.log = log.With(fields...)
+	return e.log
+}
+
+// withUPI adds the keyed hash of the UPI of the user to the event scoped logger.
+func (e *Event) withUPI(upi string) {
+	e.log = e.logger().With("upi-hash", upiHash(upi))
+}
+
+// the key of the UPI hashes in the logs
+var logHashKey []byte
+
+// setLogHashKey sets the key of the UPI hashes in the logs (LOG_HASH_KEY, otherwise PRIVACY_KEY).
+// Without the key the hashes are keyed with a random key, i.e., they can be correlated only within
+// the same process.
+func setLogHashKey(c Config) {
+	switch {
+	case c.Log.HashKey != "":
+		logHashKey = []byte(c.Log.HashKey)
+	case c.Privacy.Key != "":
+		logHashKey = []byte(c.Privacy.Key)
+	default:
+		logHashKey = make([]byte, 32)
+		rand.Read(logHashKey)
+	}
+}
+
+// upiHash returns the keyed hash of the UPI, e.g., upi:4f0a5e0c0d3f1b2a, so the log entries
+// of the user can be correlated without revealing the UPI (irrespective of the privacy mode).
+// In the privacy mode it is the pseudonym of the UPI.
+func upiHash(upi string) string {
+	if privacy != nil {
+		return pseudonym(piiUPI, upi)
+	}
+	mac := hmac.New(sha256.New, logHashKey)
+	mac.Write([]byte(piiUPI + ":" + upi))
+	return piiUPI + ":" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// logRecords logs the number of the records of the affiliation type added to the task
+// (unless it is a dry run or the records could not be added).
+func (e *Event) logRecords(affiliationType string, count int, err error) {
+	if e.dryRun != nil || err != nil || count == 0 {
+		return
+	}
+	e.logger().Infow("affiliation records added", "affiliation-type", affiliationType, "records", count)
+}
+
+// logOutcome logs the outcome and the latency of the event handling.
+func (e *Event) logOutcome(start time.Time, err error) {
+	taskIDMutex.Lock()
+	id := taskID
+	taskIDMutex.Unlock()
+	l := e.logger().With("task-id", id, "latency", time.Since(start))
+	if err != nil {
+		l.Errorw("event handling failed", "outcome", outcomeFailed, "error", err)
+		return
+	}
+	l.Infow("event handled", "outcome", outcomeOK)
+}
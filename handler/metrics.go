@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// the metric kinds
+const (
+	counterMetric   = "counter"
+	gaugeMetric     = "gauge"
+	histogramMetric = "histogram"
+)
+
+const (
+	defaultMetricsNamespace = "ORCIDHub/Integration"
+	// the maximum number of the values of a metric in a CloudWatch EMF log entry
+	maxEMFValues = 100
+)
+
+// the latency histogram buckets (in seconds)
+var latencyBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// metric - a counter, a gauge, or a histogram with the labels. The metric is exposed for
+// Prometheus (name) and as a CloudWatch Embedded Metric Format metric (emfName) with the labels
+// as the dimensions.
+type metric struct {
+	sync.Mutex
+	name, emfName, help, kind, unit string
+	labels                          []string
+	// the Prometheus counter or histogram
+	counter   *prometheus.CounterVec
+	histogram *prometheus.HistogramVec
+	// the gauge value collected at the time of the exposition
+	collect func() float64
+	series  map[string]*series
+}
+
+// series - the values of the metric with the label values recorded for CloudWatch EMF.
+type series struct {
+	labels []string
+	// the counter or gauge value
+	value float64
+	// the counter value at the last EMF flush
+	flushed float64
+	// the histogram observations since the last EMF flush
+	pending []float64
+}
+
+var (
+	registeredMetrics []*metric
+	// the Prometheus registry of the metrics (exposed at /metrics)
+	metricsRegistry = prometheus.NewRegistry()
+	// keep the histogram observations for the CloudWatch EMF flushes (AWS Lambda)
+	emfEnabled bool
+
+	eventsHandled = newMetric(counterMetric, "orcidhub_events_total", "EventsHandled", "Count",
+		"The number of the handled events.", "type", "outcome")
+	eventDuration = newMetric(histogramMetric, "orcidhub_event_duration_seconds", "EventDuration", "Seconds",
+		"The event handling latency.", "type")
+	recordsAdded = newMetric(counterMetric, "orcidhub_records_total", "RecordsAdded", "Count",
+		"The number of the affiliation records added to the ORCID Hub tasks.", "affiliation_type")
+	upstreamRequests = newMetric(counterMetric, "orcidhub_upstream_requests_total", "UpstreamRequests", "Count",
+		"The number of the UoA API and ORCID Hub requests.", "upstream", "method", "endpoint", "status")
+	upstreamDuration = newMetric(histogramMetric, "orcidhub_upstream_request_duration_seconds", "UpstreamLatency",
+		"Seconds", "The UoA API and ORCID Hub request latency.", "upstream", "method", "endpoint")
+	taskActivations = newMetric(counterMetric, "orcidhub_task_activations_total", "TaskActivations", "Count",
+		"The number of the activated ORCID Hub affiliation tasks.")
+	degreeMappings = newMetric(counterMetric, "orcidhub_degree_mappings_total", "DegreeMappings", "Count",
+		"The number of the degree code lookups by the outcome (mapped or unmapped).", "outcome")
+	_ = newGauge("orcidhub_task_records", "TaskRecords", "Count",
+		"The number of the records in the current affiliation task.", func() float64 {
+			taskRecordCountMutex.Lock()
+			defer taskRecordCountMutex.Unlock()
+			return float64(taskRecordCount)
+		})
+	_ = newGauge("orcidhub_task_age_seconds", "TaskAge", "Seconds",
+		"The age of the current affiliation task.", func() float64 {
+			taskIDMutex.Lock()
+			defer taskIDMutex.Unlock()
+			if taskID == 0 || taskCreatedAt.IsZero() {
+				return 0
+			}
+			return time.Since(taskCreatedAt).Seconds()
+		})
+)
+
+// newMetric registers a new metric.
+func newMetric(kind, name, emfName, unit, help string, labels ...string) *metric {
+	m := &metric{
+		name:    name,
+		emfName: emfName,
+		help:    help,
+		kind:    kind,
+		unit:    unit,
+		labels:  labels,
+		series:  make(map[string]*series),
+	}
+	switch kind {
+	case counterMetric:
+		m.counter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+		metricsRegistry.MustRegister(m.counter)
+	case histogramMetric:
+		m.histogram = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{Name: name, Help: help, Buckets: latencyBuckets}, labels)
+		metricsRegistry.MustRegister(m.histogram)
+	}
+	registeredMetrics = append(registeredMetrics, m)
+	return m
+}
+
+// newGauge registers a new gauge that gets collected at the time of the exposition.
+func newGauge(name, emfName, unit, help string, collect func() float64) *metric {
+	m := newMetric(gaugeMetric, name, emfName, unit, help)
+	m.collect = collect
+	metricsRegistry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, collect))
+	return m
+}
+
+// get returns the series with the label values (the caller holds the lock).
+func (m *metric) get(labels []string) *series {
+	key := strings.Join(labels, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: labels}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds the value to the counter.
+func (m *metric) add(value float64, labels ...string) {
+	m.counter.WithLabelValues(labels...).Add(value)
+	m.Lock()
+	m.get(labels).value += value
+	m.Unlock()
+}
+
+// inc increments the counter.
+func (m *metric) inc(labels ...string) {
+	m.add(1, labels...)
+}
+
+// observe records the observation in the histogram.
+func (m *metric) observe(value float64, labels ...string) {
+	m.histogram.WithLabelValues(labels...).Observe(value)
+	if !emfEnabled {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	s := m.get(labels)
+	s.pending = append(s.pending, value)
+}
+
+// observeEvent records the outcome and the latency of the event handling.
+func observeEvent(eventType string, start time.Time, err error) {
+	eventType = iif(eventType == "", "none", eventType)
+	eventsHandled.inc(eventType, iif(err == nil, outcomeOK, outcomeFailed))
+	eventDuration.observe(time.Since(start).Seconds(), eventType)
+}
+
+// observeUpstream records the outcome (the response status or "error") and the latency of the upstream call.
+func observeUpstream(upstream, method, endpoint string, status int, latency time.Duration) {
+	upstreamRequests.inc(upstream, method, endpoint, iif(status == 0, "error", strconv.Itoa(status)))
+	upstreamDuration.observe(latency.Seconds(), upstream, method, endpoint)
+}
+
+// sortedSeries returns the series of the metric ordered by the label values (the caller holds the lock).
+func (m *metric) sortedSeries() []*series {
+	if m.collect != nil {
+		s := m.get(nil)
+		s.value = m.collect()
+	}
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]*series, len(keys))
+	for i, k := range keys {
+		list[i] = m.series[k]
+	}
+	return list
+}
+
+// serveMetrics exposes the metrics for Prometheus.
+var serveMetrics = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+// writeEMF writes the metrics recorded since the last call as CloudWatch Embedded Metric Format
+// log entries (one JSON line per series, or per maxEMFValues histogram observations), e.g.:
+//
+//	{"_aws":{"Timestamp":1564611751000,"CloudWatchMetrics":[{"Namespace":"ORCIDHub/Integration",
+//	 "Dimensions":[["type","outcome"]],"Metrics":[{"Name":"EventsHandled","Unit":"Count"}]}]},
+//	 "type":"EMPLOYMENT","outcome":"ok","EventsHandled":1}
+func writeEMF(w io.Writer, namespace string, now time.Time) error {
+	type emfMetric struct {
+		Name string `json:"Name"`
+		Unit string `json:"Unit"`
+	}
+	type emfDirective struct {
+		Namespace  string      `json:"Namespace"`
+		Dimensions [][]string  `json:"Dimensions"`
+		Metrics    []emfMetric `json:"Metrics"`
+	}
+	type emfMetadata struct {
+		Timestamp         int64          `json:"Timestamp"`
+		CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+	}
+	enc := json.NewEncoder(w)
+	for _, m := range registeredMetrics {
+		m.Lock()
+		for _, s := range m.sortedSeries() {
+			var values []interface{}
+			switch m.kind {
+			case counterMetric:
+				if s.value == s.flushed {
+					continue
+				}
+				values = append(values, s.value-s.flushed)
+				s.flushed = s.value
+			case histogramMetric:
+				// NB! an entry holds up to maxEMFValues observations
+				for len(s.pending) > 0 {
+					n := len(s.pending)
+					if n > maxEMFValues {
+						n = maxEMFValues
+					}
+					values = append(values, s.pending[:n])
+					s.pending = s.pending[n:]
+				}
+				s.pending = nil
+			default:
+				values = append(values, s.value)
+			}
+			for _, value := range values {
+				entry := map[string]interface{}{
+					"_aws": emfMetadata{
+						Timestamp: now.UnixNano() / int64(time.Millisecond),
+						CloudWatchMetrics: []emfDirective{{
+							Namespace:  namespace,
+							Dimensions: [][]string{append([]string{}, m.labels...)},
+							Metrics:    []emfMetric{{m.emfName, m.unit}},
+						}},
+					},
+					m.emfName: value,
+				}
+				for i, n := range m.labels {
+					entry[n] = s.labels[i]
+				}
+				if err := enc.Encode(entry); err != nil {
+					m.Unlock()
+					return err
+				}
+			}
+		}
+		m.Unlock()
+	}
+	return nil
+}
@@ -6,12 +6,25 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strings"
+	"sync"
 	"testing"
 	"unicode"
 )
 
+var (
+	// identity API ORCID identifier update/removal requests
+	identifierRequests      []string
+	identifierRequestsMutex sync.Mutex
+	// the identity API ORCID identifier updates/removals fail with 503
+	failIdentifierRequests bool
+	// ORCID Hub API requests changing the tasks and SNS subscription confirmations
+	hubWrites, snsConfirmations []string
+	mockRequestsMutex           sync.Mutex
+	// the ORCID Hub API requests changing the tasks fail with 500
+	failHubWrites bool
+)
+
 // isValidID validates employment/student ID
 func isValidID(uid string) bool {
 	if l := len(uid); l < 8 || l > 10 {
@@ -25,21 +38,28 @@ func isValidID(uid string) bool {
 	return true
 }
 
-func getenv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
-
 func createMockHandler(t *testing.T) http.HandlerFunc {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		url, ru := r.URL, r.URL.RequestURI()
+		mockRequestsMutex.Lock()
+		if strings.HasPrefix(ru, "/api/v1/") && r.Method != "GET" {
+			hubWrites = append(hubWrites, r.Method+" "+r.URL.Path)
+		} else if strings.HasPrefix(ru, "/sns/") {
+			snsConfirmations = append(snsConfirmations, ru)
+		}
+		mockRequestsMutex.Unlock()
+		if failHubWrites && strings.HasPrefix(ru, "/api/v1/") && r.Method != "GET" {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `{"error": "Internal Server Error"}`)
+			return
+		}
 		switch {
 		case ru == "/ping":
 			w.WriteHeader(http.StatusNoContent)
+		case strings.HasPrefix(ru, "/sns/?Action=ConfirmSubscription"):
+			io.WriteString(w, `<ConfirmSubscriptionResponse/>`)
 		case ru == "/oauth/token":
 			io.WriteString(w, `{"access_token": "7jsxDZceygy2xNbK2M23sD5eyHimtx", "expires_in": 86400, "token_type": "Bearer", "scope": ""}`)
 		case ru == "/api/v1/tasks?type=AFFILIATION&status=INACTIVE":
@@ -61,6 +81,44 @@ func createMockHandler(t *testing.T) http.HandlerFunc {
 	{"created-at":"2099-07-25T00:34:08","filename":"UOA-OH-INTEGRATION-TASK-pv69kZ.json","id":888,"records":[{},{}],"task-type":"AFFILIATION"}`)
 			}
 			io.WriteString(w, "]")
+		case ru == "/orcid/api/v3.0/0000-0003-1255-9023/employments":
+			io.WriteString(w, `{"affiliation-group": [
+	{"summaries": [{"employment-summary": {"put-code": 1001, "department-name": "Cent Learning & Rsch Higher Ed", "role-title": "Professional Casual Staff",
+		"start-date": {"year": {"value": "2016"}, "month": {"value": "06"}, "day": {"value": "15"}},
+		"end-date": {"year": {"value": "2018"}, "month": {"value": "04"}, "day": {"value": "28"}},
+		"organization": {"name": "The University of Auckland"},
+		"external-ids": {"external-id": [{"external-id-type": "local", "external-id-value": "00004741"}]}}}]},
+	{"summaries": [{"employment-summary": {"put-code": 1002, "department-name": "Enterprise Architecture", "role-title": "Developer",
+		"start-date": {"year": {"value": "2018"}, "month": {"value": "07"}, "day": {"value": "16"}},
+		"end-date": {"year": {"value": "2019"}, "month": {"value": "10"}, "day": {"value": "31"}},
+		"organization": {"name": "The University of Auckland"}}}]},
+	{"summaries": [{"employment-summary": {"put-code": 1003, "department-name": "Computer Science", "role-title": "Lecturer",
+		"start-date": {"year": {"value": "2020"}},
+		"organization": {"name": "The University of Auckland"}}}]},
+	{"summaries": [{"employment-summary": {"put-code": 1004, "role-title": "Developer",
+		"organization": {"name": "Another University"}}}]}]}`)
+		case ru == "/orcid/api/v3.0/0000-0003-1255-9023/educations":
+			io.WriteString(w, `{"affiliation-group": [
+	{"summaries": [{"education-summary": {"put-code": 2001, "role-title": "Master of Engineering Studies",
+		"end-date": {"year": {"value": "2016"}, "month": {"value": "09"}, "day": {"value": "26"}},
+		"organization": {"name": "The University of Auckland"},
+		"external-ids": {"external-id": [{"external-id-type": "local", "external-id-value": "208013283/01"}]}}}]}]}`)
+		case strings.HasPrefix(ru, "/orcid/api/v3.0/"):
+			io.WriteString(w, `{"affiliation-group": []}`)
+		case strings.HasPrefix(ru, "/api/v1/users?"):
+			if url.Query().Get("page") != "1" {
+				io.WriteString(w, `[]`)
+				break
+			}
+			io.WriteString(w, `[
+	{"email": "roshan.pawar@auckland.ac.nz", "eppn": "rpaw053@auckland.ac.nz", "orcid": "0000-0003-1255-9023", "confirmed": true},
+	{"email": "rad42@mailinator.com", "eppn": "rcir178@auckland.ac.nz", "orcid": "0000-0001-8228-7153", "confirmed": true},
+	{"email": "dthn666@mailinator.com", "eppn": "dthn666@auckland.ac.nz", "confirmed": true},
+	{"email": "dthn666@mailinator.com", "eppn": "dthn666@auckland.ac.nz", "orcid": "0000-0001-8888-715X", "confirmed": true},
+	{"email": "someone@mailinator.com", "eppn": "abcd123@another.ac.nz", "orcid": "0000-0002-0146-7409", "confirmed": true},
+	{"email": "rpaw053@auckland.ac.nz", "eppn": "RPAW053@auckland.ac.nz", "orcid": "0000-0003-1255-9023", "confirmed": true},
+	{"email": "jken016@mailinator.com", "eppn": "jken016@auckland.ac.nz", "orcid": "0000-0001-1234-5678", "confirmed": true},
+	{"email": "dthn777@mailinator.com", "eppn": "dthn777@auckland.ac.nz", "orcid": "0000-0001-7777-7158", "confirmed": true}]`)
 		case strings.HasPrefix(ru, "/api/v1/tokens/"):
 			var id = strings.TrimPrefix(ru, "/api/v1/tokens/")
 			if id == "rad42@mailinator.com" || id == "0000-0001-8228-7153" || id == "rcir178@auckland.ac.nz" {
@@ -452,6 +510,15 @@ func createMockHandler(t *testing.T) http.HandlerFunc {
 				}`)
 			}
 
+		case strings.HasPrefix(ru, "/service/identity/integrations/v3/identity/") && strings.HasSuffix(ru, "/identifier/ORCID"):
+			identifierRequestsMutex.Lock()
+			identifierRequests = append(identifierRequests, r.Method+" "+ru)
+			identifierRequestsMutex.Unlock()
+			if failIdentifierRequests {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			io.WriteString(w, `{"statusCode":"OK"}`)
 		case strings.HasPrefix(ru, "/service/identity/integrations/v3/identity/"):
 			var uid = strings.TrimPrefix(ru, "/service/identity/integrations/v3/identity/")
 			switch uid {
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OrcidID - ORCID iD in the canonical form, i.e., 16 characters (digits and possibly
+// the check character 'X') in four hyphen separated groups, e.g., 0000-0002-1825-0097.
+type OrcidID string
+
+// parseOrcidID parses and validates ORCID iD given either as a bare iD (with or without the hyphens)
+// or as ORCID (or ORCID sandbox) URI, e.g., https://orcid.org/0000-0002-1825-0097.
+// The last character is verified with ISO 7064 MOD 11-2 check.
+func parseOrcidID(value string) (OrcidID, error) {
+	s := strings.TrimSpace(value)
+	if i := strings.Index(s, "://"); i >= 0 {
+		if scheme := strings.ToLower(s[:i]); scheme != "http" && scheme != "https" {
+			return "", fmt.Errorf("invalid ORCID iD %q: unsupported URI scheme", value)
+		}
+		s = s[i+3:]
+	}
+	if i := strings.Index(s, "/"); i >= 0 {
+		if host := strings.ToLower(s[:i]); host != "orcid.org" && host != "www.orcid.org" && host != "sandbox.orcid.org" {
+			return "", fmt.Errorf("invalid ORCID iD %q: not an ORCID URI", value)
+		}
+		s = strings.TrimSuffix(s[i+1:], "/")
+	}
+
+	digits := strings.ToUpper(strings.Replace(s, "-", "", -1))
+	if len(digits) != 16 || (len(s) != 16 && (len(s) != 19 || s[4] != '-' || s[9] != '-' || s[14] != '-')) {
+		return "", fmt.Errorf("invalid ORCID iD %q: wrong format", value)
+	}
+	total := 0
+	for i, r := range digits {
+		if i < 15 && (r < '0' || r > '9') || i == 15 && (r < '0' || r > '9') && r != 'X' {
+			return "", fmt.Errorf("invalid ORCID iD %q: wrong format", value)
+		}
+		if i < 15 {
+			total = (total + int(r-'0')) * 2
+		}
+	}
+	if checkDigit := (12 - total%11) % 11; digits[15] != "0123456789X"[checkDigit] {
+		return "", fmt.Errorf("invalid ORCID iD %q: checksum mismatch", value)
+	}
+	return OrcidID(digits[0:4] + "-" + digits[4:8] + "-" + digits[8:12] + "-" + digits[12:]), nil
+}
+
+// isValidOrcidID validates ORCID iD.
+func isValidOrcidID(value string) bool {
+	_, err := parseOrcidID(value)
+	return err == nil
+}
+
+// URI returns ORCID iD URI (ORCID_BASE_URI, e.g., https://orcid.org/0000-0002-1825-0097).
+func (o OrcidID) URI() string {
+	return config.ORCIDBaseURI + string(o)
+}
+
+func (o OrcidID) String() string {
+	return string(o)
+}
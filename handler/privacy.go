@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// the kinds of the personal identifiers
+const (
+	piiUPI   = "upi"
+	piiID    = "id"
+	piiEmail = "email"
+	piiORCID = "orcid"
+	piiEPPN  = "eppn"
+)
+
+// the minimum length of the privacy mode hash key (PRIVACY_KEY)
+const minPrivacyKeyLength = 16
+
+// privacyMode - in the privacy mode the personal identifiers (UPIs, employee/student IDs, emails,
+// EPPNs and ORCID iDs) in the logs and the responses get replaced with the keyed hashes (pseudonyms),
+// e.g., upi:4f0a5e0c0d3f1b2a. The pseudonym to identifier mapping is written only into the audit log
+// (PRIVACY_AUDIT_LOG) that is readable only by the owner.
+type privacyMode struct {
+	key   []byte
+	audit *zap.Logger
+	// the pseudonyms that have been recorded in the audit log
+	recorded sync.Map
+}
+
+// privacy is nil unless the privacy mode is enabled (PRIVACY_MODE).
+var privacy *privacyMode
+
+// setPrivacy enables (or disables) the privacy mode and opens the audit log.
+func setPrivacy(c Config) error {
+	if !c.Privacy.Enabled {
+		privacy = nil
+		return nil
+	}
+	f, err := os.OpenFile(c.Privacy.AuditLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open the privacy audit log: %v", err)
+	}
+	encoderCfg := loggerCfg.EncoderConfig
+	encoderCfg.CallerKey, encoderCfg.StacktraceKey = "", ""
+	privacy = &privacyMode{
+		key:   []byte(c.Privacy.Key),
+		audit: zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(encoderCfg), zapcore.Lock(f), zap.InfoLevel)),
+	}
+	return nil
+}
+
+// pseudonym returns the keyed hash of the personal identifier in the privacy mode
+// (otherwise the identifier itself) and records the mapping in the audit log.
+func pseudonym(kind, value string) string {
+	p := privacy
+	if p == nil || value == "" {
+		return value
+	}
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(kind + ":" + value))
+	hash := kind + ":" + hex.EncodeToString(mac.Sum(nil))[:16]
+	if _, recorded := p.recorded.LoadOrStore(hash, true); !recorded {
+		p.audit.Info("pseudonym", zap.String("pseudonym", hash), zap.String("kind", kind), zap.String("value", value))
+	}
+	return hash
+}
+
+// userPseudonym returns the pseudonym of the user given either by the UPI or the employee/student ID.
+func userPseudonym(upiOrID string) string {
+	if isValidUPI(upiOrID) {
+		return pseudonym(piiUPI, upiOrID)
+	}
+	return pseudonym(piiID, upiOrID)
+}
+
+// idPseudonym returns the pseudonym of the employee/student ID.
+func idPseudonym(id int) string {
+	return pseudonym(piiID, strconv.Itoa(id))
+}
+
+// pathPseudonym returns the URL path with the users (e.g., /admin/users/{upi-or-id} and
+// /admin/conflicts/{upi}) replaced with the pseudonyms.
+func pathPseudonym(path string) string {
+	if privacy == nil {
+		return path
+	}
+	parts := strings.Split(path, "/")
+	for i := 1; i < len(parts); i++ {
+		if (parts[i-1] == "users" || parts[i-1] == "conflicts") && parts[i] != "" {
+			parts[i] = userPseudonym(parts[i])
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// describe returns the event for the logs.
+func (e *Event) describe() string {
+	if privacy == nil {
+		return fmt.Sprintf("%+v", e)
+	}
+	if len(e.Records) > 0 || len(e.Batch) > 0 {
+		var list []string
+		for _, r := range e.Records {
+			list = append(list, "SQS message "+r.MessageId)
+		}
+		for _, be := range e.Batch {
+			list = append(list, be.describe())
+		}
+		return fmt.Sprintf("batch of %d messages: [%s]", len(list), strings.Join(list, ", "))
+	}
+	// NB! the URL (e.g., the SNS subscription confirmation URL) is not needed
+	return fmt.Sprintf("&{EPPN:%s Email:%s ORCID:%s Subject:%s Type:%s URL:%s Source:%s DryRun:%t}",
+		pseudonym(piiEPPN, e.EPPN), pseudonym(piiEmail, e.Email), pseudonym(piiORCID, e.ORCID),
+		iif(e.Subject == 0, "", idPseudonym(e.Subject)), e.Type, iif(e.URL == "", "", redacted), e.Source, e.DryRun)
+}
+
+// describe returns the identity record for the logs and the responses.
+func (id Identity) describe() string {
+	if privacy == nil {
+		return fmt.Sprintf("%#v", id)
+	}
+	return fmt.Sprintf("main.Identity{ID:%q, Upi:%q, EmailAddress:%q, ORCID:%q}", idPseudonym(id.ID),
+		pseudonym(piiUPI, id.Upi), pseudonym(piiEmail, id.EmailAddress), pseudonym(piiORCID, id.GetORCID()))
+}
+
+// pseudonymise returns the copy of the identity record with the personal identifiers replaced
+// with the pseudonyms in the privacy mode (the numeric ID is omitted).
+func (id Identity) pseudonymise() Identity {
+	if privacy == nil {
+		return id
+	}
+	p := Identity{EmailAddress: pseudonym(piiEmail, id.EmailAddress), Upi: pseudonym(piiUPI, id.Upi)}
+	p.Emails = append(p.Emails, id.Emails...)
+	for i := range p.Emails {
+		p.Emails[i].Email = pseudonym(piiEmail, p.Emails[i].Email)
+	}
+	p.ExtIds = append(p.ExtIds, id.ExtIds...)
+	for i := range p.ExtIds {
+		p.ExtIds[i].ID = pseudonym(iif(p.ExtIds[i].Type == "ORCID", piiORCID, piiID), p.ExtIds[i].ID)
+	}
+	return p
+}
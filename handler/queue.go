@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Queued event statuses
+const (
+	eventQueued     = "QUEUED"
+	eventProcessing = "PROCESSING"
+	eventDone       = "DONE"
+	eventFailed     = "FAILED"
+)
+
+const (
+	defaultQueueSize        = 10000
+	defaultQueueRetention   = 24 * time.Hour
+	defaultQueueMaxAttempts = 5
+	defaultQueueRetryDelay  = time.Minute
+	maxQueueRetryDelay      = time.Hour
+)
+
+var errQueueFull = errors.New("the event queue is full")
+
+// QueuedEvent - the event message accepted for the asynchronous processing.
+type QueuedEvent struct {
+	ID      string  `json:"id"`
+	Status  string  `json:"status"`
+	Events  []Event `json:"events"`
+	Message string  `json:"message,omitempty"`
+	Error   string  `json:"error,omitempty"`
+	// the number of the attempts to process the event
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"created-at"`
+	UpdatedAt time.Time `json:"updated-at"`
+	// the trace context of the request (W3C traceparent)
+	TraceParent string `json:"traceparent,omitempty"`
+}
+
+// eventQueue - in-process persistent event queue. Each queued event gets stored in
+// a separate file in the queue directory, so the events that haven't been processed
+// get re-queued when the server restarts. The failed events get retried with the exponential
+// back-off up to the maximum number of attempts. The processed events are kept for the
+// status look-up for the retention period.
+type eventQueue struct {
+	sync.Mutex
+	dir         string
+	retention   time.Duration
+	maxAttempts int
+	retryDelay  time.Duration
+	entries     map[string]*QueuedEvent
+	pending     chan string
+	quit        chan struct{}
+	workers     sync.WaitGroup
+}
+
+// newEventQueue creates the queue in the given directory and re-queues
+// the events that haven't been processed.
+func newEventQueue(dir string, size int) (*eventQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if size < len(files) {
+		size = len(files)
+	}
+	q := eventQueue{
+		dir:         dir,
+		retention:   defaultQueueRetention,
+		maxAttempts: defaultQueueMaxAttempts,
+		retryDelay:  defaultQueueRetryDelay,
+		entries:     make(map[string]*QueuedEvent, len(files)),
+		pending:     make(chan string, size),
+		quit:        make(chan struct{}),
+	}
+	var queued []*QueuedEvent
+	for _, fn := range files {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		var qe QueuedEvent
+		if err = json.Unmarshal(data, &qe); err != nil {
+			log.Errorf("failed to load the queued event %q: %v", fn, err)
+			continue
+		}
+		q.entries[qe.ID] = &qe
+		if qe.Status == eventQueued || qe.Status == eventProcessing {
+			queued = append(queued, &qe)
+		}
+	}
+	// NB! preserve the order of the events
+	sort.Slice(queued, func(i, j int) bool { return queued[i].CreatedAt.Before(queued[j].CreatedAt) })
+	for _, qe := range queued {
+		qe.Status = eventQueued
+		q.pending <- qe.ID
+	}
+	if n := len(q.pending); n > 0 {
+		log.Infof("re-queued %d event(s)", n)
+	}
+	return &q, nil
+}
+
+// store persists the queued event.
+func (q *eventQueue) store(qe *QueuedEvent) error {
+	data, err := json.Marshal(qe)
+	if err != nil {
+		return err
+	}
+	fn := filepath.Join(q.dir, qe.ID+".json")
+	if err = ioutil.WriteFile(fn+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+// enqueue validates and durably enqueues the event.
+func (q *eventQueue) enqueue(e Event) (*QueuedEvent, error) {
+	events := []Event{e}
+	if e.isBatch() {
+		events = e.messages()
+	}
+	if len(events) == 0 || (!e.isBatch() && !e.isProcessable()) {
+		return nil, errors.New("unhandled event")
+	}
+	// NB! the SNS messages get verified before they are queued (and once more when they get processed)
+	if err := e.SNS.verify(); err != nil {
+		return nil, err
+	}
+	for _, m := range events {
+		if err := m.SNS.verify(); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	qe := QueuedEvent{
+		ID:          uuid.New().String(),
+		Status:      eventQueued,
+		Events:      events,
+		TraceParent: e.parent.traceParent(),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	if len(q.pending) == cap(q.pending) {
+		return nil, errQueueFull
+	}
+	if err := q.store(&qe); err != nil {
+		return nil, err
+	}
+	q.entries[qe.ID] = &qe
+	q.pending <- qe.ID
+	return &qe, nil
+}
+
+// get returns the snapshot of the queued event.
+func (q *eventQueue) get(id string) (qe QueuedEvent, ok bool) {
+	q.Lock()
+	defer q.Unlock()
+	if e, ok := q.entries[id]; ok {
+		return *e, true
+	}
+	return
+}
+
+// setStatus updates and persists the status of the queued event.
+func (q *eventQueue) setStatus(qe *QueuedEvent, status, message string, err error) {
+	q.Lock()
+	defer q.Unlock()
+	qe.Status, qe.Message, qe.UpdatedAt = status, message, time.Now()
+	if err != nil {
+		qe.Error = err.Error()
+	} else if status == eventDone {
+		qe.Error = ""
+	}
+	if err := q.store(qe); err != nil {
+		log.Errorf("failed to store the queued event %q: %v", qe.ID, err)
+	}
+}
+
+// process handles the queued event.
+func (q *eventQueue) process(id string) {
+	inflight.Add(1)
+	defer inflight.Done()
+
+	q.Lock()
+	qe, ok := q.entries[id]
+	q.Unlock()
+	if !ok {
+		return
+	}
+	q.Lock()
+	qe.Attempts++
+	q.Unlock()
+	q.setStatus(qe, eventProcessing, "", nil)
+
+	var (
+		message string
+		err     error
+	)
+	// NB! the queued event ID is used as the request ID (it's returned to the client)
+	parent, _ := parseTraceParent(qe.TraceParent)
+	for i := range qe.Events {
+		qe.Events[i].requestID = qe.ID
+		qe.Events[i].parent = parent
+	}
+	if len(qe.Events) == 1 {
+		message, err = qe.Events[0].handle()
+	} else {
+		message, err = (&Event{Batch: qe.Events, parent: parent}).handle()
+	}
+	if err != nil {
+		if qe.Attempts < q.maxAttempts {
+			delay := q.backoff(qe.Attempts)
+			log.Warnf("failed to process the queued event %q (attempt %d of %d), retrying in %s: %v",
+				qe.ID, qe.Attempts, q.maxAttempts, delay, err)
+			q.setStatus(qe, eventQueued, message, err)
+			time.AfterFunc(delay, func() { q.retry(id) })
+			return
+		}
+		q.setStatus(qe, eventFailed, message, err)
+		return
+	}
+	q.setStatus(qe, eventDone, message, nil)
+}
+
+// backoff returns the delay before the next attempt (it doubles with each attempt).
+func (q *eventQueue) backoff(attempts int) time.Duration {
+	delay := q.retryDelay
+	for i := 1; i < attempts && delay < maxQueueRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxQueueRetryDelay {
+		delay = maxQueueRetryDelay
+	}
+	return delay
+}
+
+// retry re-queues the failed event. If the queue is stopped or full, the event
+// remains persisted and gets re-queued when the server restarts.
+func (q *eventQueue) retry(id string) {
+	select {
+	case <-q.quit:
+		return
+	default:
+	}
+	select {
+	case q.pending <- id:
+	default:
+		log.Warnf("the queue is full, the queued event %q gets retried after the restart", id)
+	}
+}
+
+// purge removes the processed events that are older than the retention period.
+func (q *eventQueue) purge() {
+	q.Lock()
+	defer q.Unlock()
+	for id, qe := range q.entries {
+		if (qe.Status == eventDone || qe.Status == eventFailed) && time.Since(qe.UpdatedAt) > q.retention {
+			delete(q.entries, id)
+			os.Remove(filepath.Join(q.dir, id+".json"))
+		}
+	}
+}
+
+// start starts the background workers.
+func (q *eventQueue) start(workers int) {
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			ticker := time.NewTicker(time.Hour)
+			defer ticker.Stop()
+			for {
+				// NB! stop before picking up the next event
+				select {
+				case <-q.quit:
+					return
+				default:
+				}
+				select {
+				case <-q.quit:
+					return
+				case <-ticker.C:
+					q.purge()
+				case id := <-q.pending:
+					q.process(id)
+				}
+			}
+		}()
+	}
+}
+
+// stop stops the workers after the events that are being processed get processed.
+// The rest of the queued events remain persisted.
+func (q *eventQueue) stop() {
+	close(q.quit)
+	q.workers.Wait()
+}
+
+// isProcessable checks if the (single) event message can be processed.
+func (e *Event) isProcessable() bool {
+	switch e.Type {
+	case "PING", snsSubscriptionConfirmation, snsUnsubscribeConfirmation:
+		return true
+	}
+	return e.Subject != 0 || e.isHubEvent()
+}
+
+// eventIDFromPath extracts the event ID from the status request path (/events/{id}).
+func eventIDFromPath(path string) string {
+	return strings.Trim(strings.TrimPrefix(path, "/events/"), "/")
+}
+
+// handleEvent validates and enqueues the event message posted to the server.
+// It responds with 202 and the ID of the queued event.
+func (q *eventQueue) handleEvent(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	e, err := eventFromRequest(req)
+	if err != nil {
+		rw.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprintf(rw, `{"error": %q}`, err.Error())
+		return
+	}
+	qe, err := q.enqueue(e)
+	if err != nil {
+		requestLogger(req).Error(err)
+		if err == errQueueFull {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+		fmt.Fprintf(rw, `{"error": %q}`, err.Error())
+		return
+	}
+	requestLogger(req).Infof("queued the event %q", qe.ID)
+	rw.Header().Set("Location", "/events/"+qe.ID)
+	rw.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(rw, `{"id": %q, "status": %q}`, qe.ID, qe.Status)
+}
+
+// eventStatus responds with the status of the queued event (GET /events/{id}). NB! the events
+// and the message (e.g., the dry-run report) carry the personal details and are not exposed.
+func (q *eventQueue) eventStatus(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	qe, ok := q.get(eventIDFromPath(req.URL.Path))
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(rw, `{"error": "event not found"}`)
+		return
+	}
+	json.NewEncoder(rw).Encode(struct {
+		ID       string `json:"id"`
+		Status   string `json:"status"`
+		Attempts int    `json:"attempts"`
+		Error    string `json:"error,omitempty"`
+	}{qe.ID, qe.Status, qe.Attempts, qe.Error})
+}
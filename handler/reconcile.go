@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Reconciliation statuses
+const (
+	// the record that would be generated is not on ORCID
+	affiliationMissing = "missing"
+	// the record is on ORCID, but it differs from the one that would be generated
+	affiliationStale = "stale"
+	// the record of the organisation is on ORCID, but it wouldn't be generated
+	affiliationExtra = "extra"
+)
+
+// organisationName is used to tell the affiliations of the organisation on ORCID.
+var organisationName = "University of Auckland"
+
+// FuzzyDate - ORCID API fuzzy date.
+type FuzzyDate struct {
+	Year *struct {
+		Value string `json:"value"`
+	} `json:"year"`
+	Month *struct {
+		Value string `json:"value"`
+	} `json:"month"`
+	Day *struct {
+		Value string `json:"value"`
+	} `json:"day"`
+}
+
+// String formats the date as YYYY[-MM[-DD]].
+func (d *FuzzyDate) String() string {
+	if d == nil || d.Year == nil {
+		return ""
+	}
+	s := d.Year.Value
+	if d.Month != nil {
+		s += "-" + d.Month.Value
+		if d.Day != nil {
+			s += "-" + d.Day.Value
+		}
+	}
+	return s
+}
+
+// AffiliationSummary - ORCID API (v3.0) employment or education summary.
+type AffiliationSummary struct {
+	PutCode        int        `json:"put-code"`
+	DepartmentName string     `json:"department-name"`
+	RoleTitle      string     `json:"role-title"`
+	StartDate      *FuzzyDate `json:"start-date"`
+	EndDate        *FuzzyDate `json:"end-date"`
+	Organization   struct {
+		Name string `json:"name"`
+	} `json:"organization"`
+	ExternalIDs struct {
+		ExternalID []struct {
+			Type  string `json:"external-id-type"`
+			Value string `json:"external-id-value"`
+		} `json:"external-id"`
+	} `json:"external-ids"`
+}
+
+// localID returns the local ID (the external ID of type "local") of the affiliation.
+func (s *AffiliationSummary) localID() string {
+	for _, eid := range s.ExternalIDs.ExternalID {
+		if eid.Type == "local" {
+			return eid.Value
+		}
+	}
+	return ""
+}
+
+// Affiliations - ORCID API (v3.0) employments or educations response.
+type Affiliations struct {
+	AffiliationGroup []struct {
+		Summaries []struct {
+			Employment *AffiliationSummary `json:"employment-summary"`
+			Education  *AffiliationSummary `json:"education-summary"`
+		} `json:"summaries"`
+	} `json:"affiliation-group"`
+}
+
+// summaries returns the affiliations of the organisation.
+func (a *Affiliations) summaries() (list []*AffiliationSummary) {
+	for _, g := range a.AffiliationGroup {
+		for _, s := range g.Summaries {
+			summary := s.Employment
+			if summary == nil {
+				summary = s.Education
+			}
+			if summary != nil && strings.Contains(strings.ToLower(summary.Organization.Name), strings.ToLower(organisationName)) {
+				list = append(list, summary)
+			}
+		}
+	}
+	return
+}
+
+// orcidAffiliations reads the affiliations ("employments" or "educations") of the user
+// back from ORCID via the ORCID Hub API proxy.
+func orcidAffiliations(orcid, section string) ([]*AffiliationSummary, error) {
+	var a Affiliations
+	if err := oh.get("orcid/api/v3.0/"+orcid+"/"+section, &a); err != nil {
+		return nil, err
+	}
+	return a.summaries(), nil
+}
+
+// AffiliationDiff - a discrepancy between the record that would be generated and ORCID.
+type AffiliationDiff struct {
+	User            string   `json:"user"`
+	ORCID           string   `json:"orcid"`
+	Status          string   `json:"status"`
+	AffiliationType string   `json:"affiliation-type"`
+	PutCode         int      `json:"put-code,omitempty"`
+	LocalID         string   `json:"local-id,omitempty"`
+	Role            string   `json:"role,omitempty"`
+	Department      string   `json:"department,omitempty"`
+	StartDate       string   `json:"start-date,omitempty"`
+	EndDate         string   `json:"end-date,omitempty"`
+	Differences     []string `json:"differences,omitempty"`
+}
+
+// differences compares the generated record with the affiliation on ORCID. The start date
+// gets compared only if it is set (the education records have only the end date).
+func differences(r Record, s *AffiliationSummary) (diffs []string) {
+	compare := func(name, expected, actual string) {
+		if name == "start-date" && expected == "" {
+			return
+		}
+		if !strings.EqualFold(strings.TrimSpace(expected), strings.TrimSpace(actual)) {
+			diffs = append(diffs, fmt.Sprintf("%s: %q != %q", name, actual, expected))
+		}
+	}
+	compare("role", r.Role, s.RoleTitle)
+	if r.AffiliationType == "employment" {
+		compare("department", r.Department, s.DepartmentName)
+	}
+	compare("start-date", r.StartDate, s.StartDate.String())
+	compare("end-date", r.EndDate, s.EndDate.String())
+	return
+}
+
+// matches checks if the affiliation on ORCID is the one of the generated record, i.e.,
+// either the local IDs or the roles (and the departments of the employment) match.
+func matches(r Record, s *AffiliationSummary) bool {
+	if id := s.localID(); id != "" && r.LocalID != "" {
+		return id == r.LocalID
+	}
+	return strings.EqualFold(r.Role, s.RoleTitle) &&
+		(r.AffiliationType != "employment" || strings.EqualFold(r.Department, s.DepartmentName))
+}
+
+// reconcileRecords compares the records that would be generated with the affiliations on ORCID.
+func reconcileRecords(user, orcid, affiliationType string, records []Record, summaries []*AffiliationSummary) (diffs []AffiliationDiff) {
+	matched := make(map[*AffiliationSummary]bool)
+	for _, r := range records {
+		if r.AffiliationType != affiliationType {
+			continue
+		}
+		var found *AffiliationSummary
+		for _, s := range summaries {
+			if !matched[s] && matches(r, s) {
+				found = s
+				break
+			}
+		}
+		d := AffiliationDiff{
+			User: user, ORCID: orcid, AffiliationType: affiliationType, LocalID: r.LocalID,
+			Role: r.Role, Department: r.Department, StartDate: r.StartDate, EndDate: r.EndDate,
+		}
+		if found == nil {
+			d.Status = affiliationMissing
+			diffs = append(diffs, d)
+			continue
+		}
+		matched[found] = true
+		if d.Differences = differences(r, found); len(d.Differences) > 0 {
+			d.Status, d.PutCode = affiliationStale, found.PutCode
+			diffs = append(diffs, d)
+		}
+	}
+	for _, s := range summaries {
+		if !matched[s] {
+			diffs = append(diffs, AffiliationDiff{
+				User: user, ORCID: orcid, Status: affiliationExtra, AffiliationType: affiliationType,
+				PutCode: s.PutCode, LocalID: s.localID(), Role: s.RoleTitle, Department: s.DepartmentName,
+				StartDate: s.StartDate.String(), EndDate: s.EndDate.String(),
+			})
+		}
+	}
+	return
+}
+
+// reconcileUser compares the records that would be generated for the user given by
+// the UPI or the employee/student ID with the affiliations on ORCID.
+func reconcileUser(user string) ([]AffiliationDiff, error) {
+	var id Identity
+	if err := api.lookup("identity/integrations/v3/identity/"+user, &id); err != nil {
+		return nil, err
+	}
+	if id.ID == 0 {
+		return nil, fmt.Errorf("identity record for %q not found", user)
+	}
+	report, err := newUserReport(id, user)
+	if err != nil {
+		return nil, err
+	}
+	orcid := report.ORCID
+	if report.Token != nil {
+		orcid = report.Token.ORCID
+	}
+	if orcid == "" {
+		return nil, fmt.Errorf("the user %q hasn't got an ORCID iD", user)
+	}
+	if !isValidOrcidID(orcid) {
+		return nil, fmt.Errorf("the user %q has an invalid ORCID iD %q", user, orcid)
+	}
+
+	var diffs []AffiliationDiff
+	for _, section := range []struct{ name, affiliationType string }{
+		{"employments", "employment"},
+		{"educations", "education"},
+	} {
+		summaries, err := orcidAffiliations(orcid, section.name)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, reconcileRecords(user, orcid, section.affiliationType, report.Records, summaries)...)
+	}
+	return diffs, nil
+}
+
+// writeDiffs writes the reconciliation report in the given format ("csv" or "json").
+func writeDiffs(w io.Writer, format string, diffs []AffiliationDiff) error {
+	switch format {
+	case "json":
+		if diffs == nil {
+			diffs = []AffiliationDiff{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diffs)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"user", "orcid", "status", "affiliation-type", "put-code", "local-id",
+			"role", "department", "start-date", "end-date", "differences"})
+		for _, d := range diffs {
+			putCode := ""
+			if d.PutCode != 0 {
+				putCode = strconv.Itoa(d.PutCode)
+			}
+			cw.Write([]string{d.User, d.ORCID, d.Status, d.AffiliationType, putCode, d.LocalID,
+				d.Role, d.Department, d.StartDate, d.EndDate, strings.Join(d.Differences, "; ")})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unsupported format %q", format)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// capturedLogEvent is used to probe a CloudWatch Logs export or subscription record
+// for the logged message.
+type capturedLogEvent struct {
+	Message *string `json:"message"`
+}
+
+// jsonPayload strips the prefix (e.g., the log line timestamp and the level) of the JSON object or array.
+func jsonPayload(data []byte) []byte {
+	if i := bytes.IndexAny(data, "{["); i > 0 {
+		return data[i:]
+	}
+	return data
+}
+
+// decodeCapturedEvent decodes the event that might be wrapped in a CloudWatch log record.
+func decodeCapturedEvent(data []byte) (e Event, err error) {
+	var m capturedLogEvent
+	if json.Unmarshal(data, &m) == nil && m.Message != nil {
+		data = jsonPayload([]byte(*m.Message))
+	}
+	err = json.Unmarshal(data, &e)
+	return
+}
+
+// readEvents reads the event messages: a single event message (including SQS batches and
+// the other supported envelopes), a JSON array, a stream of JSON values, or JSONL captured
+// from CloudWatch (the log line prefixes get stripped).
+func readEvents(r io.Reader) ([]Event, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var (
+			raw json.RawMessage
+			e   Event
+		)
+		if err = dec.Decode(&raw); err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			break
+		}
+		if e, err = decodeCapturedEvent(raw); err != nil {
+			break
+		}
+		events = append(events, e)
+	}
+
+	// fall back to the line by line decoding
+	events = nil
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		e, err := decodeCapturedEvent(jsonPayload(text))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// ReplayResult - the outcome of the replayed event.
+type ReplayResult struct {
+	Source  string `json:"source"`
+	Index   int    `json:"index"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// replay handles the events one by one and reports the results.
+func replay(source string, events []Event, dryRun bool) []ReplayResult {
+	results := make([]ReplayResult, len(events))
+	for i := range events {
+		e := &events[i]
+		// NB! the messages of the batch inherit the dry-run mode
+		e.DryRun = e.DryRun || dryRun
+		message, err := e.handle()
+		results[i] = ReplayResult{Source: source, Index: i + 1, Message: message}
+		if err != nil {
+			results[i].Error = err.Error()
+		}
+	}
+	return results
+}
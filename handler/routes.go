@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+var (
+	// in-flight event messages (to drain at the shutdown)
+	inflight sync.WaitGroup
+	// the UoA API resource used to check if the API is reachable
+	apiHealthCheckURL = "external-organisations/v1/qualifications"
+)
+
+// newRouter creates the stand-alone server request router. If the queue is given,
+// the events get processed asynchronously. If the admin authenticator is given,
+// the operator REST API gets enabled.
+func newRouter(auth *authenticator, queue *eventQueue, adminAuth *authenticator) http.Handler {
+	mux := http.NewServeMux()
+	if queue != nil {
+		mux.Handle("/handle", auth.wrap(http.HandlerFunc(queue.handleEvent)))
+		mux.Handle("/events/", auth.wrap(http.HandlerFunc(queue.eventStatus)))
+	} else {
+		mux.Handle("/handle", auth.wrap(http.HandlerFunc(handleEvent)))
+	}
+	if adminAuth != nil {
+		addAdminRoutes(mux, adminAuth)
+	}
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	// NB! the metrics require the admin API key (if set) or the incoming request authentication
+	metricsAuth := auth
+	if adminAuth != nil {
+		metricsAuth = adminAuth
+	}
+	mux.Handle("/metrics", metricsAuth.wrap(serveMetrics))
+	return withRequestID(mux)
+}
+
+// requestID returns the request ID (X-Request-ID) of the request.
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns the logger with the request ID.
+func requestLogger(req *http.Request) *zap.SugaredLogger {
+	if id := requestID(req); id != "" {
+		return log.With("request-id", id)
+	}
+	return log
+}
+
+// statusRecorder records the response status code.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// withRequestID assigns the request ID (or uses the one set by the caller in X-Request-ID header),
+// returns it in the response header and logs the request.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if id == "" {
+			id = uuid.New().String()
+		}
+		rw.Header().Set(requestIDHeader, id)
+		req = req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id))
+
+		start := time.Now()
+		rec := statusRecorder{ResponseWriter: rw}
+		h.ServeHTTP(&rec, req)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		requestLogger(req).Infof("%s %s %d %s", req.Method, pathPseudonym(req.URL.Path), rec.status, time.Since(start))
+	})
+}
+
+// handleEvent handles the event message posted to the server.
+func handleEvent(rw http.ResponseWriter, req *http.Request) {
+	inflight.Add(1)
+	defer inflight.Done()
+
+	rw.Header().Set("Content-Type", "application/json")
+	e, err := eventFromRequest(req)
+	if err != nil {
+		rw.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprintf(rw, `{"error": %q}`, err.Error())
+		return
+	}
+	msg, err := e.handle()
+	if err != nil {
+		requestLogger(req).Error(err)
+		rw.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(rw, `{"error": %q}`, err.Error())
+	}
+	if msg != "" {
+		fmt.Fprintf(rw, `{"message": %q}`, msg)
+	} else if err == nil {
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// healthz reports that the process is alive.
+func healthz(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(rw, `{"status": "ok"}`)
+}
+
+const (
+	// the readiness check result is cached for the interval (the probes can be frequent)
+	readinessTTL = 5 * time.Second
+	// the timeout of the upstream checks
+	readinessTimeout = 3 * time.Second
+)
+
+// the last readiness check result
+var lastReadiness struct {
+	sync.Mutex
+	checks    map[string]string
+	ready     bool
+	checkedAt time.Time
+}
+
+// readiness checks if the ORCID Hub access token is valid, the UoA API is
+// reachable and, unless it is a dry run, the affiliation task is initialised.
+func readiness() (checks map[string]string, ready bool) {
+	checks = map[string]string{"hub": "ok", "api": "ok", "task": "ok"}
+	ready = true
+	fail := func(name string, err error) {
+		checks[name] = err.Error()
+		ready = false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), readinessTimeout)
+	defer cancel()
+	if oh.accessToken == "" {
+		fail("hub", fmt.Errorf("missing ORCID Hub access token"))
+	} else if err := oh.check(ctx, "api/v1/tasks?type=AFFILIATION&status=INACTIVE"); err != nil {
+		fail("hub", err)
+	}
+	if err := api.check(ctx, apiHealthCheckURL); err != nil {
+		fail("api", err)
+	}
+	taskIDMutex.Lock()
+	id := taskID
+	taskIDMutex.Unlock()
+	if dryRun {
+		// NB! no affiliation task gets created in the dry-run mode
+		checks["task"] = "skipped (dry run)"
+	} else if id == 0 {
+		fail("task", fmt.Errorf("the affiliation task is not initialised"))
+	}
+	return
+}
+
+// cachedReadiness returns the last readiness check result if it is not older than readinessTTL,
+// otherwise it checks the readiness again.
+func cachedReadiness() (map[string]string, bool) {
+	lastReadiness.Lock()
+	defer lastReadiness.Unlock()
+	if lastReadiness.checks == nil || time.Since(lastReadiness.checkedAt) > readinessTTL {
+		lastReadiness.checks, lastReadiness.ready = readiness()
+		lastReadiness.checkedAt = time.Now()
+	}
+	return lastReadiness.checks, lastReadiness.ready
+}
+
+// readyz reports if the server is ready to handle the events.
+func readyz(rw http.ResponseWriter, req *http.Request) {
+	checks, ready := cachedReadiness()
+	if !ready {
+		writeJSON(rw, http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "checks": checks})
+		return
+	}
+	writeJSON(rw, http.StatusOK, map[string]interface{}{"status": "ok", "checks": checks})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// secrets providers (SECRETS_PROVIDER)
+const (
+	secretsFromEnv   = "env"
+	secretsFromFile  = "file"
+	secretsFromSSM   = "ssm"
+	secretsFromVault = "vault"
+)
+
+const (
+	// awsPsPrefix - AWS Paramter Store parameter name prefix
+	awsPsPrefix = "/ORCIDHUB-INTEGRATION/"
+	// kmsPrefix marks the base64 encoded KMS encrypted secret values, e.g., kms:AQICAHh...
+	kmsPrefix         = "kms:"
+	defaultSecretsDir = "/run/secrets"
+	vaultTimeout      = 10 * time.Second
+)
+
+// secretsProvider - the source of the secret values, i.e., APIKEY, CLIENT_ID and CLIENT_SECRET.
+type secretsProvider interface {
+	// secret returns the value of the secret (empty if it is not set).
+	secret(key string) (string, error)
+}
+
+var (
+	// the secrets provider selected by the configuration (created at the first use)
+	secrets     secretsProvider
+	secretsLock sync.Mutex
+	// decrypt also the unprefixed values that look like KMS ciphertext (the Lambda function
+	// decrypted them before the prefix "kms:" was introduced)
+	legacyKMSSecrets bool
+	vaultClient      = &http.Client{Timeout: vaultTimeout}
+)
+
+// isValidSecretsProvider checks if the secrets provider is supported.
+func isValidSecretsProvider(provider string) bool {
+	switch provider {
+	case "", secretsFromEnv, secretsFromFile, secretsFromSSM, secretsFromVault:
+		return true
+	}
+	return false
+}
+
+// newSecretsProvider creates the secrets provider selected by the configuration. The values
+// that are not provided fall back to the configuration ones, and the values marked with
+// the prefix "kms:" (or, in the Lambda function, the ones that look encrypted) get decrypted with KMS.
+func newSecretsProvider(c Config) secretsProvider {
+	var p secretsProvider
+	switch c.Secrets.Provider {
+	case secretsFromFile:
+		p = fileSecrets{dir: c.Secrets.Dir}
+	case secretsFromSSM:
+		p = &ssmSecrets{prefix: c.Secrets.SSMPrefix}
+	case secretsFromVault:
+		p = &vaultSecrets{addr: c.Secrets.Vault.Addr, token: string(c.Secrets.Vault.Token), path: c.Secrets.Vault.Path}
+	default:
+		p = envSecrets{}
+	}
+	return &kmsSecrets{legacy: legacyKMSSecrets, provider: chainSecrets{p, configSecrets{
+		"APIKEY":        string(c.APIKey),
+		"CLIENT_ID":     string(c.ClientID),
+		"CLIENT_SECRET": string(c.ClientSecret),
+	}}}
+}
+
+// getSecret returns the value of the secret read from the configured secrets provider.
+func getSecret(key string) (string, error) {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	if secrets == nil {
+		secrets = newSecretsProvider(config)
+	}
+	value, err := secrets.secret(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the secret %q: %v", key, err)
+	}
+	return value, nil
+}
+
+// envSecrets - the secrets given as the environment variables.
+type envSecrets struct{}
+
+func (envSecrets) secret(key string) (string, error) {
+	return os.Getenv(key), nil
+}
+
+// configSecrets - the secrets of the configuration (the configuration file or the environment).
+type configSecrets map[string]string
+
+func (c configSecrets) secret(key string) (string, error) {
+	return c[key], nil
+}
+
+// chainSecrets returns the first value set by the providers.
+type chainSecrets []secretsProvider
+
+func (c chainSecrets) secret(key string) (string, error) {
+	for _, p := range c {
+		if value, err := p.secret(key); err != nil || value != "" {
+			return value, err
+		}
+	}
+	return "", nil
+}
+
+// fileSecrets - the secrets stored in the files of the directory (SECRETS_DIR), e.g.,
+// Docker (/run/secrets) or Kubernetes secrets mounted as a volume. The file is named
+// either after the key (e.g., CLIENT_SECRET) or the lower-cased key (e.g., client_secret).
+type fileSecrets struct {
+	dir string
+}
+
+func (f fileSecrets) secret(key string) (string, error) {
+	for _, name := range []string{key, strings.ToLower(key)} {
+		data, err := ioutil.ReadFile(filepath.Join(f.dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return "", nil
+}
+
+// ssmSecrets - the secrets stored in AWS Systems Manager Parameter Store
+// (SECRETS_SSM_PREFIX + key, e.g., /dev/ORCIDHUB-INTEGRATION/APIKEY).
+type ssmSecrets struct {
+	client ssmiface.SSMAPI
+	prefix string
+}
+
+func (s *ssmSecrets) secret(key string) (string, error) {
+	if s.client == nil {
+		sess, err := session.NewSession()
+		if err != nil {
+			return "", err
+		}
+		s.client = ssm.New(sess)
+	}
+	name := s.prefix + key
+	log.Debugf("reading parameter %q", name)
+	param, err := s.client.GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		if e, ok := err.(awserr.Error); ok && e.Code() == ssm.ErrCodeParameterNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	return aws.StringValue(param.Parameter.Value), nil
+}
+
+// vaultSecrets - the secrets stored in HashiCorp Vault key/value secrets engine (either version 1 or 2),
+// e.g., VAULT_SECRET_PATH=secret/data/orcidhub-integration with the keys APIKEY, CLIENT_ID and CLIENT_SECRET.
+// The secret gets read only once it has been read successfully.
+type vaultSecrets struct {
+	sync.Mutex
+	addr, token, path string
+	values            map[string]string
+	loaded            bool
+}
+
+func (v *vaultSecrets) secret(key string) (string, error) {
+	v.Lock()
+	defer v.Unlock()
+	if !v.loaded {
+		values, err := v.read()
+		if err != nil {
+			return "", err
+		}
+		v.values, v.loaded = values, true
+	}
+	return v.values[key], nil
+}
+
+// read reads the secret from Vault.
+func (v *vaultSecrets) read() (map[string]string, error) {
+	url := strings.TrimSuffix(v.addr, "/") + "/v1/" + strings.TrimPrefix(v.path, "/")
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %q: %s", url, resp.Status)
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, err
+	}
+	data := secret.Data
+	// KV version 2 nests the values and the metadata
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok = data["metadata"]; ok {
+			data = nested
+		}
+	}
+	values := make(map[string]string, len(data))
+	for k, value := range data {
+		values[k] = fmt.Sprint(value)
+	}
+	return values, nil
+}
+
+// kmsSecrets decrypts the values of the provider that are explicitly marked as KMS
+// encrypted, i.e., the base64 encoded ciphertext prefixed with "kms:". If legacy is set,
+// the unprefixed values that look encrypted (at least 40 characters with a "+") get
+// decrypted as well.
+type kmsSecrets struct {
+	provider secretsProvider
+	client   kmsiface.KMSAPI
+	legacy   bool
+}
+
+func (k *kmsSecrets) secret(key string) (string, error) {
+	value, err := k.provider.secret(key)
+	if err != nil {
+		return value, err
+	}
+	var ciphertext string
+	switch {
+	case strings.HasPrefix(value, kmsPrefix):
+		ciphertext = strings.TrimPrefix(value, kmsPrefix)
+	case k.legacy && len(value) >= 40 && strings.Contains(value, "+"):
+		ciphertext = value
+	default:
+		return value, nil
+	}
+	blob, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("invalid KMS encrypted value: %v", err)
+	}
+	if k.client == nil {
+		sess, err := session.NewSession()
+		if err != nil {
+			return "", err
+		}
+		k.client = kms.New(sess)
+	}
+	output, err := k.client.Decrypt(&kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		return "", err
+	}
+	return string(output.Plaintext), nil
+}
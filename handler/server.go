@@ -3,48 +3,133 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
+	"flag"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-func getenv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+func main() {
+	flag.BoolVar(&dryRun, "dry-run", dryRun, "process the events without writing anywhere (the changes get logged)")
+	flag.Parse()
+	if configErr != nil {
+		log.Fatal("invalid configuration: ", configErr)
+	}
+	log.Info("configuration:\n", config)
+	if dryRun {
+		log.Warn("running in the dry-run mode: no changes get written to the ORCID Hub or the identity records")
 	}
-	return defaultValue
-}
 
-func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
+	sc := config.Server
+	if sc.Port == "" {
 		log.Fatal("$PORT not set")
 	}
-	addr := ":" + port
-	http.HandleFunc("/handle", func(rw http.ResponseWriter, req *http.Request) {
-		rw.Header().Set("Content-Type", "application/json")
-		var e Event
-		decoder := json.NewDecoder(req.Body)
-		err := decoder.Decode(&e)
+	auth := newAuthenticator()
+	if !auth.isEnabled() {
+		log.Warn("the incoming request authentication is not configured")
+	}
+	var adminAuth *authenticator
+	if sc.Admin.APIKey != "" {
+		adminAuth = &authenticator{apiKey: string(sc.Admin.APIKey), apiKeyHeader: sc.Admin.APIKeyHeader,
+			maxBodySize: int64(sc.MaxBodySize)}
+	}
+	var queue *eventQueue
+	if dir := sc.Queue.Dir; dir != "" {
+		var err error
+		queue, err = newEventQueue(dir, defaultQueueSize)
 		if err != nil {
-			rw.WriteHeader(http.StatusUnsupportedMediaType)
-			fmt.Fprintf(rw, `{"error": %q}`, err.Error())
-			return
+			log.Fatal("failed to set up the event queue: ", err)
 		}
-		msg, err := e.handle()
+		queue.retention = sc.Queue.Retention
+		queue.maxAttempts, queue.retryDelay = sc.Queue.MaxAttempts, sc.Queue.RetryDelay
+		queue.start(sc.Queue.Workers)
+		log.Infof("the events get queued in %q and processed by %d worker(s)", dir, sc.Queue.Workers)
+	}
+	server := http.Server{
+		Addr:         ":" + sc.Port,
+		Handler:      newRouter(auth, queue, adminAuth),
+		ReadTimeout:  sc.ReadTimeout,
+		WriteTimeout: sc.WriteTimeout,
+		IdleTimeout:  sc.IdleTimeout,
+	}
+	shutdownTimeout := sc.ShutdownTimeout
+
+	certFile, keyFile := sc.TLS.CertFile, sc.TLS.KeyFile
+	if certFile != "" {
+		cfg, err := tlsConfig()
 		if err != nil {
-			rw.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(rw, `{"error": %q}`, err.Error())
+			log.Fatal(err)
 		}
-		if msg != "" {
-			fmt.Fprintf(rw, `{"message": %q}`, msg)
-		} else {
-			rw.WriteHeader(http.StatusNoContent)
+		server.TLSConfig = cfg
+	}
+
+	// initialise the API clients and the task
+	go func() {
+		if err := setup(dryRun); err != nil {
+			log.Error("failed to set up: ", err)
 		}
-	})
-	log.Infof("Listening on %s...\n", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		sc := make(chan os.Signal, 1)
+		signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			// every 10 min check if the current task can be submitted for processing
+			case <-ticker.C:
+				if err := activateDueTask(true); err != nil {
+					log.Error(err)
+				}
+			case s := <-sc:
+				log.Infof("received %s, shutting down...", s)
+				ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				defer cancel()
+				if err := server.Shutdown(ctx); err != nil {
+					log.Error("failed to shut down gracefully: ", err)
+				}
+				if queue != nil {
+					// NB! the queued events that haven't been picked up get processed after the restart
+					queue.stop()
+				}
+				// drain the in-flight events
+				drained := make(chan struct{})
+				go func() {
+					inflight.Wait()
+					close(drained)
+				}()
+				select {
+				case <-drained:
+				case <-ctx.Done():
+					log.Warn("not all in-flight events were processed")
+				}
+				// activate the current task (if it might be activated) at the shutdown
+				activateDueTask(false)
+				// stop the span export and export the remaining spans
+				tracing.shutdown()
+				close(done)
+				return
+			}
+		}
+	}()
+
+	var err error
+	if certFile != "" {
+		log.Infof("Listening on %s (TLS)...\n", server.Addr)
+		err = server.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		log.Infof("Listening on %s...\n", server.Addr)
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-done
+	log.Info("service terminated")
+	logger.Sync()
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SNS message types
+const (
+	snsNotification             = "Notification"
+	snsSubscriptionConfirmation = "SubscriptionConfirmation"
+	snsUnsubscribeConfirmation  = "UnsubscribeConfirmation"
+)
+
+// snsURL returns the SNS endpoint URL of the region, e.g., https://sns.ap-southeast-2.amazonaws.com.
+// The subscription URL and the signing certificate URL have to be on the endpoint of the topic region.
+var snsURL = func(region string) string {
+	if strings.HasPrefix(region, "cn-") {
+		return "https://sns." + region + ".amazonaws.com.cn"
+	}
+	return "https://sns." + region + ".amazonaws.com"
+}
+
+const maxSNSCertificateSize = 64 * 1024
+
+var (
+	// the SNS signing certificates by the certificate URL
+	snsCertificates sync.Map
+	// the client fetching the signing certificates and confirming the subscriptions
+	snsClient = http.Client{Timeout: 10 * time.Second}
+)
+
+// SNSMessage - AWS SNS HTTP(S) endpoint notification message.
+type SNSMessage struct {
+	Type              string `json:"Type"`
+	MessageID         string `json:"MessageId"`
+	Token             string `json:"Token"`
+	TopicArn          string `json:"TopicArn"`
+	Subject           string `json:"Subject"`
+	Message           string `json:"Message"`
+	Timestamp         string `json:"Timestamp"`
+	SubscribeURL      string `json:"SubscribeURL"`
+	UnsubscribeURL    string `json:"UnsubscribeURL"`
+	SignatureVersion  string `json:"SignatureVersion"`
+	Signature         string `json:"Signature"`
+	SigningCertURL    string `json:"SigningCertURL"`
+	MessageAttributes map[string]struct {
+		Type  string `json:"Type"`
+		Value string `json:"Value"`
+	} `json:"MessageAttributes"`
+}
+
+// attribute returns the value of the message attribute.
+func (m *SNSMessage) attribute(name string) string {
+	if a, ok := m.MessageAttributes[name]; ok {
+		return a.Value
+	}
+	return ""
+}
+
+// region returns the AWS region of the topic (arn:aws:sns:<region>:<account>:<topic>).
+func (m *SNSMessage) region() string {
+	if parts := strings.Split(m.TopicArn, ":"); len(parts) == 6 && parts[2] == "sns" {
+		return parts[3]
+	}
+	return ""
+}
+
+// isSNSURL checks if the URL is on the SNS endpoint of the topic region.
+func (m *SNSMessage) isSNSURL(rawurl string) bool {
+	region := m.region()
+	if region == "" || !strings.HasPrefix(rawurl, snsURL(region)+"/") {
+		return false
+	}
+	_, err := url.Parse(rawurl)
+	return err == nil
+}
+
+// stringToSign returns the message fields covered by the signature.
+func (m *SNSMessage) stringToSign() string {
+	var sb strings.Builder
+	add := func(name, value string) {
+		sb.WriteString(name + "\n" + value + "\n")
+	}
+	add("Message", m.Message)
+	add("MessageId", m.MessageID)
+	if m.Type == snsNotification {
+		if m.Subject != "" {
+			add("Subject", m.Subject)
+		}
+		add("Timestamp", m.Timestamp)
+	} else {
+		add("SubscribeURL", m.SubscribeURL)
+		add("Timestamp", m.Timestamp)
+		add("Token", m.Token)
+	}
+	add("TopicArn", m.TopicArn)
+	add("Type", m.Type)
+	return sb.String()
+}
+
+// certificate returns the signing certificate (it gets fetched only once).
+func (m *SNSMessage) certificate() (*x509.Certificate, error) {
+	if !m.isSNSURL(m.SigningCertURL) || !strings.HasSuffix(m.SigningCertURL, ".pem") {
+		return nil, fmt.Errorf("invalid SNS signing certificate URL: %q", m.SigningCertURL)
+	}
+	if cert, ok := snsCertificates.Load(m.SigningCertURL); ok {
+		return cert.(*x509.Certificate), nil
+	}
+	resp, err := snsClient.Get(m.SigningCertURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the SNS signing certificate: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch the SNS signing certificate: %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSNSCertificateSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the SNS signing certificate: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("invalid SNS signing certificate %q", m.SigningCertURL)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SNS signing certificate %q: %v", m.SigningCertURL, err)
+	}
+	snsCertificates.Store(m.SigningCertURL, cert)
+	return cert, nil
+}
+
+// verify verifies the signature of the message with the SNS signing certificate.
+// It accepts nil messages, i.e., the events that weren't delivered by SNS.
+func (m *SNSMessage) verify() error {
+	if m == nil {
+		return nil
+	}
+	var algorithm x509.SignatureAlgorithm
+	switch m.SignatureVersion {
+	case "1":
+		algorithm = x509.SHA1WithRSA
+	case "2":
+		algorithm = x509.SHA256WithRSA
+	default:
+		return fmt.Errorf("unsupported SNS message %q signature version %q", m.MessageID, m.SignatureVersion)
+	}
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid SNS message %q signature: %v", m.MessageID, err)
+	}
+	cert, err := m.certificate()
+	if err != nil {
+		return err
+	}
+	if err := cert.CheckSignature(algorithm, []byte(m.stringToSign()), signature); err != nil {
+		return fmt.Errorf("invalid SNS message %q signature: %v", m.MessageID, err)
+	}
+	return nil
+}
+
+// decodeSNSMessage maps the SNS message onto the event. The notification message
+// can be any event message the handler understands. Its 'type', 'subject' and 'source'
+// message attributes get mapped onto the event. NB! the signature of the message
+// gets verified only when the event is handled (it might require fetching the signing certificate).
+func (e *Event) decodeSNSMessage(data []byte) error {
+	var m SNSMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	switch m.Type {
+	case snsNotification:
+		if err := e.decodePayload([]byte(m.Message)); err != nil {
+			return fmt.Errorf("failed to decode SNS message %q: %v", m.MessageID, err)
+		}
+		e.applyAttributes(m.attribute("type"), m.attribute("subject"), m.attribute("source"))
+		if e.id == "" {
+			e.id = m.MessageID
+		}
+	case snsSubscriptionConfirmation, snsUnsubscribeConfirmation:
+		e.Type = m.Type
+		e.URL = m.SubscribeURL
+		e.Source = m.TopicArn
+	default:
+		return fmt.Errorf("unsupported SNS message type %q", m.Type)
+	}
+	e.SNS = &m
+	return nil
+}
+
+// confirmSubscription confirms the SNS topic subscription visiting the subscription URL. The subscription
+// gets confirmed only if the event is the signed SNS message and the URL is on the SNS endpoint of the topic region.
+func (e *Event) confirmSubscription() (string, error) {
+	m := e.SNS
+	if m == nil || m.Type != snsSubscriptionConfirmation {
+		return "", errors.New("the subscription confirmation is accepted only as a signed SNS message")
+	}
+	if !m.isSNSURL(m.SubscribeURL) {
+		return "", fmt.Errorf("invalid SNS subscription URL: %q", m.SubscribeURL)
+	}
+	if e.dryRun != nil {
+		e.dryRun.setSubscription(m.TopicArn)
+		return "", nil
+	}
+	resp, err := snsClient.Get(m.SubscribeURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to confirm the subscription to %q: %v", m.TopicArn, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to confirm the subscription to %q: %s", m.TopicArn, resp.Status)
+	}
+	log.Infof("confirmed the subscription to %q", m.TopicArn)
+	return "subscription confirmed", nil
+}
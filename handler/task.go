@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
@@ -43,33 +44,39 @@ type Record struct {
 	Status              string `json:"status,omitempty"`
 }
 
-func (t *Task) activate() {
+// activate activates the task with the ORCID Hub client.
+func (t *Task) activate(c *Client) {
 	var task Task
-	log.Debugf("Activate the task %q (ID: %d)", t.Filename, t.ID)
-	err := oh.patch("api/v1/tasks/"+strconv.Itoa(t.ID), map[string]string{"status": "ACTIVE"}, &task)
+	c.logger().Debugf("Activate the task %q (ID: %d)", t.Filename, t.ID)
+	err := c.patch("api/v1/tasks/"+strconv.Itoa(t.ID), map[string]string{"status": "ACTIVE"}, &task)
 	if err != nil {
-		log.Errorf("ERROR: Failed to activate task %d: %q", t.ID, err)
+		c.logger().Errorf("ERROR: Failed to activate task %d: %q", t.ID, err)
+		return
 	}
+	taskActivations.inc()
 }
 
-func newTask() {
+// newTask creates a new affiliation task with the ORCID Hub client.
+func newTask(c *Client) error {
 
 	taskFilename := taskFilenamePrefix + strconv.FormatInt(time.Now().Unix(), 36) + ".json"
 	var task = Task{Filename: taskFilename, Type: "AFFILIATION", Records: []Record{}}
-	err := oh.post("api/v1/affiliations?filename="+taskFilename, task, &task)
+	err := c.post("api/v1/affiliations?filename="+taskFilename, task, &task)
 	if err != nil {
-		logFatal("failed to create a new affiliation task", err)
+		return fmt.Errorf("failed to create a new affiliation task: %v", err)
 	}
 	taskID = task.ID
 	taskCreatedAt, err = time.Parse("2006-01-02T15:04:05", task.CreatedAt)
 	if err != nil {
-		log.Errorf("failed to parse date %q: %s", task.CreatedAt, err)
+		c.logger().Errorf("failed to parse date %q: %s", task.CreatedAt, err)
 	}
-	log.Debugf("*** New affiliation task created (ID: %d, filename: %q)", task.ID, task.Filename)
+	c.logger().Debugf("*** New affiliation task created (ID: %d, filename: %q)", task.ID, task.Filename)
+	return nil
 }
 
 // Either get the task ID or activate outstanding tasks and start a new one
-func setupTask() (err error) {
+// (with the ORCID Hub client)
+func setupTask(c *Client) (err error) {
 
 	taskIDMutex.Lock()
 	defer taskIDMutex.Unlock()
@@ -78,21 +85,21 @@ func setupTask() (err error) {
 	if taskID == 0 {
 		var tasks []Task
 		// Make sure the access token acquired
-		log.Debug("=======================================================================================")
-		oh.get("api/v1/tasks?type=AFFILIATION&status=INACTIVE", &tasks)
+		c.logger().Debug("=======================================================================================")
+		c.get("api/v1/tasks?type=AFFILIATION&status=INACTIVE", &tasks)
 		for _, t := range tasks {
-			log.Debugf("TASK: %+v", t)
+			c.logger().Debugf("TASK: %+v", t)
 			if t.Status == "ACTIVE" || t.Status == "RESET" || t.CompletedAt != "" || !strings.HasPrefix(t.Filename, taskFilenamePrefix) {
 				continue
 			}
 			var createdAt time.Time
 			createdAt, err = time.Parse("2006-01-02T15:04:05", t.CreatedAt)
 			if err != nil {
-				log.Error(err)
+				c.logger().Error(err)
 				return
 			}
 			if now.Sub(createdAt).Minutes() > taskRetentionMin && len(t.Records) > batchSize {
-				t.activate()
+				t.activate(c)
 				continue
 			}
 			taskID = t.ID
@@ -100,12 +107,52 @@ func setupTask() (err error) {
 			taskRecordCount = len(t.Records)
 			return
 		}
-		newTask()
+		return newTask(c)
 
 	} else if now.Sub(taskCreatedAt).Minutes() > taskRetentionMin && taskRecordCount > batchSize {
-		log.Debug(now.Sub(taskCreatedAt).Minutes(), taskRetentionMin, taskRecordCount, batchSize)
-		(&Task{ID: taskID}).activate()
-		newTask()
+		c.logger().Debug(now.Sub(taskCreatedAt).Minutes(), taskRetentionMin, taskRecordCount, batchSize)
+		(&Task{ID: taskID}).activate(c)
+		// NB! a new task gets created with the next event if it can't be created now
+		taskID = 0
+		return newTask(c)
+	}
+	return
+}
+
+// isTaskDue checks if the current task can be submitted for processing.
+func isTaskDue() bool {
+	return taskID != 0 && taskRecordCount > batchSize && time.Since(taskCreatedAt).Minutes() > taskRetentionMin
+}
+
+// activateDueTask activates the current task if it is due for processing
+// and, if renew is set, starts a new one.
+func activateDueTask(renew bool) error {
+	taskIDMutex.Lock()
+	defer taskIDMutex.Unlock()
+	if isTaskDue() {
+		(&Task{ID: taskID}).activate(&oh)
+		// NB! a new task gets created with the next event if it can't be created now
+		taskID = 0
+		if renew {
+			return newTask(&oh)
+		}
+	}
+	return nil
+}
+
+// addTaskRecords adds the records to the current affiliation task with the ORCID Hub client.
+func addTaskRecords(c *Client, records []Record) (err error) {
+	var task Task
+	err = c.patch("api/v1/affiliations/"+strconv.Itoa(taskID), Task{ID: taskID, Records: records}, &task)
+	if err != nil {
+		c.logger().Error("failed to update the taks: ", err)
+		return
+	}
+	taskRecordCountMutex.Lock()
+	taskRecordCount += len(records)
+	taskRecordCountMutex.Unlock()
+	for _, r := range records {
+		recordsAdded.inc(r.AffiliationType)
 	}
 	return
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the span kinds
+const (
+	spanInternal = trace.SpanKindInternal
+	spanServer   = trace.SpanKindServer
+	spanClient   = trace.SpanKindClient
+	spanConsumer = trace.SpanKindConsumer
+)
+
+const (
+	// the W3C trace context header (and the SQS message attribute)
+	traceParentHeader  = "traceparent"
+	defaultServiceName = "orcidhub-integration"
+	otlpTracesPath     = "/v1/traces"
+	spanBatchSize      = 256
+	spanExportInterval = 5 * time.Second
+	spanExportTimeout  = 10 * time.Second
+)
+
+// the W3C trace context propagation
+var traceContext propagation.TraceContext
+
+// spanContext - the W3C trace context of a span.
+type spanContext struct {
+	trace.SpanContext
+}
+
+// isValid checks if both the trace and the span IDs are set.
+func (sc spanContext) isValid() bool {
+	return sc.IsValid()
+}
+
+// traceParent returns the traceparent header value, e.g.,
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func (sc spanContext) traceParent() string {
+	if !sc.isValid() {
+		return ""
+	}
+	carrier := propagation.MapCarrier{}
+	traceContext.Inject(contextWithSpan(context.Background(), sc), carrier)
+	return carrier.Get(traceParentHeader)
+}
+
+// parseTraceParent parses the traceparent header value.
+func parseTraceParent(value string) (sc spanContext, ok bool) {
+	ctx := traceContext.Extract(context.Background(), propagation.MapCarrier{traceParentHeader: value})
+	sc.SpanContext = trace.SpanContextFromContext(ctx)
+	return sc, sc.isValid()
+}
+
+// contextWithSpan returns the context carrying the span context (the parent of the outbound call spans).
+func contextWithSpan(ctx context.Context, sc spanContext) context.Context {
+	return trace.ContextWithSpanContext(ctx, sc.SpanContext)
+}
+
+// span - the timed operation of a trace, e.g., the event handling, a processing stage, or an HTTP call.
+type span struct {
+	trace.Span
+}
+
+// startSpan starts a new span as the child of the parent (if valid), otherwise a new trace.
+// It returns nil if the tracing is not enabled. All the span methods accept nil spans.
+func startSpan(parent spanContext, name string, kind trace.SpanKind) *span {
+	t := tracing
+	if t == nil {
+		return nil
+	}
+	_, s := t.tracer.Start(contextWithSpan(context.Background(), parent), name, trace.WithSpanKind(kind))
+	return &span{s}
+}
+
+// context returns the span context (empty, if the span is nil).
+func (s *span) context() spanContext {
+	if s == nil {
+		return spanContext{}
+	}
+	return spanContext{s.SpanContext()}
+}
+
+// set sets the attribute of the span.
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	var a attribute.KeyValue
+	switch v := value.(type) {
+	case string:
+		a = attribute.String(key, v)
+	case int:
+		a = attribute.Int(key, v)
+	case bool:
+		a = attribute.Bool(key, v)
+	case float64:
+		a = attribute.Float64(key, v)
+	default:
+		a = attribute.String(key, fmt.Sprint(value))
+	}
+	s.SetAttributes(a)
+}
+
+// finish ends the span (the span gets exported with the next batch).
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		// NB! the status message gets redacted as the log messages
+		s.SetStatus(codes.Error, redaction.redact(err.Error()))
+	}
+	s.End()
+}
+
+// tracer - exports the finished spans to the OpenTelemetry collector via OTLP/HTTP in batches.
+type tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// tracing is nil unless the OpenTelemetry collector endpoint is set (OTEL_EXPORTER_OTLP_ENDPOINT).
+var tracing *tracer
+
+// setTracing enables (or disables) the tracing and starts the periodic span export.
+// The previous tracer (if any) gets shut down.
+func setTracing(c Config) {
+	tracing.shutdown()
+	tracing = nil
+	if c.Tracing.Endpoint == "" {
+		return
+	}
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(strings.TrimSuffix(c.Tracing.Endpoint, "/")+otlpTracesPath),
+		otlptracehttp.WithTimeout(spanExportTimeout))
+	if err != nil {
+		log.Error("failed to set up the span export: ", err)
+		return
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter,
+			sdktrace.WithBatchTimeout(spanExportInterval),
+			sdktrace.WithMaxExportBatchSize(spanBatchSize)),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", c.Tracing.ServiceName))),
+	)
+	tracing = &tracer{provider: provider, tracer: provider.Tracer(defaultServiceName)}
+}
+
+// shutdown stops the periodic span export and exports the remaining spans.
+func (t *tracer) shutdown() {
+	if t == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), spanExportTimeout)
+	defer cancel()
+	if err := t.provider.Shutdown(ctx); err != nil {
+		log.Warn("failed to export the spans: ", err)
+	}
+}
+
+// flush exports the finished spans.
+func (t *tracer) flush() {
+	if t == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), spanExportTimeout)
+	defer cancel()
+	if err := t.provider.ForceFlush(ctx); err != nil {
+		log.Warn("failed to export the spans: ", err)
+	}
+}
+
+// tracingTransport - the HTTP transport recording a client span of each call (as the child
+// of the span in the request context) and propagating the trace context (traceparent).
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	parent := spanContext{trace.SpanContextFromContext(req.Context())}
+	endpoint := endpointTemplate(req.URL.Path)
+	s := startSpan(parent, req.Method+" "+endpoint, spanClient)
+	if s == nil {
+		return base.RoundTrip(req)
+	}
+	s.set("http.method", req.Method)
+	s.set("http.route", endpoint)
+	s.set("net.peer.name", req.URL.Hostname())
+
+	// NB! the round tripper must not modify the original request
+	req = req.WithContext(req.Context())
+	req.Header = req.Header.Clone()
+	traceContext.Inject(contextWithSpan(req.Context(), s.context()), propagation.HeaderCarrier(req.Header))
+	resp, err := base.RoundTrip(req)
+	if err == nil {
+		s.set("http.status_code", resp.StatusCode)
+		if resp.StatusCode >= http.StatusInternalServerError {
+			s.finish(fmt.Errorf("%s %s: %s", req.Method, endpoint, resp.Status))
+			return resp, err
+		}
+	}
+	s.finish(err)
+	return resp, err
+}
+
+// startTrace starts the span of the event (as the child of the incoming trace context, if any).
+func (e *Event) startTrace() {
+	name := "batch"
+	if !e.isBatch() {
+		name = "event " + iif(e.Type == "", "none", e.Type)
+	}
+	e.span = startSpan(e.parent, name, spanConsumer)
+	if e.span == nil {
+		return
+	}
+	// NB! the event gets the ID (if it hasn't got one) with the event scoped logger
+	e.log = nil
+	e.logger()
+	for k, v := range map[string]string{"event.id": e.id, "event.type": e.Type,
+		"messaging.message_id": e.sqsMessageID, "request.id": e.requestID} {
+		if v != "" {
+			e.span.set(k, v)
+		}
+	}
+}
+
+// stage starts the span of the event processing stage, e.g., the identity look-up.
+func (e *Event) stage(name string) *span {
+	return startSpan(e.span.context(), name, spanInternal)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ORCID Hub webhook event types
+const (
+	// the user linked the ORCID account and granted the access to the profile
+	hubUserCreated = "CREATED"
+	// the user profile or the ORCID iD of the user changed
+	hubUserUpdated = "UPDATED"
+	// the user revoked the access token
+	hubTokenRevoked = "REVOKED"
+	// the ORCID account was unlinked from the Hub user account
+	hubOrcidUnlinked = "UNLINKED"
+	// the user was deleted from the Hub
+	hubUserDeleted = "DELETED"
+)
+
+// isHubEvent checks if the event is an ORCID Hub webhook event.
+func (e *Event) isHubEvent() bool {
+	if e.EPPN == "" {
+		return false
+	}
+	switch e.Type {
+	case hubUserCreated, hubUserUpdated, hubTokenRevoked, hubOrcidUnlinked, hubUserDeleted:
+		return true
+	}
+	return false
+}
+
+// upi extracts and validates the UPI of the event EPPN.
+func (e *Event) upi() (string, error) {
+	parts := strings.Split(e.EPPN, "@")
+	upi := parts[0]
+	if !isValidUPI(upi) {
+		return "", fmt.Errorf("invalid UPI: %q", pseudonym(piiUPI, upi))
+	}
+	return upi, nil
+}
+
+// processHubEvent routes the ORCID Hub webhook event.
+func (e *Event) processHubEvent() (string, error) {
+	if e.ORCID != "" {
+		orcid, err := parseOrcidID(e.ORCID)
+		if err != nil {
+			return "", fmt.Errorf("rejected the event %q: %v", e.Type, err)
+		}
+		e.ORCID = orcid.String()
+	}
+	switch e.Type {
+	case hubUserCreated:
+		upi, err := e.upi()
+		if err != nil {
+			return "", err
+		}
+		if e.dryRun != nil {
+			e.dryRun.setConsent("restored")
+		} else {
+			consents.restore(upi)
+		}
+		return e.processUserRegistration()
+	case hubUserUpdated:
+		upi, err := e.upi()
+		if err != nil {
+			return "", err
+		}
+		if consents.isWithdrawn(upi) {
+			e.logger().Infof("the user (UPI: %s) has withdrawn the consent, the update is ignored", pseudonym(piiUPI, upi))
+			return "", nil
+		}
+		// re-sync the user (and update the ORCID iD if it has changed)
+		return e.processUserRegistration()
+	case hubTokenRevoked, hubOrcidUnlinked, hubUserDeleted:
+		return e.processConsentWithdrawal()
+	default:
+		return "", fmt.Errorf("unhandled event: %s", e.describe())
+	}
+}
+
+// processConsentWithdrawal handles the access token revocation, ORCID account unlinking
+// or the user deletion: it clears the ORCID iD stored in the identity system and suppresses
+// further updates for the user.
+func (e *Event) processConsentWithdrawal() (string, error) {
+	upi, err := e.upi()
+	if err != nil {
+		return "", err
+	}
+	id, err := e.identity(upi)
+	if err != nil || id.ID == 0 {
+		return "", fmt.Errorf("failed to retrieve the identity record for UPI %s: %v", pseudonym(piiUPI, upi), err)
+	}
+	// NB! keep the ORCID iD if it is not the one the user has unlinked
+	if current := id.GetORCID(); current != "" && (e.ORCID == "" || e.ORCID == current) {
+		if err = id.removeOrcid(api.with(e.logger()).in(e.span), e.dryRun); err != nil {
+			return "", err
+		}
+	}
+
+	// NB! the withdrawal is recorded on the best-effort basis: without the consent store
+	// it is kept only in memory, i.e., it gets lost with the next cold start
+	if e.dryRun != nil {
+		e.dryRun.setConsent("withdrawn")
+	} else {
+		if consents.path == "" {
+			e.logger().Warnf("the consent store (CONSENT_STORE) is not set, the consent withdrawal (UPI: %s) is kept only in memory",
+				pseudonym(piiUPI, upi))
+		}
+		consents.withdraw(upi)
+	}
+	return fmt.Sprintf("the consent withdrawn (UPI: %s, event: %s)", pseudonym(piiUPI, upi), e.Type), nil
+}